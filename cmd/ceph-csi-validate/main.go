@@ -0,0 +1,294 @@
+// Command ceph-csi-validate validates a ceph-csi deployment with the specs of
+// the test/ceph-csi suite, without knowing ginkgo or the e2e framework.
+//
+//	ceph-csi-validate bootstrap -config cluster.yaml
+//	ceph-csi-validate preflight -config cluster.yaml
+//	ceph-csi-validate run -config cluster.yaml -features rbd,snapshot -maturity GA
+//	ceph-csi-validate report -output-dir ceph-csi-validate-20230601-120000
+//	ceph-csi-validate cleanup -config cluster.yaml
+//
+// The specs are run by the compiled suite, build it next to this command with
+//
+//	go test -c -o ceph_csi.test ./test/ceph-csi
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cephcsi "github.com/ydp/ceph-csi-test/test/ceph-csi"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+const (
+	// suiteBinaryName is the name of the compiled suite.
+	suiteBinaryName = "ceph_csi.test"
+
+	// the files written to the output directory of a run.
+	jsonReportFile  = "report.json"
+	junitReportFile = "junit.xml"
+	suiteLogFile    = "suite.log"
+	summaryFile     = "summary.txt"
+)
+
+const usage = `Usage: ceph-csi-validate <command> [flags]
+
+Commands:
+  bootstrap  create the ceph users and the secrets of ceph-csi
+  preflight  check that the cluster, ceph-csi and ceph can be reached
+  run        run the specs of the selected features
+  report     print the summary of a run
+  cleanup    remove what an interrupted run left behind
+
+Run ceph-csi-validate <command> -h for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "bootstrap":
+		err = bootstrap(args)
+	case "preflight":
+		err = preflight(args)
+	case "run":
+		err = run(args)
+	case "report":
+		err = report(args)
+	case "cleanup":
+		err = cleanup(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// command holds the flags shared by the commands that talk to the cluster.
+type command struct {
+	fs *flag.FlagSet
+	// suite has the flags of the suite, they are forwarded to the compiled
+	// suite by run.
+	suite      *flag.FlagSet
+	kubeconfig string
+}
+
+func newCommand(name string) *command {
+	c := &command{
+		fs:    flag.NewFlagSet(name, flag.ExitOnError),
+		suite: flag.NewFlagSet(name, flag.ContinueOnError),
+	}
+	cephcsi.RegisterFlags(c.suite)
+	c.suite.VisitAll(func(f *flag.Flag) {
+		c.fs.Var(f.Value, f.Name, f.Usage)
+	})
+	c.fs.StringVar(&c.kubeconfig, "kubeconfig", defaultKubeconfig(), "path to the kubeconfig of the cluster")
+
+	return c
+}
+
+// parse parses the arguments and configures the suite and the e2e framework
+// with them.
+func (c *command) parse(args []string) error {
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	if c.fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(c.fs.Args(), " "))
+	}
+	if err := cephcsi.ApplyFlags(c.fs); err != nil {
+		return err
+	}
+	framework.TestContext.KubeConfig = c.kubeconfig
+
+	return nil
+}
+
+// suiteArgs returns the suite flags that were set on the command line.
+func (c *command) suiteArgs() []string {
+	var args []string
+	c.fs.Visit(func(f *flag.Flag) {
+		if c.suite.Lookup(f.Name) != nil {
+			args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		}
+	})
+
+	return args
+}
+
+func defaultKubeconfig() string {
+	if path, ok := os.LookupEnv("KUBECONFIG"); ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".kube", "config")
+}
+
+func bootstrap(args []string) error {
+	c := newCommand("bootstrap")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+
+	return cephcsi.Bootstrap(os.Stdout)
+}
+
+func preflight(args []string) error {
+	c := newCommand("preflight")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+
+	return cephcsi.Preflight(os.Stdout)
+}
+
+func cleanup(args []string) error {
+	c := newCommand("cleanup")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+
+	return cephcsi.Cleanup(os.Stdout)
+}
+
+func report(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "", "output directory of the run")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *outputDir == "" {
+		return errors.New("-output-dir is required")
+	}
+
+	return cephcsi.WriteReport(os.Stdout, filepath.Join(*outputDir, jsonReportFile))
+}
+
+func run(args []string) error {
+	c := newCommand("run")
+	features := c.fs.String("features", "",
+		"comma separated features to validate, empty for all: "+strings.Join(cephcsi.Features(), ", "))
+	maturity := c.fs.String("maturity", "all", "maturity of the specs to run: GA, Beta, Alpha or all")
+	outputDir := c.fs.String("output-dir", "ceph-csi-validate-"+time.Now().Format("20060102-150405"),
+		"directory the reports and logs are written to")
+	suiteBinary := c.fs.String("suite-binary", "",
+		"path of the compiled suite, defaults to "+suiteBinaryName+" next to this command or in PATH")
+	timeout := c.fs.Duration("timeout", 2*time.Hour, "timeout of the whole run")
+	dryRun := c.fs.Bool("dry-run", false, "list the selected specs without running them")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+
+	var featureList []string
+	if *features != "" {
+		featureList = strings.Split(*features, ",")
+	}
+	labelFilter, err := cephcsi.LabelFilter(featureList)
+	if err != nil {
+		return err
+	}
+	focus, err := cephcsi.MaturityFocus(*maturity)
+	if err != nil {
+		return err
+	}
+	binary, err := findSuiteBinary(*suiteBinary)
+	if err != nil {
+		return err
+	}
+
+	out, err := filepath.Abs(*outputDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	suiteArgs := []string{
+		"-kubeconfig=" + c.kubeconfig,
+		"-report-dir=" + out,
+		"-ginkgo.label-filter=" + labelFilter,
+		"-ginkgo.json-report=" + filepath.Join(out, jsonReportFile),
+		"-ginkgo.junit-report=" + filepath.Join(out, junitReportFile),
+		"-ginkgo.timeout=" + timeout.String(),
+		"-ginkgo.no-color",
+		"-ginkgo.v",
+	}
+	if focus != "" {
+		suiteArgs = append(suiteArgs, "-ginkgo.focus="+focus)
+	}
+	if *dryRun {
+		suiteArgs = append(suiteArgs, "-ginkgo.dry-run")
+	}
+	suiteArgs = append(suiteArgs, c.suiteArgs()...)
+
+	logFile, err := os.Create(filepath.Join(out, suiteLogFile))
+	if err != nil {
+		return fmt.Errorf("failed to create suite log: %w", err)
+	}
+	defer logFile.Close()
+
+	fmt.Fprintf(os.Stdout, "running %s %s\n", binary, strings.Join(suiteArgs, " "))
+	cmd := exec.Command(binary, suiteArgs...)
+	cmd.Stdout = io.MultiWriter(os.Stdout, logFile)
+	cmd.Stderr = io.MultiWriter(os.Stderr, logFile)
+	runErr := cmd.Run()
+
+	summary, err := os.Create(filepath.Join(out, summaryFile))
+	if err != nil {
+		return fmt.Errorf("failed to create summary: %w", err)
+	}
+	defer summary.Close()
+	fmt.Fprintln(os.Stdout)
+	reportErr := cephcsi.WriteReport(io.MultiWriter(os.Stdout, summary), filepath.Join(out, jsonReportFile))
+	fmt.Fprintf(os.Stdout, "\nartifacts written to %s\n", out)
+
+	if runErr != nil {
+		return fmt.Errorf("suite failed: %w", runErr)
+	}
+
+	return reportErr
+}
+
+// findSuiteBinary returns the path of the compiled suite.
+func findSuiteBinary(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+
+	if exe, err := os.Executable(); err == nil {
+		candidate := filepath.Join(filepath.Dir(exe), suiteBinaryName)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	if path, err := exec.LookPath(suiteBinaryName); err == nil {
+		return path, nil
+	}
+
+	return "", fmt.Errorf("%s not found, build it with 'go test -c -o %s ./test/ceph-csi' "+
+		"or pass -suite-binary", suiteBinaryName, suiteBinaryName)
+}
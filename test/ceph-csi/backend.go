@@ -0,0 +1,625 @@
+package ceph_csi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+// CephBackend is the single seam through which the tests talk to the ceph
+// cluster. Every validation of the ceph side goes through it, so the harness
+// logic can run against a fake cluster as well as a real one.
+type CephBackend interface {
+	// ClusterID returns the fsid of the ceph cluster.
+	ClusterID() (string, error)
+
+	// ListImages returns the names of the rbd images in the pool.
+	ListImages(pool string) ([]string, error)
+	// ImageInfo returns the details of an rbd image.
+	ImageInfo(pool, image string) (*rbdImageInfo, error)
+	// ListImageSnapshots returns the snapshots of an rbd image.
+	ListImageSnapshots(pool, image string) ([]rbdSnapInfo, error)
+	// ListTrash returns the rbd images that are in the trash of the pool.
+	ListTrash(pool string) ([]rbdTrashInfo, error)
+	// ReadImage returns the first length bytes of an rbd image.
+	ReadImage(pool, image string, length int) ([]byte, error)
+	// CreateImage creates an rbd image of size bytes, e.g. for a static
+	// PersistentVolume.
+	CreateImage(pool, image string, size int64) error
+	// DeleteImage removes an rbd image that ceph-csi does not manage.
+	DeleteImage(pool, image string) error
+
+	// ListSubVolumes returns the subvolumes of a subvolumegroup.
+	ListSubVolumes(fsName, group string) ([]cephfsSubVolume, error)
+	// SubVolumeInfo returns the details of a subvolume.
+	SubVolumeInfo(fsName, group, subVolume string) (*cephfsSubVolumeInfo, error)
+	// ListSubVolumeSnapshots returns the snapshots of a subvolume.
+	ListSubVolumeSnapshots(fsName, group, subVolume string) ([]cephfsSnapshot, error)
+	// CreateSubVolume creates a subvolume with a quota of size bytes.
+	CreateSubVolume(fsName, group, subVolume string, size int64) error
+	// DeleteSubVolume removes a subvolume that ceph-csi does not manage.
+	DeleteSubVolume(fsName, group, subVolume string) error
+
+	// ListFilesystems returns the cephfs filesystems of the cluster.
+	ListFilesystems() ([]cephFilesystem, error)
+	// ListOmapKeys returns the omap keys of a rados object, an object that
+	// does not exist has no keys.
+	ListOmapKeys(pool, namespace, object string) ([]string, error)
+	// RemoveOmapKey removes a key from the omap of a rados object.
+	RemoveOmapKey(pool, namespace, object, key string) error
+	// RemoveObject removes a rados object.
+	RemoveObject(pool, namespace, object string) error
+
+	// DF returns the usage of the cluster and its pools.
+	DF() (*cephDF, error)
+
+	// AuthGet returns the key and caps of a cephx entity, e.g. client.admin.
+	AuthGet(entity string) (*cephAuthEntity, error)
+	// AuthGetOrCreate creates the entity with the caps when it does not
+	// exist, and returns it.
+	AuthGetOrCreate(entity string, caps map[string]string) (*cephAuthEntity, error)
+	// AuthCaps replaces the caps of an existing entity.
+	AuthCaps(entity string, caps map[string]string) error
+}
+
+// errCephObjectNotFound is returned by a CephBackend when the requested image,
+// subvolume or snapshot does not exist.
+var errCephObjectNotFound = errors.New("ceph object not found")
+
+type rbdImageParent struct {
+	Pool     string `json:"pool"`
+	Image    string `json:"image"`
+	Snapshot string `json:"snapshot"`
+}
+
+type rbdImageInfo struct {
+	Name            string          `json:"name"`
+	ID              string          `json:"id"`
+	Size            int64           `json:"size"`
+	Objects         int64           `json:"objects"`
+	Order           int             `json:"order"`
+	ObjectSize      int64           `json:"object_size"`
+	SnapshotCount   int             `json:"snapshot_count"`
+	BlockNamePrefix string          `json:"block_name_prefix"`
+	Format          int             `json:"format"`
+	Features        []string        `json:"features"`
+	DataPool        string          `json:"data_pool,omitempty"`
+	StripeUnit      int64           `json:"stripe_unit,omitempty"`
+	StripeCount     int64           `json:"stripe_count,omitempty"`
+	Parent          *rbdImageParent `json:"parent,omitempty"`
+}
+
+type rbdSnapInfo struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Protected string `json:"protected"`
+	Timestamp string `json:"timestamp"`
+}
+
+type rbdTrashInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type cephfsSubVolume struct {
+	Name string `json:"name"`
+}
+
+type cephfsSubVolumeInfo struct {
+	Path       string      `json:"path"`
+	DataPool   string      `json:"data_pool"`
+	BytesUsed  int64       `json:"bytes_used"`
+	BytesQuota cephfsQuota `json:"bytes_quota"`
+	State      string      `json:"state"`
+	Type       string      `json:"type"`
+}
+
+// cephfsQuota is the quota of a subvolume in bytes, 0 when ceph reports it as
+// "infinite".
+type cephfsQuota int64
+
+func (q *cephfsQuota) UnmarshalJSON(data []byte) error {
+	if string(data) == `"infinite"` {
+		*q = 0
+
+		return nil
+	}
+	var quota int64
+	if err := json.Unmarshal(data, &quota); err != nil {
+		return fmt.Errorf("invalid subvolume quota %s: %w", data, err)
+	}
+	*q = cephfsQuota(quota)
+
+	return nil
+}
+
+type cephfsSnapshot struct {
+	Name string `json:"name"`
+}
+
+type cephFilesystem struct {
+	Name         string   `json:"name"`
+	MetadataPool string   `json:"metadata_pool"`
+	DataPools    []string `json:"data_pools"`
+}
+
+type cephDFStats struct {
+	TotalBytes        int64 `json:"total_bytes"`
+	TotalAvailBytes   int64 `json:"total_avail_bytes"`
+	TotalUsedRawBytes int64 `json:"total_used_raw_bytes"`
+}
+
+type cephDFPoolStats struct {
+	Stored   int64 `json:"stored"`
+	Objects  int64 `json:"objects"`
+	MaxAvail int64 `json:"max_avail"`
+}
+
+type cephDFPool struct {
+	Name  string          `json:"name"`
+	ID    int64           `json:"id"`
+	Stats cephDFPoolStats `json:"stats"`
+}
+
+type cephDF struct {
+	Stats cephDFStats  `json:"stats"`
+	Pools []cephDFPool `json:"pools"`
+}
+
+type cephAuthEntity struct {
+	Entity string `json:"entity"`
+	Key    string `json:"key"`
+	// Caps is keyed by the daemon type, e.g. mon or osd.
+	Caps map[string]string `json:"caps"`
+}
+
+const (
+	// cephBackendLocal runs the ceph commands with the ceph client installed
+	// on the machine running the tests.
+	cephBackendLocal = "local"
+	// cephBackendToolbox runs the ceph commands inside the rook toolbox pod.
+	cephBackendToolbox = "toolbox"
+
+	rookToolboxLabel     = "app=rook-ceph-tools"
+	rookToolboxContainer = "rook-ceph-tools"
+)
+
+// cephBackendMode selects how getCephBackend reaches the ceph cluster, it is
+// set with the -ceph-backend flag.
+var cephBackendMode = cephBackendLocal
+
+// cephBackendOverride replaces the backend returned by getCephBackend when it
+// is set, e.g. with a fakeCephBackend to exercise the helpers without a
+// cluster.
+var cephBackendOverride CephBackend
+
+// getCephBackend returns the CephBackend the validation helpers should use.
+func getCephBackend(f *framework.Framework) CephBackend {
+	if cephBackendOverride != nil {
+		return cephBackendOverride
+	}
+
+	if cephBackendMode == cephBackendToolbox {
+		return newCLICephBackend(toolboxCephCommandRunner(f))
+	}
+
+	return newCLICephBackend(runLocalCephCommand)
+}
+
+// validateCephBackendMode checks the value passed with the -ceph-backend flag.
+func validateCephBackendMode(mode string) error {
+	switch mode {
+	case cephBackendLocal, cephBackendToolbox:
+		return nil
+	}
+
+	return fmt.Errorf("unknown ceph backend %q, expected %q or %q", mode, cephBackendLocal, cephBackendToolbox)
+}
+
+// cephCommandRunner runs a ceph, rbd or rados command and returns its stdout.
+type cephCommandRunner func(args ...string) ([]byte, error)
+
+// runLocalCephCommand runs the command with the ceph client installed on the
+// machine running the tests.
+func runLocalCephCommand(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to run %q: %w, %s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// toolboxPodName is the rook-ceph-tools pod the toolbox backends run the
+// commands in. It is looked up with the first command and again only when the
+// pod is gone, e.g. after the toolbox deployment replaced it.
+var toolboxPodName string
+
+// toolboxCephCommandRunner returns a cephCommandRunner that executes the
+// commands inside the rook-ceph-tools pod, so the machine running the tests
+// does not need a ceph.conf and keyring.
+func toolboxCephCommandRunner(f *framework.Framework) cephCommandRunner {
+	return func(args ...string) ([]byte, error) {
+		cmd := shellJoin(args)
+		for lookedUp := false; ; {
+			if toolboxPodName == "" {
+				opt := &metav1.ListOptions{
+					LabelSelector: rookToolboxLabel,
+				}
+				podName, _, err := findPodAndContainerName(f, cephCSINamespace, rookToolboxContainer, opt)
+				if err != nil {
+					return nil, fmt.Errorf("failed to find toolbox pod in namespace %s: %w", cephCSINamespace, err)
+				}
+				toolboxPodName = podName
+				lookedUp = true
+			}
+
+			stdout, stderr, err := execCommandInPodWithName(f, cmd, toolboxPodName, rookToolboxContainer,
+				cephCSINamespace)
+			if apierrors.IsNotFound(err) && !lookedUp {
+				framework.Logf("toolbox pod %s is gone, looking it up again", toolboxPodName)
+				toolboxPodName = ""
+
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to run %q in pod %s: %w, %s", cmd, toolboxPodName, err, stderr)
+			}
+
+			return []byte(stdout), nil
+		}
+	}
+}
+
+// shellJoin quotes the arguments so they can be passed to /bin/sh -c.
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, "'"+strings.ReplaceAll(arg, "'", `'\''`)+"'")
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// cliCephBackend implements CephBackend with the ceph, rbd and rados command
+// line tools.
+type cliCephBackend struct {
+	run cephCommandRunner
+}
+
+func newCLICephBackend(run cephCommandRunner) *cliCephBackend {
+	return &cliCephBackend{run: run}
+}
+
+// enoent is how the rbd and rados tools print ENOENT.
+const enoent = ": (2) No such file or directory"
+
+// cephNotFound returns errCephObjectNotFound wrapping err when the output of
+// the failed command has one of the messages, or err otherwise. The messages
+// have to name the object the command is about: the ceph tools report a
+// missing keyring, pool or filesystem with ENOENT as well, and those must not
+// pass as a deleted object.
+func cephNotFound(err error, messages ...string) error {
+	for _, msg := range messages {
+		if strings.Contains(err.Error(), msg) {
+			return fmt.Errorf("%w: %v", errCephObjectNotFound, err)
+		}
+	}
+
+	return err
+}
+
+// rbdImageNotFound are the messages of rbd for a missing image.
+func rbdImageNotFound(image string) []string {
+	return []string{"error opening image " + image + enoent}
+}
+
+// subVolumeNotFound are the messages of the ceph fs subvolume commands for a
+// missing subvolume.
+func subVolumeNotFound(subVolume string) []string {
+	return []string{"Error ENOENT: subvolume '" + subVolume + "' does not exist"}
+}
+
+// radosObjectNotFound are the messages of rados for a missing object, rados
+// prints the pool, a separator and the object before the error.
+func radosObjectNotFound(object string) []string {
+	return []string{"/" + object + enoent, ">" + object + enoent}
+}
+
+func (cb *cliCephBackend) runJSON(obj interface{}, args ...string) error {
+	stdout, err := cb.run(args...)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(stdout, obj); err != nil {
+		return fmt.Errorf("failed to parse output of %q: %w", strings.Join(args, " "), err)
+	}
+
+	return nil
+}
+
+// rbdOptions returns the pool and rados namespace arguments for rbd commands.
+func rbdOptions(pool string) []string {
+	if radosNamespace != "" {
+		return []string{"--pool=" + pool, "--namespace=" + radosNamespace}
+	}
+
+	return []string{"--pool=" + pool}
+}
+
+func (cb *cliCephBackend) ClusterID() (string, error) {
+	fsID, err := cb.run("ceph", "fsid")
+	if err != nil {
+		return "", fmt.Errorf("failed getting clusterID: %w", err)
+	}
+	// remove new line present in fsID
+	return strings.Trim(string(fsID), "\n"), nil
+}
+
+func (cb *cliCephBackend) ListImages(pool string) ([]string, error) {
+	var images []string
+	args := append([]string{"rbd", "ls", "--format=json"}, rbdOptions(pool)...)
+	if err := cb.runJSON(&images, args...); err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	return images, nil
+}
+
+func (cb *cliCephBackend) ImageInfo(pool, image string) (*rbdImageInfo, error) {
+	info := &rbdImageInfo{}
+	args := append([]string{"rbd", "info", image, "--format=json"}, rbdOptions(pool)...)
+	if err := cb.runJSON(info, args...); err != nil {
+		return nil, fmt.Errorf("failed to get info of image %s: %w", image,
+			cephNotFound(err, rbdImageNotFound(image)...))
+	}
+
+	return info, nil
+}
+
+func (cb *cliCephBackend) ListImageSnapshots(pool, image string) ([]rbdSnapInfo, error) {
+	var snaps []rbdSnapInfo
+	args := append([]string{"rbd", "snap", "ls", image, "--format=json"}, rbdOptions(pool)...)
+	if err := cb.runJSON(&snaps, args...); err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of image %s: %w", image,
+			cephNotFound(err, rbdImageNotFound(image)...))
+	}
+
+	return snaps, nil
+}
+
+func (cb *cliCephBackend) ListTrash(pool string) ([]rbdTrashInfo, error) {
+	var trash []rbdTrashInfo
+	args := append([]string{"rbd", "trash", "ls", "--format=json"}, rbdOptions(pool)...)
+	if err := cb.runJSON(&trash, args...); err != nil {
+		return nil, fmt.Errorf("failed to list trash: %w", err)
+	}
+
+	return trash, nil
+}
+
+// ReadImage reads the first object of the image with rados, the image data
+// is not exported. The data objects of an image with a data pool are in the
+// data pool. An object that was never written reads as zeros.
+func (cb *cliCephBackend) ReadImage(pool, image string, length int) ([]byte, error) {
+	info, err := cb.ImageInfo(pool, image)
+	if err != nil {
+		return nil, err
+	}
+	dataPool := pool
+	if info.DataPool != "" {
+		dataPool = info.DataPool
+	}
+	object := info.BlockNamePrefix + ".0000000000000000"
+	data, err := cb.run(radosArgs(dataPool, radosNamespace, "get", object, "-")...)
+	if err != nil {
+		if errors.Is(cephNotFound(err, radosObjectNotFound(object)...), errCephObjectNotFound) {
+			return make([]byte, length), nil
+		}
+
+		return nil, fmt.Errorf("failed to read image %s: %w", image, err)
+	}
+	if len(data) > length {
+		data = data[:length]
+	}
+
+	return data, nil
+}
+
+// CreateImage creates the image with the size rounded down to MiB, the unit
+// rbd takes sizes in.
+func (cb *cliCephBackend) CreateImage(pool, image string, size int64) error {
+	args := append([]string{"rbd", "create", image, fmt.Sprintf("--size=%dM", size>>20)}, rbdOptions(pool)...)
+	if _, err := cb.run(args...); err != nil {
+		return fmt.Errorf("failed to create image %s: %w", image, err)
+	}
+
+	return nil
+}
+
+func (cb *cliCephBackend) DeleteImage(pool, image string) error {
+	args := append([]string{"rbd", "rm", image}, rbdOptions(pool)...)
+	if _, err := cb.run(args...); err != nil {
+		// rbd rm reports a missing image as a failed delete, the pool is
+		// opened before.
+		err = cephNotFound(err, append(rbdImageNotFound(image), "delete error"+enoent)...)
+
+		return fmt.Errorf("failed to delete image %s: %w", image, err)
+	}
+
+	return nil
+}
+
+func (cb *cliCephBackend) ListSubVolumes(fsName, group string) ([]cephfsSubVolume, error) {
+	var subVols []cephfsSubVolume
+	err := cb.runJSON(&subVols,
+		"ceph", "fs", "subvolume", "ls", fsName, "--group_name="+group, "--format=json")
+	if err != nil {
+		return nil, fmt.Errorf("error listing subvolumes: %w", err)
+	}
+
+	return subVols, nil
+}
+
+func (cb *cliCephBackend) SubVolumeInfo(fsName, group, subVolume string) (*cephfsSubVolumeInfo, error) {
+	info := &cephfsSubVolumeInfo{}
+	err := cb.runJSON(info,
+		"ceph", "fs", "subvolume", "info", fsName, subVolume, "--group_name="+group, "--format=json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info of subvolume %s: %w", subVolume,
+			cephNotFound(err, subVolumeNotFound(subVolume)...))
+	}
+
+	return info, nil
+}
+
+func (cb *cliCephBackend) ListSubVolumeSnapshots(fsName, group, subVolume string) ([]cephfsSnapshot, error) {
+	var snaps []cephfsSnapshot
+	err := cb.runJSON(&snaps,
+		"ceph", "fs", "subvolume", "snapshot", "ls", fsName, subVolume, "--group_name="+group, "--format=json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of subvolume %s: %w", subVolume,
+			cephNotFound(err, subVolumeNotFound(subVolume)...))
+	}
+
+	return snaps, nil
+}
+
+// CreateSubVolume creates the subvolume world-writable like the subvolumes of
+// ceph-csi, so pods that do not run as root can use it.
+func (cb *cliCephBackend) CreateSubVolume(fsName, group, subVolume string, size int64) error {
+	_, err := cb.run("ceph", "fs", "subvolume", "create", fsName, subVolume,
+		fmt.Sprintf("--size=%d", size), "--group_name="+group, "--mode=777")
+	if err != nil {
+		return fmt.Errorf("failed to create subvolume %s: %w", subVolume, err)
+	}
+
+	return nil
+}
+
+func (cb *cliCephBackend) DeleteSubVolume(fsName, group, subVolume string) error {
+	_, err := cb.run("ceph", "fs", "subvolume", "rm", fsName, subVolume, "--group_name="+group)
+	if err != nil {
+		return fmt.Errorf("failed to delete subvolume %s: %w", subVolume, cephNotFound(err, subVolumeNotFound(subVolume)...))
+	}
+
+	return nil
+}
+
+func (cb *cliCephBackend) ListFilesystems() ([]cephFilesystem, error) {
+	var filesystems []cephFilesystem
+	if err := cb.runJSON(&filesystems, "ceph", "fs", "ls", "--format=json"); err != nil {
+		return nil, fmt.Errorf("failed to list filesystems: %w", err)
+	}
+
+	return filesystems, nil
+}
+
+func (cb *cliCephBackend) ListOmapKeys(pool, namespace, object string) ([]string, error) {
+	stdout, err := cb.run(radosArgs(pool, namespace, "listomapkeys", object)...)
+	if err != nil {
+		// the directory objects are created with the first volume
+		if errors.Is(cephNotFound(err, radosObjectNotFound(object)...), errCephObjectNotFound) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to list omap keys of %s: %w", object, err)
+	}
+
+	return strings.Fields(string(stdout)), nil
+}
+
+// radosArgs returns the rados command with the pool and namespace arguments.
+func radosArgs(pool, namespace string, args ...string) []string {
+	args = append(append([]string{"rados"}, args...), "--pool="+pool)
+	if namespace != "" {
+		args = append(args, "--namespace="+namespace)
+	}
+
+	return args
+}
+
+func (cb *cliCephBackend) RemoveOmapKey(pool, namespace, object, key string) error {
+	if _, err := cb.run(radosArgs(pool, namespace, "rmomapkey", object, key)...); err != nil {
+		return fmt.Errorf("failed to remove omap key %s of %s: %w", key, object,
+			cephNotFound(err, radosObjectNotFound(object+"/"+key)...))
+	}
+
+	return nil
+}
+
+func (cb *cliCephBackend) RemoveObject(pool, namespace, object string) error {
+	if _, err := cb.run(radosArgs(pool, namespace, "rm", object)...); err != nil {
+		return fmt.Errorf("failed to remove object %s: %w", object, cephNotFound(err, radosObjectNotFound(object)...))
+	}
+
+	return nil
+}
+
+func (cb *cliCephBackend) DF() (*cephDF, error) {
+	df := &cephDF{}
+	if err := cb.runJSON(df, "ceph", "df", "--format=json"); err != nil {
+		return nil, fmt.Errorf("failed to get cluster usage: %w", err)
+	}
+
+	return df, nil
+}
+
+func (cb *cliCephBackend) AuthGet(entity string) (*cephAuthEntity, error) {
+	var entities []cephAuthEntity
+	if err := cb.runJSON(&entities, "ceph", "auth", "get", entity, "--format=json"); err != nil {
+		err = cephNotFound(err, "Error ENOENT: failed to find "+entity+" in keyring")
+
+		return nil, fmt.Errorf("failed to get auth of %s: %w", entity, err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("failed to get auth of %s: %w", entity, errCephObjectNotFound)
+	}
+
+	return &entities[0], nil
+}
+
+// capsArgs returns the caps as the daemon and caps argument pairs of the
+// ceph auth commands, in a stable order.
+func capsArgs(caps map[string]string) []string {
+	args := []string{}
+	for _, daemon := range sortedKeys(caps) {
+		args = append(args, daemon, caps[daemon])
+	}
+
+	return args
+}
+
+func (cb *cliCephBackend) AuthGetOrCreate(entity string, caps map[string]string) (*cephAuthEntity, error) {
+	var entities []cephAuthEntity
+	args := append([]string{"ceph", "auth", "get-or-create", entity}, capsArgs(caps)...)
+	if err := cb.runJSON(&entities, append(args, "--format=json")...); err != nil {
+		return nil, fmt.Errorf("failed to get or create auth of %s: %w", entity, err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("failed to get or create auth of %s: no entity returned", entity)
+	}
+
+	return &entities[0], nil
+}
+
+func (cb *cliCephBackend) AuthCaps(entity string, caps map[string]string) error {
+	args := append([]string{"ceph", "auth", "caps", entity}, capsArgs(caps)...)
+	if _, err := cb.run(args...); err != nil {
+		return fmt.Errorf("failed to set caps of %s: %w", entity, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package ceph_csi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// cannedCephCommands returns a cephCommandRunner that answers with the output
+// registered for the joined command line, or fails with the stderr registered
+// in failures. Anything else fails without a message the backend classifies.
+func cannedCephCommands(outputs, failures map[string]string) cephCommandRunner {
+	return func(args ...string) ([]byte, error) {
+		cmd := strings.Join(args, " ")
+		if stderr, ok := failures[cmd]; ok {
+			return nil, fmt.Errorf("failed to run %q: exit status 2, %s", cmd, stderr)
+		}
+		out, ok := outputs[cmd]
+		if !ok {
+			return nil, fmt.Errorf("failed to run %q: exit status 22, unexpected command", cmd)
+		}
+
+		return []byte(out), nil
+	}
+}
+
+// failingCephCommands returns a cephCommandRunner that fails every command
+// with the stderr.
+func failingCephCommands(stderr string) cephCommandRunner {
+	return func(args ...string) ([]byte, error) {
+		return nil, fmt.Errorf("failed to run %q: exit status 2, %s", strings.Join(args, " "), stderr)
+	}
+}
+
+var _ = Describe("CephBackend", Label("unit"), func() {
+	Context("cli", func() {
+		backend := newCLICephBackend(cannedCephCommands(map[string]string{
+			"ceph fsid": "7b6e5e7c-1d7b-4f39-a0b8-8d2d4c6f7a11\n",
+			"rbd ls --format=json --pool=replicapool": `["csi-vol-1","csi-vol-2"]`,
+			"rbd info csi-vol-1 --format=json --pool=replicapool": `{"name":"csi-vol-1","id":"12ab",
+				"size":1073741824,"order":22,"object_size":4194304,"block_name_prefix":"rbd_data.12ab",
+				"format":2,"features":["layering","striping"],"data_pool":"ec-pool","stripe_unit":65536,
+				"stripe_count":8}`,
+			"rbd trash ls --format=json --pool=replicapool":             `[{"id":"34cd","name":"csi-vol-3"}]`,
+			"rados get rbd_data.12ab.0000000000000000 - --pool=ec-pool": "LUKS\xba\xbe\x00\x02",
+			"ceph fs subvolume ls myfs --group_name=csi --format=json":  `[{"name":"csi-vol-4"}]`,
+			"ceph fs subvolume info myfs csi-vol-4 --group_name=csi --format=json": `{"path":"/volumes/csi/csi-vol-4/0a",
+				"data_pool":"myfs-replicated","bytes_quota":1073741824,"state":"complete","type":"subvolume"}`,
+			"ceph fs subvolume info myfs csi-vol-5 --group_name=csi --format=json": `{"path":"/volumes/csi/csi-vol-5/0a",
+				"data_pool":"myfs-replicated","bytes_quota":"infinite","state":"complete","type":"subvolume"}`,
+			"rbd create static-vol --size=1024M --pool=replicapool":                                  "",
+			"rbd rm static-vol --pool=replicapool":                                                   "",
+			"ceph fs subvolume create myfs static-vol --size=1073741824 --group_name=csi --mode=777": "",
+			"ceph fs subvolume rm myfs static-vol --group_name=csi":                                  "",
+			"rados rmomapkey csi.volumes.default csi.volume.pvc-1 --pool=replicapool":                "",
+			"rados rm csi.volume.b0285c97 --pool=replicapool":                                        "",
+			"ceph auth get client.csi-rbd-node --format=json": `[{"entity":"client.csi-rbd-node",
+				"key":"AQC8G+VkPR3eCBAAEyHNKgjoB1BhlVJdJBV13A==","caps":{"mgr":"allow rw","mon":"profile rbd",
+				"osd":"profile rbd"}}]`,
+			"ceph auth get-or-create client.csi-rbd-provisioner mgr allow rw mon profile rbd osd profile rbd --format=json": `[
+				{"entity":"client.csi-rbd-provisioner","key":"AQC7G+VkSxcANBAAM41nN7SlDA6UNg6WdNlFFw=="}]`,
+		}, map[string]string{
+			"rbd info csi-vol-9 --format=json --pool=replicapool": "rbd: error opening image csi-vol-9: " +
+				"(2) No such file or directory",
+			"rbd rm csi-vol-9 --pool=replicapool": "Removing image: 0% complete...failed.\n" +
+				"rbd: delete error: (2) No such file or directory",
+			"rados rm csi.volume.c1396d08 --pool=replicapool": "error removing replicapool>csi.volume.c1396d08: " +
+				"(2) No such file or directory",
+		}))
+
+		It("should parse the cluster id", func() {
+			Expect(backend.ClusterID()).To(Equal("7b6e5e7c-1d7b-4f39-a0b8-8d2d4c6f7a11"))
+		})
+
+		It("should parse rbd images, image info and trash", func() {
+			Expect(backend.ListImages("replicapool")).To(Equal([]string{"csi-vol-1", "csi-vol-2"}))
+
+			info, err := backend.ImageInfo("replicapool", "csi-vol-1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(info.Size).To(Equal(int64(1073741824)))
+			Expect(info.Features).To(ConsistOf("layering", "striping"))
+			Expect(info.DataPool).To(Equal("ec-pool"))
+			Expect(info.StripeUnit).To(Equal(int64(65536)))
+			Expect(info.StripeCount).To(Equal(int64(8)))
+
+			Expect(backend.ListTrash("replicapool")).To(ConsistOf(rbdTrashInfo{ID: "34cd", Name: "csi-vol-3"}))
+		})
+
+		It("should read the start of an image", func() {
+			Expect(backend.ReadImage("replicapool", "csi-vol-1", 4)).To(Equal([]byte("LUKS")))
+
+			_, err := backend.ReadImage("replicapool", "csi-vol-9", 4)
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+		})
+
+		It("should parse cephfs subvolumes", func() {
+			Expect(backend.ListSubVolumes("myfs", "csi")).To(ConsistOf(cephfsSubVolume{Name: "csi-vol-4"}))
+
+			info, err := backend.SubVolumeInfo("myfs", "csi", "csi-vol-4")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(info.Path).To(Equal("/volumes/csi/csi-vol-4/0a"))
+			Expect(info.BytesQuota).To(Equal(cephfsQuota(1073741824)))
+
+			info, err = backend.SubVolumeInfo("myfs", "csi", "csi-vol-5")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(info.BytesQuota).To(BeZero())
+		})
+
+		It("should create and delete static images and subvolumes", func() {
+			Expect(backend.CreateImage("replicapool", "static-vol", 1<<30)).To(Succeed())
+			Expect(backend.DeleteImage("replicapool", "static-vol")).To(Succeed())
+			Expect(backend.CreateSubVolume("myfs", "csi", "static-vol", 1<<30)).To(Succeed())
+			Expect(backend.DeleteSubVolume("myfs", "csi", "static-vol")).To(Succeed())
+
+			err := backend.DeleteImage("replicapool", "csi-vol-9")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+		})
+
+		It("should remove omap keys and objects", func() {
+			Expect(backend.RemoveOmapKey("replicapool", "", "csi.volumes.default", "csi.volume.pvc-1")).To(Succeed())
+			Expect(backend.RemoveObject("replicapool", "", "csi.volume.b0285c97")).To(Succeed())
+
+			err := backend.RemoveObject("replicapool", "", "csi.volume.c1396d08")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+		})
+
+		It("should parse the auth of a user", func() {
+			auth, err := backend.AuthGet("client.csi-rbd-node")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(auth.Key).To(Equal("AQC8G+VkPR3eCBAAEyHNKgjoB1BhlVJdJBV13A=="))
+			Expect(auth.Caps).To(Equal(rbdUserCaps))
+
+			auth, err = backend.AuthGetOrCreate("client.csi-rbd-provisioner", rbdUserCaps)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(auth.Key).To(Equal("AQC7G+VkSxcANBAAM41nN7SlDA6UNg6WdNlFFw=="))
+		})
+
+		It("should report missing objects as errCephObjectNotFound", func() {
+			_, err := backend.ImageInfo("replicapool", "csi-vol-9")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+		})
+	})
+
+	// the ceph tools report a missing keyring, pool or filesystem with
+	// ENOENT too, those must not pass as a deleted object.
+	DescribeTable("cli should not report client failures as missing objects",
+		func(stderr string) {
+			backend := newCLICephBackend(failingCephCommands(stderr))
+
+			_, err := backend.ImageInfo("replicapool", "csi-vol-1")
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeFalse())
+			_, err = backend.ReadImage("replicapool", "csi-vol-1", 4)
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeFalse())
+			err = backend.DeleteImage("replicapool", "csi-vol-1")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeFalse())
+			_, err = backend.SubVolumeInfo("myfs", "csi", "csi-vol-4")
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeFalse())
+			err = backend.DeleteSubVolume("myfs", "csi", "csi-vol-4")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeFalse())
+			keys, err := backend.ListOmapKeys("replicapool", "", "csi.volumes.default")
+			Expect(err).To(HaveOccurred())
+			Expect(keys).To(BeNil())
+			err = backend.RemoveObject("replicapool", "", "csi.volume.b0285c97")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeFalse())
+			_, err = backend.AuthGet("client.csi-rbd-node")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeFalse())
+		},
+		Entry("missing keyring", "2023-10-01T10:00:00.000+0000 7f0 -1 auth: unable to find a keyring on "+
+			"/etc/ceph/ceph.client.admin.keyring: (2) No such file or directory"),
+		Entry("missing pool", "rbd: error opening pool 'replicapool': (2) No such file or directory"),
+		Entry("missing rados pool", "error opening pool replicapool: (2) No such file or directory"),
+		Entry("missing filesystem", "Error ENOENT: filesystem 'myfs' does not exist"),
+		Entry("missing subvolume group", "Error ENOENT: subvolume group 'csi' does not exist"),
+		Entry("connection failure", "[errno 110] RADOS timed out (error connecting to the cluster)"),
+	)
+
+	Context("cli missing objects", func() {
+		backend := newCLICephBackend(cannedCephCommands(map[string]string{
+			"rbd info csi-vol-1 --format=json --pool=replicapool": `{"name":"csi-vol-1","block_name_prefix":"rbd_data.12ab"}`,
+		}, map[string]string{
+			"rados get rbd_data.12ab.0000000000000000 - --pool=replicapool": "error getting " +
+				"replicapool/rbd_data.12ab.0000000000000000: (2) No such file or directory",
+			"rbd snap ls csi-vol-9 --format=json --pool=replicapool": "rbd: error opening image csi-vol-9: " +
+				"(2) No such file or directory",
+			"ceph fs subvolume info myfs csi-vol-9 --group_name=csi --format=json": "Error ENOENT: " +
+				"subvolume 'csi-vol-9' does not exist",
+			"ceph fs subvolume rm myfs csi-vol-9 --group_name=csi": "Error ENOENT: subvolume 'csi-vol-9' does not exist",
+			"rados listomapkeys csi.volumes.default --pool=replicapool": "error getting omap key set " +
+				"replicapool/csi.volumes.default: (2) No such file or directory",
+			"rados rmomapkey csi.volumes.default csi.volume.pvc-1 --pool=replicapool": "error removing omap key " +
+				"replicapool/csi.volumes.default/csi.volume.pvc-1: (2) No such file or directory",
+			"ceph auth get client.csi-rbd-node --format=json": "Error ENOENT: failed to find client.csi-rbd-node in keyring",
+		}))
+
+		It("should classify the ENOENT messages naming the object", func() {
+			Expect(backend.ReadImage("replicapool", "csi-vol-1", 4)).To(Equal(make([]byte, 4)))
+			Expect(backend.ListOmapKeys("replicapool", "", "csi.volumes.default")).To(BeNil())
+
+			_, err := backend.ListImageSnapshots("replicapool", "csi-vol-9")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+			_, err = backend.SubVolumeInfo("myfs", "csi", "csi-vol-9")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+			err = backend.DeleteSubVolume("myfs", "csi", "csi-vol-9")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+			err = backend.RemoveOmapKey("replicapool", "", "csi.volumes.default", "csi.volume.pvc-1")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+			_, err = backend.AuthGet("client.csi-rbd-node")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+		})
+	})
+
+	Context("fake", func() {
+		It("should track images, trash and subvolumes", func() {
+			backend := newFakeCephBackend("fake-fsid")
+			backend.addImage("replicapool", rbdImageInfo{Name: "csi-vol-1", ID: "12ab"})
+			backend.addSubVolume("myfs", "csi", "csi-vol-2", cephfsSubVolumeInfo{Path: "/volumes/csi/csi-vol-2/0a"})
+
+			Expect(backend.ListImages("replicapool")).To(Equal([]string{"csi-vol-1"}))
+			Expect(backend.ListSubVolumes("myfs", "csi")).To(ConsistOf(cephfsSubVolume{Name: "csi-vol-2"}))
+
+			backend.removeImage("replicapool", "csi-vol-1", true)
+			backend.removeSubVolume("myfs", "csi", "csi-vol-2")
+
+			Expect(backend.ListImages("replicapool")).To(BeEmpty())
+			Expect(backend.ListTrash("replicapool")).To(ConsistOf(rbdTrashInfo{ID: "12ab", Name: "csi-vol-1"}))
+			_, err := backend.SubVolumeInfo("myfs", "csi", "csi-vol-2")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+		})
+
+		It("should create and delete static images and subvolumes", func() {
+			backend := newFakeCephBackend("fake-fsid")
+			Expect(backend.CreateImage("replicapool", "static-vol", 1<<30)).To(Succeed())
+			Expect(backend.CreateImage("replicapool", "static-vol", 1<<30)).ShouldNot(Succeed())
+			info, err := backend.ImageInfo("replicapool", "static-vol")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(info.Size).To(Equal(int64(1 << 30)))
+
+			Expect(backend.CreateSubVolume("myfs", "csi", "static-vol", 1<<30)).To(Succeed())
+			Expect(backend.SubVolumeInfo("myfs", "csi", "static-vol")).To(HaveField("Path", "/volumes/csi/static-vol/0a"))
+
+			Expect(backend.DeleteImage("replicapool", "static-vol")).To(Succeed())
+			Expect(backend.DeleteSubVolume("myfs", "csi", "static-vol")).To(Succeed())
+			err = backend.DeleteSubVolume("myfs", "csi", "static-vol")
+			Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+			Expect(backend.ListImages("replicapool")).To(BeEmpty())
+		})
+	})
+})
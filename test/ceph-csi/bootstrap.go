@@ -0,0 +1,152 @@
+package ceph_csi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// bootstrapSecrets returns the secrets bootstrap writes, the secrets of the
+// storage classes and the rados namespace secrets, which share the rbd users.
+func bootstrapSecrets() []csiSecret {
+	secrets := csiSecrets()
+	secrets = append(secrets,
+		csiSecret{
+			name: rbdNamespaceNodePluginSecretName, idKey: "userID", keyKey: "userKey",
+			user: rbdNodePluginUser, caps: rbdUserCaps,
+		},
+		csiSecret{
+			name: rbdNamespaceProvisionerSecretName, idKey: "userID", keyKey: "userKey",
+			user: rbdProvisionerUser, caps: rbdUserCaps,
+		},
+	)
+
+	return secrets
+}
+
+// ensureCephUser creates the user with the caps, or sets the caps of an
+// existing user that has other caps.
+func ensureCephUser(w io.Writer, backend CephBackend, user string, caps map[string]string) (*cephAuthEntity, error) {
+	entity := "client." + user
+	auth, err := backend.AuthGet(entity)
+	switch {
+	case errors.Is(err, errCephObjectNotFound):
+		auth, err = backend.AuthGetOrCreate(entity, caps)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(w, "created %s\n", entity)
+
+		return auth, nil
+	case err != nil:
+		return nil, err
+	}
+
+	for _, daemon := range sortedKeys(caps, auth.Caps) {
+		if caps[daemon] != auth.Caps[daemon] {
+			if err := backend.AuthCaps(entity, caps); err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(w, "updated caps of %s\n", entity)
+
+			return auth, nil
+		}
+	}
+	fmt.Fprintf(w, "%s is up to date\n", entity)
+
+	return auth, nil
+}
+
+// ensureSecret creates the secret with the data, or updates an existing
+// secret that has other data.
+func ensureSecret(w io.Writer, c kubernetes.Interface, name string, data map[string][]byte) error {
+	ctx := context.TODO()
+	secret, err := c.CoreV1().Secrets(cephCSISecretNamespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: cephCSISecretNamespace,
+			},
+			Type: v1.SecretTypeOpaque,
+			Data: data,
+		}
+		if _, err := c.CoreV1().Secrets(cephCSISecretNamespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create secret %s: %w", name, err)
+		}
+		fmt.Fprintf(w, "created secret %s/%s\n", cephCSISecretNamespace, name)
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get secret %s: %w", name, err)
+	}
+
+	changed := false
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for key, value := range data {
+		if !bytes.Equal(secret.Data[key], value) {
+			secret.Data[key] = value
+			changed = true
+		}
+	}
+	if !changed {
+		fmt.Fprintf(w, "secret %s/%s is up to date\n", cephCSISecretNamespace, name)
+
+		return nil
+	}
+	if _, err := c.CoreV1().Secrets(cephCSISecretNamespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update secret %s: %w", name, err)
+	}
+	fmt.Fprintf(w, "updated secret %s/%s\n", cephCSISecretNamespace, name)
+
+	return nil
+}
+
+// bootstrapCephCSI creates the ceph users of the README and writes their
+// credentials into the secrets of cephCSISecretNamespace. Running it again
+// only changes what differs from the documented setup.
+func bootstrapCephCSI(w io.Writer, c kubernetes.Interface, backend CephBackend) error {
+	if _, err := ensureCephUser(w, backend, healthCheckerUser, healthCheckerCaps); err != nil {
+		return err
+	}
+
+	for _, secret := range bootstrapSecrets() {
+		auth, err := ensureCephUser(w, backend, secret.user, secret.caps)
+		if err != nil {
+			return err
+		}
+		data := map[string][]byte{
+			secret.idKey:  []byte(secret.user),
+			secret.keyKey: []byte(auth.Key),
+		}
+		if err := ensureSecret(w, c, secret.name, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Bootstrap prepares a new environment for the suite: it creates the secret
+// namespace, the ceph users and the secrets, and writes what it did to w.
+func Bootstrap(w io.Writer) error {
+	f, err := newClusterFramework("bootstrap")
+	if err != nil {
+		return err
+	}
+	if err := createNamespace(f.ClientSet, cephCSISecretNamespace); err != nil {
+		return err
+	}
+
+	return bootstrapCephCSI(w, f.ClientSet, getCephBackend(f))
+}
@@ -0,0 +1,53 @@
+package ceph_csi
+
+import (
+	"bytes"
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("Bootstrap", Label("unit"), func() {
+	It("should create the users and secrets once", func() {
+		backend := newFakeCephBackend("fake-fsid")
+		c := fake.NewSimpleClientset()
+
+		var out bytes.Buffer
+		Expect(bootstrapCephCSI(&out, c, backend)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("created client.healthchecker"))
+		Expect(out.String()).To(ContainSubstring("created secret rook-ceph-external/rook-csi-rbd-ns-node"))
+
+		for _, secret := range csiSecrets() {
+			s, err := c.CoreV1().Secrets(cephCSISecretNamespace).Get(context.TODO(), secret.name, metav1.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(validateCephUser(backend, secret, s.Data)).To(Succeed())
+		}
+
+		out.Reset()
+		Expect(bootstrapCephCSI(&out, c, backend)).To(Succeed())
+		Expect(out.String()).NotTo(ContainSubstring("created"))
+		Expect(out.String()).NotTo(ContainSubstring("updated"))
+	})
+
+	It("should repair the caps of existing users", func() {
+		backend := newFakeCephBackend("fake-fsid")
+		backend.addAuthEntity(cephAuthEntity{
+			Entity: "client." + rbdNodePluginUser,
+			Key:    "AQC8G+VkPR3eCBAAEyHNKgjoB1BhlVJdJBV13A==",
+			Caps:   map[string]string{"mon": "profile rbd"},
+		})
+		c := fake.NewSimpleClientset()
+
+		var out bytes.Buffer
+		Expect(bootstrapCephCSI(&out, c, backend)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("updated caps of client.csi-rbd-node"))
+
+		auth, err := backend.AuthGet("client." + rbdNodePluginUser)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(auth.Key).To(Equal("AQC8G+VkPR3eCBAAEyHNKgjoB1BhlVJdJBV13A=="))
+		Expect(auth.Caps).To(Equal(rbdUserCaps))
+	})
+})
@@ -0,0 +1,236 @@
+package ceph_csi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+const (
+	// capacityRoundUp is how much larger than the capacity of the PVC the PV,
+	// the device and the backend object may be. ceph-csi rounds the size of
+	// the volumes up to full MiB.
+	capacityRoundUp = 4 << 20
+
+	// filesystemOverhead is the fraction of a Filesystem mode volume that the
+	// filesystem may keep for its metadata, so it is missing from the statfs
+	// size in the pod.
+	filesystemOverhead = 0.12
+)
+
+// capacityLayer is the size of a volume in one layer and the range it is
+// expected in.
+type capacityLayer struct {
+	name     string
+	size     int64
+	min, max int64
+	err      error
+}
+
+func (l capacityLayer) ok() bool {
+	return l.err == nil && l.size >= l.min && l.size <= l.max
+}
+
+func (l capacityLayer) String() string {
+	status := "ok"
+	if !l.ok() {
+		status = "MISMATCH"
+	}
+	if l.err != nil {
+		return fmt.Sprintf("%-8s %-8s %v", l.name, status, l.err)
+	}
+
+	return fmt.Sprintf("%-8s %-8s %d (expected %d-%d)", l.name, status, l.size, l.min, l.max)
+}
+
+// capacityReport holds the size of a volume in each layer, compared to the
+// capacity in the status of its PVC.
+type capacityReport struct {
+	claim    string
+	mode     v1.PersistentVolumeMode
+	capacity int64
+	layers   []capacityLayer
+}
+
+func newCapacityReport(claim string, mode v1.PersistentVolumeMode, capacity int64) *capacityReport {
+	return &capacityReport{claim: claim, mode: mode, capacity: capacity}
+}
+
+// add records the size of a layer, which must be within min and max.
+func (r *capacityReport) add(name string, size, min, max int64, err error) {
+	r.layers = append(r.layers, capacityLayer{name: name, size: size, min: min, max: max, err: err})
+}
+
+// addRoundedUp records the size of a layer that must be at least the
+// capacity, and at most capacityRoundUp larger.
+func (r *capacityReport) addRoundedUp(name string, size int64, err error) {
+	r.add(name, size, r.capacity, r.capacity+capacityRoundUp, err)
+}
+
+// err returns an error with the size of all layers when a layer does not
+// match.
+func (r *capacityReport) err() error {
+	mismatch := false
+	lines := make([]string, 0, len(r.layers))
+	for _, l := range r.layers {
+		mismatch = mismatch || !l.ok()
+		lines = append(lines, "  "+l.String())
+	}
+	if !mismatch {
+		return nil
+	}
+
+	return fmt.Errorf("capacity of %s volume of PVC %s does not match its status capacity %d:\n%s",
+		r.mode, r.claim, r.capacity, strings.Join(lines, "\n"))
+}
+
+// validateVolumeCapacity compares the capacity in the status of the PVC with
+// the capacity of its PV, the size of the volume in the pod and the size of
+// the rbd image or the quota of the subvolume, i.e. ceph.quota.max_bytes of
+// its root. The size in the pod is the statfs size of the mount of a
+// Filesystem mode volume, which leaves room for filesystemOverhead, and the
+// size of the device of a Block mode volume.
+func validateVolumeCapacity(f *framework.Framework, pvc *v1.PersistentVolumeClaim, pod *v1.Pod) error {
+	claim, err := getPersistentVolumeClaim(f.ClientSet, pvc.Namespace, pvc.Name)
+	if err != nil {
+		return err
+	}
+	pv, err := getBoundPersistentVolume(f.ClientSet, claim)
+	if err != nil {
+		return err
+	}
+	mode := v1.PersistentVolumeFilesystem
+	if claim.Spec.VolumeMode != nil {
+		mode = *claim.Spec.VolumeMode
+	}
+	capacity := claim.Status.Capacity[v1.ResourceStorage]
+	report := newCapacityReport(claim.Namespace+"/"+claim.Name, mode, capacity.Value())
+
+	pvCapacity := pv.Spec.Capacity[v1.ResourceStorage]
+	report.addRoundedUp("pv", pvCapacity.Value(), nil)
+
+	podSize, err := podVolumeSize(f, pod, claim.Name, mode)
+	if mode == v1.PersistentVolumeBlock {
+		report.addRoundedUp("pod", podSize, err)
+	} else {
+		minSize := int64(float64(report.capacity) * (1 - filesystemOverhead))
+		report.add("pod", podSize, minSize, report.capacity+capacityRoundUp, err)
+	}
+
+	backendSize, err := backendVolumeSize(getCephBackend(f), pv)
+	report.addRoundedUp("backend", backendSize, err)
+
+	if err = report.err(); err != nil {
+		return err
+	}
+	framework.Logf("capacity of PVC %s matches its status capacity %d", report.claim, report.capacity)
+
+	return nil
+}
+
+// podVolumeSize returns the size of the volume of the claim in the pod.
+func podVolumeSize(f *framework.Framework, pod *v1.Pod, claimName string, mode v1.PersistentVolumeMode) (int64, error) {
+	container, path, err := podVolumePath(pod, claimName, mode)
+	if err != nil {
+		return 0, err
+	}
+	cmd := "stat -f -c '%b %S' " + path
+	if mode == v1.PersistentVolumeBlock {
+		cmd = "blockdev --getsize64 " + path
+	}
+
+	stdout, stdErr, err := execCommandInContainerByPodName(f, cmd, pod.Namespace, pod.Name, container)
+	if err != nil {
+		return 0, fmt.Errorf("failed to exec %q in pod %s: %w, %s", cmd, pod.Name, err, stdErr)
+	}
+
+	return parseVolumeSize(stdout)
+}
+
+// podVolumePath returns the container that uses the volume of the claim and
+// the device path of a Block mode volume or the mount path of a Filesystem
+// mode volume in it.
+func podVolumePath(pod *v1.Pod, claimName string, mode v1.PersistentVolumeMode) (string, string, error) {
+	volume := ""
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == claimName {
+			volume = vol.Name
+		}
+	}
+
+	for _, c := range pod.Spec.Containers {
+		if mode == v1.PersistentVolumeBlock {
+			for _, d := range c.VolumeDevices {
+				if d.Name == volume {
+					return c.Name, d.DevicePath, nil
+				}
+			}
+
+			continue
+		}
+		for _, m := range c.VolumeMounts {
+			if m.Name == volume {
+				return c.Name, m.MountPath, nil
+			}
+		}
+	}
+
+	return "", "", fmt.Errorf("pod %s does not use PVC %s", pod.Name, claimName)
+}
+
+// parseVolumeSize returns the size printed by blockdev --getsize64, or the
+// product of the block count and block size printed by stat -f.
+func parseVolumeSize(out string) (int64, error) {
+	size := int64(1)
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("no size in %q", out)
+	}
+	for _, field := range fields {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size in %q: %w", out, err)
+		}
+		size *= n
+	}
+
+	return size, nil
+}
+
+// backendVolumeSize returns the size of the rbd image or the quota of the
+// subvolume of the PV.
+func backendVolumeSize(backend CephBackend, pv *v1.PersistentVolume) (int64, error) {
+	if pv.Spec.CSI == nil {
+		return 0, fmt.Errorf("PV %s is not a CSI volume", pv.Name)
+	}
+
+	switch {
+	case isRBDDriver(pv.Spec.CSI.Driver):
+		ref, err := getRBDImageRef(pv)
+		if err != nil {
+			return 0, err
+		}
+		info, err := backend.ImageInfo(ref.pool, ref.image)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", ref, err)
+		}
+
+		return info.Size, nil
+	case isCephFSDriver(pv.Spec.CSI.Driver):
+		ref, err := getCephFSSubVolumeRef(pv)
+		if err != nil {
+			return 0, err
+		}
+		info, err := backend.SubVolumeInfo(ref.fsName, ref.group, ref.subVolume)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", ref, err)
+		}
+
+		return int64(info.BytesQuota), nil
+	}
+
+	return 0, fmt.Errorf("PV %s is not a volume of the rbd or cephfs driver", pv.Name)
+}
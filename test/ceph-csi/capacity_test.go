@@ -0,0 +1,56 @@
+package ceph_csi
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("Volume capacity", Label("unit"), func() {
+	const (
+		uuid   = "b0285c97-a0ce-11eb-8c66-0242ac110002"
+		handle = "0001-0009-rook-ceph-0000000000000004-" + uuid
+		volume = "csi-vol-" + uuid
+		size   = 2 << 30
+	)
+
+	It("should parse the size printed in the pod", func() {
+		Expect(parseVolumeSize("2147483648\n")).To(BeEquivalentTo(size))
+		Expect(parseVolumeSize("524288 4096\n")).To(BeEquivalentTo(size))
+		_, err := parseVolumeSize("")
+		Expect(err).To(HaveOccurred())
+		_, err = parseVolumeSize("unknown 4096")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should report all layers when one does not match", func() {
+		report := newCapacityReport("ns/pvc", v1.PersistentVolumeFilesystem, size)
+		report.addRoundedUp("pv", size, nil)
+		report.add("pod", size-(100<<20), size-(200<<20), size, nil)
+		Expect(report.err()).To(Succeed())
+
+		report.addRoundedUp("backend", 1<<30, nil)
+		err := report.err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("pv       ok"))
+		Expect(err.Error()).To(ContainSubstring("backend  MISMATCH 1073741824"))
+	})
+
+	It("should return the size of the image or the quota of the subvolume", func() {
+		backend := newFakeCephBackend("fake-fsid")
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: volume, Size: size})
+		backend.addSubVolume(defaultFileSystemName, defaultSubvolumegroup, volume,
+			cephfsSubVolumeInfo{BytesQuota: size})
+
+		pv := newCSIPersistentVolume("pvc-1", handle, nil)
+		pv.Spec.CSI.Driver = rbdDriverSuffix
+		Expect(backendVolumeSize(backend, pv)).To(BeEquivalentTo(size))
+
+		pv.Spec.CSI.Driver = cephfsDriverSuffix
+		Expect(backendVolumeSize(backend, pv)).To(BeEquivalentTo(size))
+
+		pv.Spec.CSI.Driver = "other.csi.example.com"
+		_, err := backendVolumeSize(backend, pv)
+		Expect(err).To(HaveOccurred())
+	})
+})
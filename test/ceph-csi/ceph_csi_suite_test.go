@@ -1,10 +1,13 @@
 package ceph_csi
 
 import (
+	"bytes"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -25,14 +28,70 @@ func init() {
 	log.SetOutput(GinkgoWriter)
 	setDefaultKubeconfig()
 
+	RegisterFlags(flag.CommandLine)
+
 	config.CopyFlags(config.Flags, flag.CommandLine)
 	framework.RegisterCommonFlags(flag.CommandLine)
 	framework.RegisterClusterFlags(flag.CommandLine)
 	testing.Init()
 	flag.Parse()
 	framework.AfterReadingAllFlags(&framework.TestContext)
+
+	if err := ApplyFlags(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+var preflightOnce struct {
+	sync.Once
+	table string
+	err   error
 }
 
+// the prerequisites are checked before the first spec that needs the cluster,
+// so runs of only the unit specs do not need one.
+var _ = BeforeEach(func() {
+	if skipPreflight || contains(CurrentSpecReport().Labels(), "unit") {
+		return
+	}
+
+	preflightOnce.Do(func() {
+		var table bytes.Buffer
+		preflightOnce.err = Preflight(&table)
+		preflightOnce.table = table.String()
+		AddReportEntry("preflight", preflightOnce.table)
+	})
+	if preflightOnce.err != nil {
+		AbortSuite(fmt.Sprintf("preflight failed: %v, pass -skip-preflight to run anyway\n%s",
+			preflightOnce.err, preflightOnce.table))
+	}
+})
+
+// the orphan detection runs on the first process once all processes are done,
+// so it sees the objects of all specs and none is still being deleted.
+var _ = SynchronizedAfterSuite(func() {}, func() {
+	if !detectOrphans {
+		return
+	}
+	selected, err := clusterSpecsSelected(GinkgoLabelFilter())
+	if err != nil {
+		framework.Failf("failed to parse label filter: %v", err)
+	}
+	if !selected {
+		return
+	}
+
+	By("checking for orphaned ceph objects")
+	f, err := newClusterFramework("orphans")
+	if err != nil {
+		framework.Failf("failed to create framework: %v", err)
+	}
+	if err := validateNoCephOrphans(f); err != nil {
+		framework.Failf("%v", err)
+	}
+})
+
 func TestCephCsi(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "CephCsi Suite")
@@ -2,51 +2,169 @@ package ceph_csi
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
 	"strings"
 
+	snapapi "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
 	. "github.com/onsi/ginkgo/v2"
 	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/kubernetes/test/e2e/framework"
 	"k8s.io/pod-security-admission/api"
 )
 
-var (
-	defaultCephfsSc = "csi-cephfs-sc"
-)
+func listCephFSSubVolumes(f *framework.Framework, filesystem, groupname string) ([]cephfsSubVolume, error) {
+	return getCephBackend(f).ListSubVolumes(filesystem, groupname)
+}
+
+// subVolumeSnapshotRetained is the state of a deleted subvolume whose
+// snapshots are still around.
+const subVolumeSnapshotRetained = "snapshot-retained"
+
+// validateSubvolumes resolves the cephfs subvolume of every PVC and checks
+// that precisely that subvolume exists with the path recorded in the PV. The
+// result of each PVC is logged and all failures are reported at once. The
+// resolved subvolumes are returned, so their removal can be validated after
+// the PVCs are deleted.
+func validateSubvolumes(f *framework.Framework, pvcs ...*v1.PersistentVolumeClaim) []cephfsSubVolumeRef {
+	refs := make([]cephfsSubVolumeRef, 0, len(pvcs))
+	var failures []string
+	for _, pvc := range pvcs {
+		pv, err := getBoundPersistentVolume(f.ClientSet, pvc)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("PVC %s/%s: %v", pvc.Namespace, pvc.Name, err))
+
+			continue
+		}
+		ref, err := getCephFSSubVolumeRef(pv)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("PVC %s/%s: %v", pvc.Namespace, pvc.Name, err))
+
+			continue
+		}
+		refs = append(refs, ref)
+
+		info, err := getCephBackend(f).SubVolumeInfo(ref.fsName, ref.group, ref.subVolume)
+		switch {
+		case errors.Is(err, errCephObjectNotFound):
+			failures = append(failures, fmt.Sprintf("%s: subvolume not found", ref))
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("%s: %v", ref, err))
+		case ref.path != "" && info.Path != ref.path:
+			failures = append(failures, fmt.Sprintf("%s: subvolume path %q does not match %q", ref, info.Path, ref.path))
+		default:
+			framework.Logf("%s: subvolume found at %s", ref, info.Path)
+		}
+	}
 
-type cephfsSubVolume struct {
-	Name string `json:"name"`
+	if len(failures) != 0 {
+		framework.Failf("backend subvolumes not matching kubernetes resources:\n%s", strings.Join(failures, "\n"))
+	}
+
+	return refs
 }
 
-func listCephFSSubVolumes(f *framework.Framework, filesystem, groupname string) ([]cephfsSubVolume, error) {
-	var subVols []cephfsSubVolume
+// validateSubvolumesInNamespace validates the subvolumes of all PVCs in the
+// test namespace, e.g. the ones of generic ephemeral volumes.
+func validateSubvolumesInNamespace(f *framework.Framework, pvcCount int) []cephfsSubVolumeRef {
+	pvcList, err := listPersistentVolumeClaims(f.ClientSet, f.UniqueName)
+	if err != nil {
+		framework.Failf("failed to list pvc: %v", err)
+	}
+	if len(pvcList) != pvcCount {
+		framework.Failf("found %d pvc in namespace %s, expected %d", len(pvcList), f.UniqueName, pvcCount)
+	}
+
+	pvcs := make([]*v1.PersistentVolumeClaim, 0, len(pvcList))
+	for i := range pvcList {
+		pvcs = append(pvcs, &pvcList[i])
+	}
+
+	return validateSubvolumes(f, pvcs...)
+}
+
+// validateSubvolumesDeleted checks that the subvolumes of deleted PVCs are
+// gone. Subvolumes that are only kept for their snapshots count as deleted.
+func validateSubvolumesDeleted(f *framework.Framework, refs []cephfsSubVolumeRef) {
+	var failures []string
+	for _, ref := range refs {
+		info, err := getCephBackend(f).SubVolumeInfo(ref.fsName, ref.group, ref.subVolume)
+		switch {
+		case errors.Is(err, errCephObjectNotFound):
+			framework.Logf("%s: subvolume deleted", ref)
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("%s: %v", ref, err))
+		case info.State == subVolumeSnapshotRetained:
+			framework.Logf("%s: subvolume deleted, snapshots retained", ref)
+		default:
+			failures = append(failures, fmt.Sprintf("%s: subvolume still exists", ref))
+		}
+	}
+
+	if len(failures) != 0 {
+		framework.Failf("backend subvolumes of deleted PVCs not removed:\n%s", strings.Join(failures, "\n"))
+	}
+}
+
+// cephfsSnapshotExists checks if the subvolume has the snapshot.
+func cephfsSnapshotExists(f *framework.Framework, ref cephfsSnapshotRef) (bool, error) {
+	snaps, err := getCephBackend(f).ListSubVolumeSnapshots(ref.fsName, ref.group, ref.subVolume)
+	if errors.Is(err, errCephObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, snap := range snaps {
+		if snap.Name == ref.name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
 
-	stdout, err := exec.Command("ceph", "fs", "subvolume", "ls", filesystem, "--group_name="+groupname, "--format=json").CombinedOutput()
+// validateCephfsSnapshot resolves the subvolume snapshot backing the
+// snapshot, which was taken from the source subvolume, and checks that it
+// exists.
+func validateCephfsSnapshot(f *framework.Framework, snap *snapapi.VolumeSnapshot, source cephfsSubVolumeRef) cephfsSnapshotRef {
+	vsc, err := getVolumeSnapshotContent(snap)
 	if err != nil {
-		return subVols, fmt.Errorf("error listing subvolumes %s, %s", err.Error(), string(stdout))
+		framework.Failf("failed to get volumesnapshotcontent: %v", err)
+	}
+	ref, err := getCephFSSnapshotRef(vsc, source)
+	if err != nil {
+		framework.Failf("failed to resolve cephfs snapshot: %v", err)
 	}
 
-	err = json.Unmarshal(stdout, &subVols)
+	exists, err := cephfsSnapshotExists(f, ref)
 	if err != nil {
-		return subVols, err
+		framework.Failf("%s: %v", ref, err)
+	}
+	if !exists {
+		framework.Failf("%s: subvolume snapshot not found", ref)
 	}
+	framework.Logf("%s: subvolume snapshot found", ref)
 
-	return subVols, nil
+	return ref
 }
 
-func validateSubvolumeCount(f *framework.Framework, count int, fileSystemName, subvolumegroup string) {
-	subVol, err := listCephFSSubVolumes(f, fileSystemName, subvolumegroup)
+// validateCephfsSnapshotDeleted checks that the subvolume snapshot of a
+// deleted snapshot is gone. A retained subvolume is purged together with its
+// last snapshot, so a missing subvolume counts as deleted as well.
+func validateCephfsSnapshotDeleted(f *framework.Framework, ref cephfsSnapshotRef) {
+	exists, err := cephfsSnapshotExists(f, ref)
 	if err != nil {
-		framework.Failf("failed to list CephFS subvolumes: %v", err)
+		framework.Failf("%s: %v", ref, err)
 	}
-	if len(subVol) != count {
-		framework.Failf("subvolumes [%v]. subvolume count %d not matching expected count %d", subVol, len(subVol), count)
+	if exists {
+		framework.Failf("%s: subvolume snapshot still exists", ref)
 	}
+	framework.Logf("%s: subvolume snapshot deleted", ref)
 }
 
 func validateCephfsRwoVolume(pvcPath, podPath string, f *framework.Framework) {
@@ -60,7 +178,259 @@ func validateCephfsRwoVolume(pvcPath, podPath string, f *framework.Framework) {
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	validateSubvolumeCount(f, 1, defaultFileSystemName, defaultSubvolumegroup)
+	subVols := validateSubvolumes(f, pvc)
+
+	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVCAndValidatePV(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	validateSubvolumesDeleted(f, subVols)
+}
+
+// validateCephfsStaticPV checks that a pod can use a static PV of a subvolume
+// created outside of ceph-csi, and that deleting the PV, which has the Retain
+// reclaim policy, keeps the subvolume.
+func validateCephfsStaticPV(f *framework.Framework) {
+	name := staticVolumeNamePrefix + f.UniqueName
+	DeferCleanup(func() {
+		err := getCephBackend(f).DeleteSubVolume(defaultFileSystemName, defaultSubvolumegroup, name)
+		if err != nil && !errors.Is(err, errCephObjectNotFound) {
+			framework.Failf("failed to delete subvolume %s: %v", name, err)
+		}
+	})
+	DeferCleanup(func() {
+		err := f.ClientSet.CoreV1().PersistentVolumes().Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			framework.Failf("failed to delete pv %s: %v", name, err)
+		}
+	})
+
+	pv, err := createStaticCephFSPV(f, name)
+	if err != nil {
+		framework.Failf("failed to create static pv: %v", err)
+	}
+
+	pvc, err := createPVCForPV("manifest/cephfs/rwo-pvc.yaml", pv, f)
+	if err != nil {
+		framework.Failf("failed to create pvc: %v", err)
+	}
+
+	app, err := createPod("manifest/cephfs/rwo-pod.yaml", deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+
+	subVols := validateSubvolumes(f, pvc)
+
+	err = writeToFileInContainer(f, app, "/var/lib/www/static-data")
+	if err != nil {
+		framework.Failf("failed to write to the static volume: %v", err)
+	}
+
+	err = deletePod(app.Name, app.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVC(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	err = deletePV(f.ClientSet, pv.Name, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pv: %v", err)
+	}
+
+	for _, ref := range subVols {
+		_, err := getCephBackend(f).SubVolumeInfo(ref.fsName, ref.group, ref.subVolume)
+		if errors.Is(err, errCephObjectNotFound) {
+			framework.Failf("%s: subvolume deleted with its Retain PV", ref)
+		}
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+	}
+}
+
+// validateCephfsRetainPolicy checks the lifecycle of a volume provisioned with
+// the Retain reclaim policy: the PV is Released with its PVC and keeps the
+// subvolume and the data, a new PVC can bind it once its claimRef is cleared,
+// and the subvolume is only removed by hand.
+func validateCephfsRetainPolicy(pvcPath, podPath string, f *framework.Framework) {
+	pvc, err := createPVC(pvcPath, f)
+	if err != nil {
+		framework.Failf("failed to create Cephfs pvc: %v", err)
+	}
+
+	app, err := createPod(podPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+
+	subVols := validateSubvolumes(f, pvc)
+
+	pv, err := getBoundPersistentVolume(f.ClientSet, pvc)
+	if err != nil {
+		framework.Failf("failed to get pv: %v", err)
+	}
+	// the PV and the subvolume are removed by hand at the end of the spec, this
+	// only cleans up after a failure.
+	DeferCleanup(func() {
+		err := f.ClientSet.CoreV1().PersistentVolumes().Delete(context.TODO(), pv.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			framework.Failf("failed to delete pv %s: %v", pv.Name, err)
+		}
+		if err = deleteRetainedCephFSVolume(getCephBackend(f), pv); err != nil {
+			framework.Failf("failed to delete the subvolume of pv %s: %v", pv.Name, err)
+		}
+	})
+
+	dataPath := "/var/lib/www/retain-data"
+	if err = writeToFileInContainer(f, app, dataPath); err != nil {
+		framework.Failf("failed to write to the volume: %v", err)
+	}
+	opt := &metav1.ListOptions{FieldSelector: "metadata.name=" + app.Name}
+	checkSum, err := calculateSHA512sum(f, app, dataPath, opt)
+	if err != nil {
+		framework.Failf("failed to calculate checksum: %v", err)
+	}
+
+	err = deletePod(app.Name, app.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVC(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	By("the PV is Released and the subvolume is kept")
+	err = waitForPVPhase(f.ClientSet, pv.Name, v1.VolumeReleased, deployTimeout)
+	if err != nil {
+		framework.Failf("pv %s not released: %v", pv.Name, err)
+	}
+	for _, ref := range subVols {
+		_, err := getCephBackend(f).SubVolumeInfo(ref.fsName, ref.group, ref.subVolume)
+		if errors.Is(err, errCephObjectNotFound) {
+			framework.Failf("%s: subvolume of the Retain PV deleted", ref)
+		}
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+	}
+
+	By("rebind the PV to a new PVC")
+	err = clearPVClaimRef(f.ClientSet, pv.Name)
+	if err != nil {
+		framework.Failf("failed to rebind pv: %v", err)
+	}
+	pvc, err = createPVCForPV(pvcPath, pv, f)
+	if err != nil {
+		framework.Failf("failed to create pvc: %v", err)
+	}
+	app, err = createPod(podPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+	opt = &metav1.ListOptions{FieldSelector: "metadata.name=" + app.Name}
+	got, err := calculateSHA512sum(f, app, dataPath, opt)
+	if err != nil {
+		framework.Failf("failed to calculate checksum: %v", err)
+	}
+	if got != checkSum {
+		framework.Failf("checksum of %s changed from %s to %s", dataPath, checkSum, got)
+	}
+
+	err = deletePod(app.Name, app.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVC(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	By("delete the PV and the subvolume by hand")
+	err = deletePV(f.ClientSet, pv.Name, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pv: %v", err)
+	}
+	for _, ref := range subVols {
+		_, err := getCephBackend(f).SubVolumeInfo(ref.fsName, ref.group, ref.subVolume)
+		if errors.Is(err, errCephObjectNotFound) {
+			framework.Failf("%s: subvolume of the Retain PV deleted", ref)
+		}
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+	}
+	err = deleteRetainedCephFSVolume(getCephBackend(f), pv)
+	if err != nil {
+		framework.Failf("failed to delete the subvolume of pv %s: %v", pv.Name, err)
+	}
+
+	validateSubvolumesDeleted(f, subVols)
+}
+
+// validateCephfsNodePluginRestart checks that a mounted volume stays usable
+// when the cephfs nodeplugin pods are restarted.
+func validateCephfsNodePluginRestart(pvcPath, podPath string, f *framework.Framework) {
+	pvc, err := createPVC(pvcPath, f)
+	if err != nil {
+		framework.Failf("failed to create Cephfs pvc: %v", err)
+	}
+
+	pod, err := createPod(podPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+
+	subVols := validateSubvolumes(f, pvc)
+
+	By("restart the nodeplugin")
+	err = validateNodePluginRestart(f, pod, "/var/lib/www", cephFSNodePluginDaemonSet, cephFSProvisionerDeployment)
+	if err != nil {
+		framework.Failf("failed to validate the volume after the nodeplugin restart: %v", err)
+	}
+
+	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVCAndValidatePV(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	validateSubvolumesDeleted(f, subVols)
+}
+
+// validateCephfsRwopVolume checks that a pod can use a ReadWriteOncePod volume
+// and that a second pod using the same claim is rejected.
+func validateCephfsRwopVolume(pvcPath, podPath string, f *framework.Framework) {
+	pvc, err := createPVC(pvcPath, f)
+	if err != nil {
+		framework.Failf("failed to create Cephfs pvc: %v", err)
+	}
+
+	pod, err := createPod(podPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+
+	subVols := validateSubvolumes(f, pvc)
+
+	validateRWOPConflict(podPath, f)
 
 	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
 	if err != nil {
@@ -72,7 +442,7 @@ func validateCephfsRwoVolume(pvcPath, podPath string, f *framework.Framework) {
 		framework.Failf("failed to delete pvc: %v", err)
 	}
 
-	validateSubvolumeCount(f, 0, defaultFileSystemName, defaultSubvolumegroup)
+	validateSubvolumesDeleted(f, subVols)
 }
 
 const testData = "cephfs-test"
@@ -125,7 +495,7 @@ func validateCephfsRwxVolume(pvcPath, podPath, anotherPodPath string, f *framewo
 		framework.Failf("failed to create another pod: %v", err)
 	}
 
-	validateSubvolumeCount(f, 1, defaultFileSystemName, defaultSubvolumegroup)
+	subVols := validateSubvolumes(f, pvc)
 
 	writeToCephfsPod(pod, f)
 	readFromCephfsPod(anotherPod, f)
@@ -145,7 +515,7 @@ func validateCephfsRwxVolume(pvcPath, podPath, anotherPodPath string, f *framewo
 		framework.Failf("failed to delete pvc: %v", err)
 	}
 
-	validateSubvolumeCount(f, 0, defaultFileSystemName, defaultSubvolumegroup)
+	validateSubvolumesDeleted(f, subVols)
 }
 
 func validateCephfsVolumeClone(pvcPath, podPath, clonePvcPath, clonePodPath string, f *framework.Framework) {
@@ -159,7 +529,7 @@ func validateCephfsVolumeClone(pvcPath, podPath, clonePvcPath, clonePodPath stri
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	validateSubvolumeCount(f, 1, defaultFileSystemName, defaultSubvolumegroup)
+	subVols := validateSubvolumes(f, pvc)
 
 	clonePvc, err := createPVC(clonePvcPath, f)
 	if err != nil {
@@ -171,7 +541,7 @@ func validateCephfsVolumeClone(pvcPath, podPath, clonePvcPath, clonePodPath stri
 		framework.Failf("failed to create pod clone: %v", err)
 	}
 
-	validateSubvolumeCount(f, 2, defaultFileSystemName, defaultSubvolumegroup)
+	subVols = append(subVols, validateSubvolumes(f, clonePvc)...)
 
 	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
 	if err != nil {
@@ -193,7 +563,7 @@ func validateCephfsVolumeClone(pvcPath, podPath, clonePvcPath, clonePodPath stri
 		framework.Failf("failed to delete clone pvc: %v", err)
 	}
 
-	validateSubvolumeCount(f, 0, defaultFileSystemName, defaultSubvolumegroup)
+	validateSubvolumesDeleted(f, subVols)
 }
 
 func createCephfsVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPath, restorePodPath string, f *framework.Framework) {
@@ -209,8 +579,8 @@ func createCephfsVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPa
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	By("validate cephfs subvolume count")
-	validateSubvolumeCount(f, 1, defaultFileSystemName, defaultSubvolumegroup)
+	By("validate cephfs subvolume")
+	subVols := validateSubvolumes(f, pvc)
 
 	snap := getSnapshot(snapshotPath)
 	snap.Namespace = f.UniqueName
@@ -222,8 +592,9 @@ func createCephfsVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPa
 		framework.Failf("failed to create snapshot: %v", err)
 	}
 
-	By("validate cephfs subvolume count")
-	validateSubvolumeCount(f, 1, defaultFileSystemName, defaultSubvolumegroup)
+	By("validate cephfs subvolume snapshot")
+	validateSubvolumes(f, pvc)
+	subVolSnap := validateCephfsSnapshot(f, &snap, subVols[0])
 
 	By("delete pod")
 	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
@@ -237,8 +608,11 @@ func createCephfsVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPa
 		framework.Failf("failed to delete pvc: %v", err)
 	}
 
-	By("validate cephfs subvolume count")
-	validateSubvolumeCount(f, 1, defaultFileSystemName, defaultSubvolumegroup)
+	By("validate cephfs subvolume deleted")
+	validateSubvolumesDeleted(f, subVols)
+
+	By("validate cephfs subvolume snapshot kept after the source pvc is deleted")
+	validateCephfsSnapshot(f, &snap, subVols[0])
 
 	By("create pvc from snapshot")
 	restorePVC, err := createPVC(restorePvcPath, f)
@@ -252,16 +626,19 @@ func createCephfsVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPa
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	By("validate cephfs subvolume count")
-	validateSubvolumeCount(f, 2, defaultFileSystemName, defaultSubvolumegroup)
+	By("validate restored cephfs subvolume")
+	restoreSubVols := validateSubvolumes(f, restorePVC)
 
 	By("delete snapshot")
 	if err := deleteSnapshot(&snap, deployTimeout); err != nil {
 		framework.Failf("failed to delete snapshot: %v", err)
 	}
 
-	By("validate cephfs subvolume count")
-	validateSubvolumeCount(f, 1, defaultFileSystemName, defaultSubvolumegroup)
+	By("validate cephfs subvolume snapshot deleted")
+	validateCephfsSnapshotDeleted(f, subVolSnap)
+
+	By("validate restored cephfs subvolume")
+	validateSubvolumes(f, restorePVC)
 
 	By("delete pod")
 	err = deletePod(restorePod.Name, restorePod.Namespace, f.ClientSet, deployTimeout)
@@ -275,11 +652,20 @@ func createCephfsVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPa
 		framework.Failf("failed to delete restore pvc: %v", err)
 	}
 
-	By("validate cephfs subvolume count")
-	validateSubvolumeCount(f, 0, defaultFileSystemName, defaultSubvolumegroup)
+	By("validate restored cephfs subvolume deleted")
+	validateSubvolumesDeleted(f, restoreSubVols)
 }
 
-func validateCephfsVolumeExpansion(pvcPath, podPath string, f *framework.Framework) {
+// validateCephfsVolumeExpansion expands the volume to the size, online while
+// the pod uses it or offline after the pod was deleted, and reconciles the
+// capacity of the PVC with the PV, the volume in the pod and the quota of the
+// subvolume.
+func validateCephfsVolumeExpansion(
+	pvcPath, podPath string,
+	size resource.Quantity,
+	mode expansionMode,
+	f *framework.Framework,
+) {
 	pvc, err := createPVC(pvcPath, f)
 	if err != nil {
 		framework.Failf("failed to create Cephfs pvc: %v", err)
@@ -290,20 +676,43 @@ func validateCephfsVolumeExpansion(pvcPath, podPath string, f *framework.Framewo
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	validateSubvolumeCount(f, 1, defaultFileSystemName, defaultSubvolumegroup)
+	subVols := validateSubvolumes(f, pvc)
 
-	By("validate volume size in pod")
-	validateTestVolumeSize(pod, 900, f)
+	By("validate volume capacity")
+	err = validateVolumeCapacity(f, pvc, pod)
+	if err != nil {
+		framework.Failf("%v", err)
+	}
 
-	expandPVC(f.ClientSet, pvc, deployTimeout)
+	if mode == offlineExpansion {
+		err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
+		if err != nil {
+			framework.Failf("failed to delete pod: %v", err)
+		}
+	}
+
+	By(fmt.Sprintf("expand pvc %s to %s", mode, size.String()))
+	err = expandPVC(f.ClientSet, pvc, size, mode, deployTimeout)
 	if err != nil {
 		framework.Failf("failed to expand PVC: %v", err)
 	}
 
-	validateSubvolumeCount(f, 1, defaultFileSystemName, defaultSubvolumegroup)
+	if mode == offlineExpansion {
+		pod, err = createPod(podPath, deployTimeout, f)
+		if err != nil {
+			framework.Failf("failed to create pod: %v", err)
+		}
+		err = waitForPVCCapacity(f.ClientSet, pvc, size, deployTimeout)
+		if err != nil {
+			framework.Failf("failed to expand PVC: %v", err)
+		}
+	}
 
-	By("validate volume size in pod after expansion")
-	validateTestVolumeSize(pod, 1800, f)
+	By("validate volume capacity after expansion")
+	err = validateVolumeCapacity(f, pvc, pod)
+	if err != nil {
+		framework.Failf("%v", err)
+	}
 
 	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
 	if err != nil {
@@ -315,7 +724,116 @@ func validateCephfsVolumeExpansion(pvcPath, podPath string, f *framework.Framewo
 		framework.Failf("failed to delete pvc: %v", err)
 	}
 
-	validateSubvolumeCount(f, 0, defaultFileSystemName, defaultSubvolumegroup)
+	validateSubvolumesDeleted(f, subVols)
+}
+
+// validateCephfsExpansionRejected checks that resizing the volume to the size
+// is rejected and that the subvolume keeps its quota.
+func validateCephfsExpansionRejected(pvcPath string, size resource.Quantity, f *framework.Framework) {
+	pvc, err := createPVC(pvcPath, f)
+	if err != nil {
+		framework.Failf("failed to create Cephfs pvc: %v", err)
+	}
+
+	subVols := validateSubvolumes(f, pvc)
+	quotas := map[string]cephfsQuota{}
+	for _, ref := range subVols {
+		info, err := getCephBackend(f).SubVolumeInfo(ref.fsName, ref.group, ref.subVolume)
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+		quotas[ref.subVolume] = info.BytesQuota
+	}
+
+	err = validateResizeRejected(f.ClientSet, pvc, size)
+	if err != nil {
+		framework.Failf("%v", err)
+	}
+
+	for _, ref := range subVols {
+		info, err := getCephBackend(f).SubVolumeInfo(ref.fsName, ref.group, ref.subVolume)
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+		if info.BytesQuota != quotas[ref.subVolume] {
+			framework.Failf("%s: quota changed from %d to %d", ref, quotas[ref.subVolume], info.BytesQuota)
+		}
+	}
+
+	err = deletePVCAndValidatePV(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	validateSubvolumesDeleted(f, subVols)
+}
+
+// validateCephfsEphemeralVolume checks that a subvolume is created for the
+// generic ephemeral volume of a pod and removed together with the pod.
+func validateCephfsEphemeralVolume(podPath string, f *framework.Framework) {
+	pod, err := createPod(podPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+
+	subVols := validateSubvolumesInNamespace(f, 1)
+
+	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	// the PVC is owned by the pod and garbage collected with it
+	for _, subVol := range subVols {
+		if err := waitForPVDeleted(f.ClientSet, subVol.pvName, deployTimeout); err != nil {
+			framework.Failf("PV %s of ephemeral volume not deleted: %v", subVol.pvName, err)
+		}
+	}
+
+	validateSubvolumesDeleted(f, subVols)
+}
+
+// validateCephfsVolumeMetrics checks that kubelet reports the volume stats of
+// a cephfs volume used by a deployment.
+func validateCephfsVolumeMetrics(pvcPath, deployPath string, f *framework.Framework) {
+	pvc, err := createPVC(pvcPath, f)
+	if err != nil {
+		framework.Failf("failed to create Cephfs pvc: %v", err)
+	}
+
+	deploy, err := createDeployment(deployPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create deployment: %v", err)
+	}
+
+	subVols := validateSubvolumes(f, pvc)
+
+	validateVolumeMetrics(deploy, deployTimeout, f)
+
+	err = deleteDeploymentApp(f.ClientSet, deploy.Name, deploy.Namespace, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete deployment: %v", err)
+	}
+
+	err = deletePVCAndValidatePV(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	validateSubvolumesDeleted(f, subVols)
+}
+
+// useCephfsStorageClass creates the default cephfs storage class with the
+// params for the current spec.
+func useCephfsStorageClass(params storageClassParams, f *framework.Framework) {
+	if err := createCephfsStorageClass(f.ClientSet, f, true, params.parameters); err != nil {
+		framework.Failf("failed to create storageclass %s with %s: %v", defaultCephfsSc, params, err)
+	}
+	DeferCleanup(func() {
+		if err := deleteStorageClass(f.ClientSet, defaultCephfsSc); err != nil {
+			framework.Failf("failed to delete storageclass %s: %v", defaultCephfsSc, err)
+		}
+	})
 }
 
 var _ = Describe("Cephfs", func() {
@@ -336,20 +854,20 @@ var _ = Describe("Cephfs", func() {
 			}
 		})
 
-		It("should be able to dynamically provision File mode RWO volume", Label("cephfs", "pvc", "rwo"), func() {
+		It("should be able to dynamically provision File mode RWO volume", Label("cephfs", "rwo", "file"), func() {
 			validateCephfsRwoVolume(
 				"manifest/cephfs/rwo-pvc.yaml",
 				"manifest/cephfs/rwo-pod.yaml", f)
 		})
 
-		It("should be able to dynamically provision File mode RWX volume", Label("cephfs", "pvc", "rwx"), func() {
+		It("should be able to dynamically provision File mode RWX volume", Label("cephfs", "rwx", "file"), func() {
 			validateCephfsRwxVolume(
 				"manifest/cephfs/rwx-pvc.yaml",
 				"manifest/cephfs/rwx-pod.yaml",
 				"manifest/cephfs/rwx-pod-another.yaml", f)
 		})
 
-		It("should be able to provision volume from another volume", Label("cephfs", "clone"), func() {
+		It("should be able to provision volume from another volume", Label("cephfs", "clone", "rwx", "file"), func() {
 			validateCephfsVolumeClone(
 				"manifest/cephfs/rwx-pvc.yaml",
 				"manifest/cephfs/rwx-pod.yaml",
@@ -357,8 +875,14 @@ var _ = Describe("Cephfs", func() {
 				"manifest/cephfs/pod-clone.yaml", f)
 		})
 
-		It("should be able to collect metrics of File mode volume", Label("cephfs", "metrics"), func() {
-			Skip("Not implemented")
+		It("should be able to create ephemeral File mode volume", Label("cephfs", "ephemeral", "rwo", "file"), func() {
+			validateCephfsEphemeralVolume("manifest/cephfs/pod-ephemeral.yaml", f)
+		})
+
+		It("should be able to collect metrics of File mode volume", Label("cephfs", "metrics", "rwx", "file"), func() {
+			validateCephfsVolumeMetrics(
+				"manifest/cephfs/rwx-pvc.yaml",
+				"manifest/cephfs/deployment.yaml", f)
 		})
 	})
 
@@ -394,7 +918,7 @@ var _ = Describe("Cephfs", func() {
 			}
 		})
 
-		It("should be able to provision volume from snapshot", Label("cephfs", "snapshot"), func() {
+		It("should be able to provision volume from snapshot", Label("cephfs", "snapshot", "rwx", "file"), func() {
 			createCephfsVolumeFromSnapshot(
 				"manifest/cephfs/rwx-pvc.yaml",
 				"manifest/cephfs/rwx-pod.yaml",
@@ -418,10 +942,188 @@ var _ = Describe("Cephfs", func() {
 			}
 		})
 
-		It("should be able to expand volume", Label("cephfs", "beta", "expansion"), func() {
-			validateCephfsVolumeExpansion(
-				"manifest/cephfs/rwx-pvc.yaml",
-				"manifest/cephfs/rwx-pod.yaml", f)
+		for _, exp := range volumeExpansions {
+			exp := exp
+			It(fmt.Sprintf("should be able to expand volume %s to %s", exp.mode, exp.size),
+				Label("cephfs", "expansion", "rwx", "file"), func() {
+					validateCephfsVolumeExpansion(
+						"manifest/cephfs/rwx-pvc.yaml",
+						"manifest/cephfs/rwx-pod.yaml",
+						resource.MustParse(exp.size), exp.mode, f)
+				})
+		}
+
+		It("should reject shrinking volume", Label("cephfs", "expansion", "rwx", "file"), func() {
+			validateCephfsExpansionRejected("manifest/cephfs/rwx-pvc.yaml", resource.MustParse("512Mi"), f)
+		})
+
+		It("should reject expanding volume of a storage class without allowVolumeExpansion",
+			Label("cephfs", "expansion", "rwx", "file"), func() {
+				if err := setAllowVolumeExpansion(f.ClientSet, defaultCephfsSc, false); err != nil {
+					framework.Failf("%v", err)
+				}
+				validateCephfsExpansionRejected("manifest/cephfs/rwx-pvc.yaml", resource.MustParse("2Gi"), f)
+			})
+	})
+
+	Context("[Alpha]", func() {
+		BeforeEach(func() {
+			if err := createCephfsStorageClass(
+				f.ClientSet, f, true, nil); err != nil {
+				framework.Failf("failed to create storageclass %s: %v", defaultCephfsSc, err)
+			}
 		})
+
+		AfterEach(func() {
+			if err := deleteStorageClass(f.ClientSet, defaultCephfsSc); err != nil {
+				framework.Failf("failed to delete storageclass %s: %v", defaultCephfsSc, err)
+			}
+		})
+
+		It("should be able to provision File mode RWOP volume", Label("cephfs", "rwop", "file"), func() {
+			validateCephfsRwopVolume(
+				"manifest/cephfs/rwop-pvc.yaml",
+				"manifest/cephfs/rwop-pod.yaml", f)
+		})
+	})
+
+	Context("[GA]", Label("restart"), func() {
+		for _, m := range []struct {
+			mounter string
+			// skip is the reason the mounter can not keep the volume of
+			// a running pod usable.
+			skip string
+		}{
+			{mounter: "kernel"},
+			{
+				mounter: "fuse",
+				skip: "ceph-fuse mounts die with the nodeplugin, " +
+					"the volume is only mounted again for a new pod",
+			},
+		} {
+			m := m
+			Context("with the "+m.mounter+" mounter", func() {
+				BeforeEach(func() {
+					if err := createCephfsStorageClass(
+						f.ClientSet, f, true, map[string]string{"mounter": m.mounter}); err != nil {
+						framework.Failf("failed to create storageclass %s: %v", defaultCephfsSc, err)
+					}
+				})
+
+				AfterEach(func() {
+					if err := deleteStorageClass(f.ClientSet, defaultCephfsSc); err != nil {
+						framework.Failf("failed to delete storageclass %s: %v", defaultCephfsSc, err)
+					}
+				})
+
+				It("should keep volume usable after a nodeplugin restart", Label("cephfs", "restart", "rwo", "file"), func() {
+					if m.skip != "" {
+						Skip(m.skip)
+					}
+					validateCephfsNodePluginRestart(
+						"manifest/cephfs/rwo-pvc.yaml",
+						"manifest/cephfs/rwo-pod.yaml", f)
+				})
+			})
+		}
+	})
+
+	Context("[GA]", Label("static"), func() {
+		BeforeEach(func() {
+			if err := createCephFSStaticSecret(f.ClientSet); err != nil {
+				framework.Failf("failed to create the secret of static volumes: %v", err)
+			}
+		})
+
+		AfterEach(func() {
+			if err := deleteCephFSStaticSecret(f.ClientSet); err != nil {
+				framework.Failf("failed to delete the secret of static volumes: %v", err)
+			}
+		})
+
+		It("should be able to use static volume and keep the subvolume after the PV is deleted",
+			Label("cephfs", "static", "rwo", "file"), func() {
+				validateCephfsStaticPV(f)
+			})
+	})
+
+	Context("[GA]", Label("retain"), func() {
+		BeforeEach(func() {
+			if err := createCephfsStorageClassWithPolicy(f.ClientSet, f, true, nil, retainPolicy); err != nil {
+				framework.Failf("failed to create storageclass %s: %v", defaultCephfsSc, err)
+			}
+		})
+
+		AfterEach(func() {
+			if err := deleteStorageClass(f.ClientSet, defaultCephfsSc); err != nil {
+				framework.Failf("failed to delete storageclass %s: %v", defaultCephfsSc, err)
+			}
+		})
+
+		It("should keep and rebind volume with the Retain reclaim policy", Label("cephfs", "retain", "rwo", "file"), func() {
+			validateCephfsRetainPolicy(
+				"manifest/cephfs/rwo-pvc.yaml",
+				"manifest/cephfs/rwo-pod.yaml", f)
+		})
+	})
+
+	// the core flows run once for each parameter set of the matrix.
+	Context("[Beta]", Label("matrix"), func() {
+		DescribeTable("should be able to provision RWO volume with",
+			Label("cephfs", "matrix", "rwo", "file"), func(params storageClassParams) {
+				useCephfsStorageClass(params, f)
+				validateCephfsRwoVolume(
+					"manifest/cephfs/rwo-pvc.yaml",
+					"manifest/cephfs/rwo-pod.yaml", f)
+			}, storageClassEntries(cephfsStorageClassMatrix))
+
+		DescribeTable("should be able to provision volume from another volume with",
+			Label("cephfs", "matrix", "rwx", "file"), func(params storageClassParams) {
+				useCephfsStorageClass(params, f)
+				validateCephfsVolumeClone(
+					"manifest/cephfs/rwx-pvc.yaml",
+					"manifest/cephfs/rwx-pod.yaml",
+					"manifest/cephfs/pvc-clone.yaml",
+					"manifest/cephfs/pod-clone.yaml", f)
+			}, storageClassEntries(cephfsStorageClassMatrix))
+
+		DescribeTable("should be able to provision volume from snapshot with",
+			Label("cephfs", "matrix", "rwx", "file"), func(params storageClassParams) {
+				_, err := f.DynamicClient.Resource(schema.GroupVersionResource{
+					Group:    "apiextensions.k8s.io",
+					Version:  "v1",
+					Resource: "customresourcedefinitions",
+				}).Get(context.Background(),
+					"volumesnapshotclasses.snapshot.storage.k8s.io", metav1.GetOptions{})
+				if err != nil {
+					framework.Logf("Get volumesnapshotclasses error due to %v", err)
+					Skip("Skip snapshot cases")
+				}
+				useCephfsStorageClass(params, f)
+				if err := createCephfsSnapshotClass(f); err != nil {
+					framework.Failf("failed to create snapshotclass csi-cephfsplugin-snapclass: %v", err)
+				}
+				DeferCleanup(func() {
+					if err := deleteCephfsSnapshotClass(); err != nil {
+						framework.Failf("failed to delete snapshotclass csi-cephfsplugin-snapclass: %v", err)
+					}
+				})
+
+				createCephfsVolumeFromSnapshot(
+					"manifest/cephfs/rwx-pvc.yaml",
+					"manifest/cephfs/rwx-pod.yaml",
+					"manifest/cephfs/snapshot.yaml",
+					"manifest/cephfs/pvc-restore.yaml",
+					"manifest/cephfs/pod-restore.yaml", f)
+			}, storageClassEntries(cephfsStorageClassMatrix))
+
+		DescribeTable("should be able to expand volume online to 2Gi with",
+			Label("cephfs", "matrix", "rwx", "file"), func(params storageClassParams) {
+				useCephfsStorageClass(params, f)
+				validateCephfsVolumeExpansion(
+					"manifest/cephfs/rwx-pvc.yaml",
+					"manifest/cephfs/rwx-pod.yaml",
+					resource.MustParse("2Gi"), onlineExpansion, f)
+			}, storageClassEntries(cephfsStorageClassMatrix))
 	})
 })
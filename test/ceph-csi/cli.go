@@ -0,0 +1,333 @@
+package ceph_csi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	snapapi "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"github.com/onsi/ginkgo/v2/types"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// This file holds the parts of the suite that the ceph-csi-validate command
+// uses, the command can not import the specs as they live in test files.
+
+// RegisterFlags adds the flags of the suite that are not part of the e2e
+// framework to the flag set.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cephBackendMode, "ceph-backend", cephBackendLocal,
+		"how to reach the ceph cluster for backend validation: local (ceph client on this machine) "+
+			"or toolbox (exec in the rook-ceph-tools pod)")
+
+	registerSuiteConfigFlags(fs)
+
+	fs.StringVar(&manifestDir, "manifest-dir", "",
+		"directory with manifests that take precedence over the ones built into the suite, "+
+			"with the same layout as test/ceph-csi/manifest")
+
+	fs.BoolVar(&detectOrphans, "detect-orphans", true,
+		"fail the suite when ceph objects created by ceph-csi are left without a PV or VolumeSnapshotContent")
+
+	fs.BoolVar(&skipPreflight, "skip-preflight", false,
+		"do not check the prerequisites of the suite before the first spec that needs the cluster")
+}
+
+// ApplyFlags validates the flags added by RegisterFlags and loads the config
+// file. It must be called after the flag set is parsed.
+func ApplyFlags(fs *flag.FlagSet) error {
+	if err := validateCephBackendMode(cephBackendMode); err != nil {
+		return err
+	}
+
+	return loadSuiteConfig(fs)
+}
+
+// featureGroups maps the feature names of the command to the spec labels. The
+// features of a group are or'ed and the groups are and'ed, so "rbd,cephfs,snapshot"
+// selects the snapshot specs of both drivers.
+var featureGroups = []struct {
+	name     string
+	features map[string]string
+}{
+	{name: "driver", features: map[string]string{
+		"rbd":           "rbd",
+		"cephfs":        "cephfs",
+		"elasticsearch": "es",
+	}},
+	{name: "capability", features: map[string]string{
+		"snapshot":    "snapshot",
+		"clone":       "clone",
+		"expansion":   "expansion",
+		"matrix":      "matrix",
+		"metrics":     "metrics",
+		"ephemeral":   "ephemeral",
+		"encryption":  "encryption",
+		"restart":     "restart",
+		"retain":      "retain",
+		"static":      "static",
+		"statefulset": "statefulset",
+		"topology":    "topology",
+	}},
+	{name: "volume mode", features: map[string]string{
+		"block": "block",
+		"file":  "file",
+	}},
+	{name: "access mode", features: map[string]string{
+		"rwo":  "rwo",
+		"rwx":  "rwx",
+		"rwop": "rwop",
+	}},
+}
+
+// Features returns the feature names accepted by LabelFilter.
+func Features() []string {
+	var names []string
+	for _, group := range featureGroups {
+		for name := range group.features {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// LabelFilter returns the ginkgo label filter that selects the specs of the
+// features. The unit specs are always excluded, they do not validate the
+// cluster.
+func LabelFilter(features []string) (string, error) {
+	selected := make([][]string, len(featureGroups))
+	for _, feature := range features {
+		feature = strings.ToLower(strings.TrimSpace(feature))
+		if feature == "" {
+			continue
+		}
+		found := false
+		for i, group := range featureGroups {
+			if label, ok := group.features[feature]; ok {
+				if !contains(selected[i], label) {
+					selected[i] = append(selected[i], label)
+				}
+				found = true
+
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("unknown feature %q, expected one of %s", feature, strings.Join(Features(), ", "))
+		}
+	}
+
+	var terms []string
+	for _, group := range selected {
+		if len(group) != 0 {
+			terms = append(terms, "("+strings.Join(group, " || ")+")")
+		}
+	}
+	terms = append(terms, "!unit")
+
+	return strings.Join(terms, " && "), nil
+}
+
+// clusterSpecsSelected reports whether the label filter selects a spec that
+// uses the cluster. Every such spec carries a driver, a volume mode and an
+// access mode label and at most one capability label, so the filter is
+// matched against all those combinations, which errs on the side of checking
+// the cluster for combinations no spec has. It does not depend on the specs a
+// process ran, which differ between the processes of a parallel run.
+func clusterSpecsSelected(filter string) (bool, error) {
+	match, err := types.ParseLabelFilter(filter)
+	if err != nil {
+		return false, err
+	}
+	combinations := [][]string{{}}
+	for _, group := range featureGroups {
+		labels := make([]string, 0, len(group.features))
+		for _, label := range group.features {
+			labels = append(labels, label)
+		}
+		next := make([][]string, 0, len(combinations)*(len(labels)+1))
+		for _, c := range combinations {
+			if group.name == "capability" {
+				next = append(next, c)
+			}
+			for _, label := range labels {
+				next = append(next, append(append([]string{}, c...), label))
+			}
+		}
+		combinations = next
+	}
+	for _, labels := range combinations {
+		if match(labels) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// MaturityFocus returns the ginkgo focus regexp that selects the specs of the
+// maturity level, empty for all levels.
+func MaturityFocus(maturity string) (string, error) {
+	switch strings.ToLower(maturity) {
+	case "", "all":
+		return "", nil
+	case "ga":
+		return `\[GA\]`, nil
+	case "beta":
+		return `\[Beta\]`, nil
+	case "alpha":
+		return `\[Alpha\]`, nil
+	}
+
+	return "", fmt.Errorf("unknown maturity %q, expected GA, Beta, Alpha or all", maturity)
+}
+
+// suiteFrameworkNames are the base names of the frameworks of the specs, the
+// e2e framework labels the namespaces it creates with them.
+var suiteFrameworkNames = []string{rbdType, cephfsType, "es"}
+
+// suiteStorageClasses are the names of the storage classes the specs create.
+// The matrix, topology, encryption and restart specs recreate the default
+// classes with their parameters rather than adding classes of their own, so
+// deleting these covers every spec.
+var suiteStorageClasses = []string{defaultRbdSc, defaultCephfsSc}
+
+// Cleanup removes what an interrupted run may have left behind: the spec
+// namespaces, with the PVCs in them, the storage and snapshot classes, the
+// encryption KMS configurations and the secret of the static cephfs volumes.
+// The ceph objects are only reported, the orphan detection can not tell the
+// objects of ceph-csi from other users of the cluster apart well enough to
+// delete them.
+func Cleanup(w io.Writer) error {
+	f, err := newClusterFramework("cleanup")
+	if err != nil {
+		return err
+	}
+	c := f.ClientSet
+	ctx := context.TODO()
+
+	var errs []error
+	selector := fmt.Sprintf("e2e-framework in (%s)", strings.Join(suiteFrameworkNames, ","))
+	nsList, err := c.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		fmt.Fprintf(w, "deleting namespace %s\n", ns.Name)
+		if err := deleteNamespace(c, ns.Name); err != nil {
+			errs = append(errs, fmt.Errorf("namespace %s: %w", ns.Name, err))
+		}
+	}
+
+	for _, name := range suiteStorageClasses {
+		err := deleteStorageClass(c, name)
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "deleted storageclass %s\n", name)
+		case !apierrs.IsNotFound(err):
+			errs = append(errs, fmt.Errorf("storageclass %s: %w", name, err))
+		}
+	}
+
+	sclient, err := newSnapshotClient()
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{"manifest/rbd/snapshotclass.yaml", "manifest/cephfs/snapshotclass.yaml"} {
+		sc := snapapi.VolumeSnapshotClass{}
+		if err := unmarshal(path, &sc); err != nil {
+			return err
+		}
+		name := sc.Name
+		err := sclient.VolumeSnapshotClasses().Delete(ctx, name, metav1.DeleteOptions{})
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "deleted volumesnapshotclass %s\n", name)
+		case !apierrs.IsNotFound(err):
+			errs = append(errs, fmt.Errorf("volumesnapshotclass %s: %w", name, err))
+		}
+	}
+
+	for _, kms := range encryptionKMSes {
+		if err := deleteEncryptionKMS(c, kms); err != nil {
+			errs = append(errs, fmt.Errorf("%s KMS: %w", kms.name, err))
+		}
+	}
+
+	if err := deleteCephFSStaticSecret(c); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateNoCephOrphans(f); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// WriteReport writes a summary of the ginkgo JSON report at path to w. It
+// returns an error when the report can not be read, a spec failed or no spec
+// ran, as a label filter that matches no spec is a selection mistake rather
+// than a passing run.
+func WriteReport(w io.Writer, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read report: %w", err)
+	}
+	var reports []types.Report
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return fmt.Errorf("failed to parse report %s: %w", path, err)
+	}
+
+	var failures []types.SpecReport
+	ran := 0
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESULT\tDURATION\tSPEC")
+	for _, report := range reports {
+		for _, spec := range report.SpecReports {
+			if spec.LeafNodeType != types.NodeTypeIt || spec.State.Is(types.SpecStateSkipped|types.SpecStatePending) {
+				continue
+			}
+			ran++
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", spec.State, spec.RunTime.Round(time.Second), spec.FullText())
+			if spec.State.Is(types.SpecStateFailureStates) {
+				failures = append(failures, spec)
+			}
+		}
+		// failures outside of the specs, e.g. in the orphan detection
+		for _, spec := range report.SpecReports {
+			if spec.LeafNodeType != types.NodeTypeIt && spec.State.Is(types.SpecStateFailureStates) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", spec.State, spec.RunTime.Round(time.Second), spec.LeafNodeType)
+				failures = append(failures, spec)
+			}
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, spec := range failures {
+		fmt.Fprintf(w, "\n%s %s\n%s\n", spec.State, spec.FullText(), spec.Failure.Message)
+	}
+	if len(failures) != 0 {
+		return fmt.Errorf("%d specs failed", len(failures))
+	}
+	if ran == 0 {
+		return errors.New("no specs matched the selected features and maturity")
+	}
+	fmt.Fprintln(w, "\nall specs passed")
+
+	return nil
+}
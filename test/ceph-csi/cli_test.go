@@ -0,0 +1,88 @@
+package ceph_csi
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	"github.com/onsi/ginkgo/v2/types"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Command spec selection", Label("unit"), func() {
+	It("should exclude the unit specs without features", func() {
+		Expect(LabelFilter(nil)).To(Equal("!unit"))
+	})
+
+	It("should or the features of a group and and the groups", func() {
+		Expect(LabelFilter([]string{"rbd", "CephFS", " snapshot", "rbd"})).
+			To(Equal("(rbd || cephfs) && (snapshot) && !unit"))
+		Expect(LabelFilter([]string{"block", "elasticsearch"})).
+			To(Equal("(es) && (block) && !unit"))
+	})
+
+	It("should reject unknown features", func() {
+		_, err := LabelFilter([]string{"rbd", "mirroring"})
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("mirroring"))
+	})
+
+	It("should focus on the maturity level", func() {
+		Expect(MaturityFocus("GA")).To(Equal(`\[GA\]`))
+		Expect(MaturityFocus("beta")).To(Equal(`\[Beta\]`))
+		Expect(MaturityFocus("Alpha")).To(Equal(`\[Alpha\]`))
+		Expect(MaturityFocus("all")).To(BeEmpty())
+		_, err := MaturityFocus("stable")
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should tell whether the label filter selects cluster specs", func() {
+		for _, filter := range []string{"", "!unit", "rbd && !unit", "(cephfs) && (expansion) && (rwx) && !unit"} {
+			Expect(clusterSpecsSelected(filter)).To(BeTrue(), filter)
+		}
+		for _, filter := range []string{"unit", "snapshot && clone", "rwo && rwx", "rbd && !block && !file"} {
+			Expect(clusterSpecsSelected(filter)).To(BeFalse(), filter)
+		}
+		_, err := clusterSpecsSelected("rbd &&")
+		Expect(err).Should(HaveOccurred())
+	})
+})
+
+var _ = Describe("Command report", Label("unit"), func() {
+	writeReport := func(specs ...types.SpecReport) string {
+		path := filepath.Join(GinkgoT().TempDir(), "report.json")
+		data, err := json.Marshal([]types.Report{{SpecReports: specs}})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(os.WriteFile(path, data, 0o600)).To(Succeed())
+
+		return path
+	}
+	spec := func(text string, state types.SpecState) types.SpecReport {
+		return types.SpecReport{LeafNodeType: types.NodeTypeIt, LeafNodeText: text, State: state}
+	}
+
+	It("should pass when the specs that ran passed", func() {
+		var out bytes.Buffer
+		path := writeReport(spec("provisions", types.SpecStatePassed), spec("skipped", types.SpecStateSkipped))
+		Expect(WriteReport(&out, path)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("provisions"))
+		Expect(out.String()).NotTo(ContainSubstring("skipped"))
+	})
+
+	It("should fail when a spec failed", func() {
+		var out bytes.Buffer
+		path := writeReport(spec("provisions", types.SpecStatePassed), spec("expands", types.SpecStateFailed))
+		err := WriteReport(&out, path)
+		Expect(err).To(MatchError("1 specs failed"))
+	})
+
+	It("should fail when no spec ran", func() {
+		var out bytes.Buffer
+		path := writeReport(spec("skipped", types.SpecStateSkipped), spec("pending", types.SpecStatePending))
+		err := WriteReport(&out, path)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no specs matched"))
+	})
+})
@@ -0,0 +1,307 @@
+package ceph_csi
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	kjson "sigs.k8s.io/json"
+)
+
+// suiteConfig is the layout of the file passed with -config. Options that are
+// not set in the file keep their defaults, and options that are set on the
+// command line take precedence over the file.
+//
+//	cephCSINamespace: ceph-csi
+//	cephCSISecretNamespace: ceph-csi
+//	clusterID: 7b6e5e7c-1d7b-4f39-a0b8-8d2d4c6f7a11
+//	rbd:
+//	  pool: rbd
+//	  storageClass: rbd-sc
+//	  provisioner: rbd.csi.ceph.com
+//	cephfs:
+//	  fileSystem: myfs
+//	  provisioner: cephfs.csi.ceph.com
+type suiteConfig struct {
+	CephCSINamespace       string       `json:"cephCSINamespace"`
+	CephCSISecretNamespace string       `json:"cephCSISecretNamespace"`
+	ClusterID              string       `json:"clusterID"`
+	RBD                    rbdConfig    `json:"rbd"`
+	CephFS                 cephfsConfig `json:"cephfs"`
+	NFS                    nfsConfig    `json:"nfs"`
+}
+
+type rbdConfig struct {
+	Pool              string `json:"pool"`
+	RadosNamespace    string `json:"radosNamespace"`
+	StorageClass      string `json:"storageClass"`
+	Provisioner       string `json:"provisioner"`
+	ProvisionerSecret string `json:"provisionerSecret"`
+	NodePluginSecret  string `json:"nodePluginSecret"`
+	// NodePluginDaemonSet and ProvisionerDeployment are the names of the
+	// ceph-csi workloads in the ceph-csi namespace.
+	NodePluginDaemonSet   string `json:"nodePluginDaemonSet"`
+	ProvisionerDeployment string `json:"provisionerDeployment"`
+	// TopologyPools maps zones to pools for the topology specs, e.g.
+	// "zone-a=pool-a,zone-b=pool-b".
+	TopologyPools string `json:"topologyPools"`
+}
+
+type cephfsConfig struct {
+	FileSystem            string `json:"fileSystem"`
+	DataPool              string `json:"dataPool"`
+	SubvolumeGroup        string `json:"subvolumeGroup"`
+	StorageClass          string `json:"storageClass"`
+	Provisioner           string `json:"provisioner"`
+	ProvisionerSecret     string `json:"provisionerSecret"`
+	NodePluginSecret      string `json:"nodePluginSecret"`
+	NodePluginDaemonSet   string `json:"nodePluginDaemonSet"`
+	ProvisionerDeployment string `json:"provisionerDeployment"`
+}
+
+type nfsConfig struct {
+	Provisioner string `json:"provisioner"`
+}
+
+// suiteConfigFile is the path of the config file, empty when only the flags
+// and defaults are used.
+var suiteConfigFile string
+
+// configOption ties a package level setting to its flag and to its field in
+// the config file.
+type configOption struct {
+	flag  string
+	usage string
+	value *string
+	// fromFile returns the value of the option in the config file.
+	fromFile func(cfg *suiteConfig) string
+	// validate returns the reasons the value is invalid, nil when the option
+	// is optional and not set.
+	validate func(value string) []string
+}
+
+func required(value string) []string {
+	if value == "" {
+		return []string{"must not be empty"}
+	}
+
+	return nil
+}
+
+func optional(string) []string {
+	return nil
+}
+
+func dns1123Label(value string) []string {
+	if value == "" {
+		return required(value)
+	}
+
+	return validation.IsDNS1123Label(value)
+}
+
+func dns1123Subdomain(value string) []string {
+	if value == "" {
+		return required(value)
+	}
+
+	return validation.IsDNS1123Subdomain(value)
+}
+
+func optionalDNS1123Subdomain(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	return validation.IsDNS1123Subdomain(value)
+}
+
+func suiteConfigOptions() []configOption {
+	return []configOption{
+		{
+			flag: "ceph-csi-namespace", usage: "namespace where ceph-csi (and the rook toolbox) are deployed",
+			value: &cephCSINamespace, validate: dns1123Label,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephCSINamespace },
+		},
+		{
+			flag: "ceph-csi-secret-namespace", usage: "namespace of the ceph-csi secrets referenced by the storage classes",
+			value: &cephCSISecretNamespace, validate: dns1123Label,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephCSISecretNamespace },
+		},
+		{
+			flag: "cluster-id", usage: "clusterID of the storage and snapshot classes, defaults to the one in the manifests",
+			value: &cephCSIClusterID, validate: optional,
+			fromFile: func(cfg *suiteConfig) string { return cfg.ClusterID },
+		},
+		{
+			flag: "rbd-pool", usage: "rbd pool the volumes are provisioned in",
+			value: &defaultRbdPool, validate: required,
+			fromFile: func(cfg *suiteConfig) string { return cfg.RBD.Pool },
+		},
+		{
+			flag: "rbd-rados-namespace", usage: "rados namespace of the rbd pool",
+			value: &radosNamespace, validate: optional,
+			fromFile: func(cfg *suiteConfig) string { return cfg.RBD.RadosNamespace },
+		},
+		{
+			flag: "rbd-storageclass", usage: "name of the rbd storage class created by the suite",
+			value: &defaultRbdSc, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.RBD.StorageClass },
+		},
+		{
+			flag: "rbd-provisioner", usage: "name of the rbd CSI driver, discovered from the CSIDriver objects when empty",
+			value: &rbdProvisioner, validate: optionalDNS1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.RBD.Provisioner },
+		},
+		{
+			flag: "rbd-provisioner-secret", usage: "secret of the rbd provisioner",
+			value: &rbdProvisionerSecretName, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.RBD.ProvisionerSecret },
+		},
+		{
+			flag: "rbd-nodeplugin-secret", usage: "secret of the rbd nodeplugin",
+			value: &rbdNodePluginSecretName, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.RBD.NodePluginSecret },
+		},
+		{
+			flag: "rbd-nodeplugin-daemonset", usage: "daemonset of the rbd nodeplugin",
+			value: &rbdNodePluginDaemonSet, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.RBD.NodePluginDaemonSet },
+		},
+		{
+			flag: "rbd-provisioner-deployment", usage: "deployment of the rbd provisioner",
+			value: &rbdProvisionerDeployment, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.RBD.ProvisionerDeployment },
+		},
+		{
+			flag: "rbd-topology-pools", usage: "comma separated <zone>=<pool> pairs for the topology specs, " +
+				"which are skipped when it is empty",
+			value: &rbdTopologyPools, validate: validateTopologyPools,
+			fromFile: func(cfg *suiteConfig) string { return cfg.RBD.TopologyPools },
+		},
+		{
+			flag: "cephfs-filesystem", usage: "cephfs filesystem the volumes are provisioned in",
+			value: &defaultFileSystemName, validate: required,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephFS.FileSystem },
+		},
+		{
+			flag: "cephfs-data-pool", usage: "data pool of the cephfs filesystem",
+			value: &defaultFileSystemDataPool, validate: required,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephFS.DataPool },
+		},
+		{
+			flag: "cephfs-subvolumegroup", usage: "subvolumegroup of the cephfs volumes",
+			value: &defaultSubvolumegroup, validate: required,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephFS.SubvolumeGroup },
+		},
+		{
+			flag: "cephfs-storageclass", usage: "name of the cephfs storage class created by the suite",
+			value: &defaultCephfsSc, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephFS.StorageClass },
+		},
+		{
+			flag: "cephfs-provisioner", usage: "name of the cephfs CSI driver, discovered from the CSIDriver objects when empty",
+			value: &cephfsProvisioner, validate: optionalDNS1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephFS.Provisioner },
+		},
+		{
+			flag: "cephfs-provisioner-secret", usage: "secret of the cephfs provisioner",
+			value: &cephFSProvisionerSecretName, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephFS.ProvisionerSecret },
+		},
+		{
+			flag: "cephfs-nodeplugin-secret", usage: "secret of the cephfs nodeplugin",
+			value: &cephFSNodePluginSecretName, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephFS.NodePluginSecret },
+		},
+		{
+			flag: "cephfs-nodeplugin-daemonset", usage: "daemonset of the cephfs nodeplugin",
+			value: &cephFSNodePluginDaemonSet, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephFS.NodePluginDaemonSet },
+		},
+		{
+			flag: "cephfs-provisioner-deployment", usage: "deployment of the cephfs provisioner",
+			value: &cephFSProvisionerDeployment, validate: dns1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.CephFS.ProvisionerDeployment },
+		},
+		{
+			flag: "nfs-provisioner", usage: "name of the nfs CSI driver, discovered from the CSIDriver objects when empty",
+			value: &nfsProvisioner, validate: optionalDNS1123Subdomain,
+			fromFile: func(cfg *suiteConfig) string { return cfg.NFS.Provisioner },
+		},
+	}
+}
+
+// registerSuiteConfigFlags adds the -config flag and a flag for every config
+// option to the flag set.
+func registerSuiteConfigFlags(fs *flag.FlagSet) {
+	fs.StringVar(&suiteConfigFile, "config", "",
+		"YAML file with the names of the ceph and kubernetes resources the suite runs against")
+	for _, opt := range suiteConfigOptions() {
+		fs.StringVar(opt.value, opt.flag, *opt.value, opt.usage)
+	}
+}
+
+// parseSuiteConfig decodes the config file. Unknown and duplicate keys are
+// rejected and keys are case sensitive, a misspelled option would otherwise
+// silently keep its default.
+func parseSuiteConfig(data []byte) (*suiteConfig, error) {
+	data, err := utilyaml.ToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &suiteConfig{}
+	strictErrs, err := kjson.UnmarshalStrict(data, cfg, kjson.DisallowUnknownFields, kjson.DisallowDuplicateFields)
+	if err != nil {
+		return nil, err
+	}
+	if len(strictErrs) != 0 {
+		return nil, errors.Join(strictErrs...)
+	}
+
+	return cfg, nil
+}
+
+// loadSuiteConfig applies the config file on top of the defaults, keeping the
+// options that were set on the command line, and validates the result. It
+// must be called after the flag set is parsed.
+func loadSuiteConfig(fs *flag.FlagSet) error {
+	opts := suiteConfigOptions()
+
+	if suiteConfigFile != "" {
+		data, err := os.ReadFile(suiteConfigFile)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+		cfg, err := parseSuiteConfig(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse config file %s: %w", suiteConfigFile, err)
+		}
+
+		setOnCommandLine := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) {
+			setOnCommandLine[f.Name] = true
+		})
+		for _, opt := range opts {
+			if v := opt.fromFile(cfg); v != "" && !setOnCommandLine[opt.flag] {
+				*opt.value = v
+			}
+		}
+	}
+
+	var failures []string
+	for _, opt := range opts {
+		for _, msg := range opt.validate(*opt.value) {
+			failures = append(failures, fmt.Sprintf("-%s=%q: %s", opt.flag, *opt.value, msg))
+		}
+	}
+	if len(failures) != 0 {
+		return errors.New("invalid suite configuration:\n" + strings.Join(failures, "\n"))
+	}
+
+	return nil
+}
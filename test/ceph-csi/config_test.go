@@ -0,0 +1,104 @@
+package ceph_csi
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("Suite configuration", Label("unit"), func() {
+	var fs *flag.FlagSet
+
+	BeforeEach(func() {
+		// the options point at package level settings, restore them so the
+		// specs do not leak into each other
+		saved := map[*string]string{}
+		for _, opt := range suiteConfigOptions() {
+			saved[opt.value] = *opt.value
+		}
+		savedFile := suiteConfigFile
+		DeferCleanup(func() {
+			for value, s := range saved {
+				*value = s
+			}
+			suiteConfigFile = savedFile
+		})
+
+		fs = flag.NewFlagSet("ceph-csi", flag.ContinueOnError)
+		registerSuiteConfigFlags(fs)
+	})
+
+	writeConfig := func(content string) string {
+		path := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+
+		return path
+	}
+
+	It("should keep the defaults without config file", func() {
+		Expect(fs.Parse(nil)).To(Succeed())
+		Expect(loadSuiteConfig(fs)).To(Succeed())
+		Expect(defaultRbdPool).To(Equal("replicapool"))
+		Expect(defaultRbdSc).To(Equal(manifestRbdSc))
+	})
+
+	It("should apply the config file and prefer the flags", func() {
+		path := writeConfig(`
+cephCSINamespace: ceph-csi
+rbd:
+  pool: rbd
+  storageClass: rbd-sc
+cephfs:
+  fileSystem: myfs
+  provisioner: cephfs.csi.ceph.com
+`)
+		Expect(fs.Parse([]string{"-config=" + path, "-rbd-pool=fast"})).To(Succeed())
+		Expect(loadSuiteConfig(fs)).To(Succeed())
+
+		Expect(cephCSINamespace).To(Equal("ceph-csi"))
+		Expect(defaultRbdPool).To(Equal("fast"))
+		Expect(defaultRbdSc).To(Equal("rbd-sc"))
+		Expect(defaultFileSystemName).To(Equal("myfs"))
+		Expect(cephfsProvisioner).To(Equal("cephfs.csi.ceph.com"))
+		Expect(cephCSISecretNamespace).To(Equal("rook-ceph-external"))
+
+		pvc := &v1.PersistentVolumeClaim{}
+		Expect(unmarshal("manifest/rbd/block-rwo-pvc.yaml", pvc)).To(Succeed())
+		Expect(pvc.Spec.StorageClassName).To(HaveValue(Equal("rbd-sc")))
+	})
+
+	It("should reject invalid names", func() {
+		Expect(fs.Parse([]string{"-ceph-csi-namespace=Rook_Ceph", "-rbd-pool="})).To(Succeed())
+
+		err := loadSuiteConfig(fs)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("-ceph-csi-namespace"))
+		Expect(err.Error()).To(ContainSubstring("-rbd-pool"))
+	})
+
+	It("should reject unknown keys in the config file", func() {
+		path := writeConfig(`
+rbd:
+  pool: rbd
+  storageclass: rbd-sc
+`)
+		Expect(fs.Parse([]string{"-config=" + path})).To(Succeed())
+
+		err := loadSuiteConfig(fs)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`unknown field "rbd.storageclass"`))
+	})
+
+	It("should reject a config file that is not a mapping of options", func() {
+		path := writeConfig("rbd: [pool]\n")
+		Expect(fs.Parse([]string{"-config=" + path})).To(Succeed())
+
+		err := loadSuiteConfig(fs)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("failed to parse config file"))
+	})
+})
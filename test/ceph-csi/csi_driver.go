@@ -0,0 +1,143 @@
+package ceph_csi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+const (
+	// the CSIDriver names of ceph-csi end with these, the prefix depends on
+	// how ceph-csi is deployed, e.g. rook-ceph.rbd.csi.ceph.com for rook and
+	// rbd.csi.ceph.com for the helm charts.
+	rbdDriverSuffix    = "rbd.csi.ceph.com"
+	cephfsDriverSuffix = "cephfs.csi.ceph.com"
+	nfsDriverSuffix    = "nfs.csi.ceph.com"
+)
+
+// csiDriverNames holds the names of the ceph-csi drivers, an empty name means
+// the driver is not deployed.
+type csiDriverNames struct {
+	rbd    string
+	cephfs string
+	nfs    string
+}
+
+var discoverCSIDriversOnce struct {
+	sync.Once
+	err error
+}
+
+// isDriverOfType checks if the CSIDriver name belongs to the ceph-csi driver
+// with the suffix, a custom prefix has to be separated by a dot.
+func isDriverOfType(name, suffix string) bool {
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
+
+// selectDriver returns the only name of the driver type in names, or the
+// override when it is set.
+func selectDriver(names []string, suffix, override, flagName string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+
+	var candidates []string
+	for _, name := range names {
+		if isDriverOfType(name, suffix) {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) > 1 {
+		return "", fmt.Errorf("found multiple CSIDrivers for %s: %s, select one with -%s",
+			suffix, strings.Join(candidates, ", "), flagName)
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	return candidates[0], nil
+}
+
+// selectCSIDrivers picks the ceph-csi drivers out of the names of the
+// CSIDriver objects, configured names take precedence.
+func selectCSIDrivers(names []string, configured csiDriverNames) (csiDriverNames, error) {
+	var (
+		drivers csiDriverNames
+		err     error
+	)
+	drivers.rbd, err = selectDriver(names, rbdDriverSuffix, configured.rbd, "rbd-provisioner")
+	if err != nil {
+		return csiDriverNames{}, err
+	}
+	drivers.cephfs, err = selectDriver(names, cephfsDriverSuffix, configured.cephfs, "cephfs-provisioner")
+	if err != nil {
+		return csiDriverNames{}, err
+	}
+	drivers.nfs, err = selectDriver(names, nfsDriverSuffix, configured.nfs, "nfs-provisioner")
+	if err != nil {
+		return csiDriverNames{}, err
+	}
+
+	return drivers, nil
+}
+
+// discoverCSIDrivers fills in the driver names that are not configured from
+// the CSIDriver objects of the cluster. The cluster is only queried once.
+func discoverCSIDrivers(c kubernetes.Interface) error {
+	discoverCSIDriversOnce.Do(func() {
+		configured := csiDriverNames{rbd: rbdProvisioner, cephfs: cephfsProvisioner, nfs: nfsProvisioner}
+		if configured.rbd != "" && configured.cephfs != "" && configured.nfs != "" {
+			return
+		}
+
+		driverList, err := c.StorageV1().CSIDrivers().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			discoverCSIDriversOnce.err = fmt.Errorf("failed to list csidrivers: %w", err)
+
+			return
+		}
+		names := make([]string, 0, len(driverList.Items))
+		for i := range driverList.Items {
+			names = append(names, driverList.Items[i].Name)
+		}
+
+		drivers, err := selectCSIDrivers(names, configured)
+		if err != nil {
+			discoverCSIDriversOnce.err = err
+
+			return
+		}
+		rbdProvisioner = drivers.rbd
+		cephfsProvisioner = drivers.cephfs
+		nfsProvisioner = drivers.nfs
+		framework.Logf("using CSI drivers rbd=%q cephfs=%q nfs=%q", rbdProvisioner, cephfsProvisioner, nfsProvisioner)
+	})
+
+	return discoverCSIDriversOnce.err
+}
+
+func getDriverName(c kubernetes.Interface, name *string, suffix, flagName string) (string, error) {
+	if err := discoverCSIDrivers(c); err != nil {
+		return "", err
+	}
+	if *name == "" {
+		return "", fmt.Errorf("no CSIDriver for %s found, set it with -%s", suffix, flagName)
+	}
+
+	return *name, nil
+}
+
+// getRBDDriverName returns the name of the rbd driver.
+func getRBDDriverName(c kubernetes.Interface) (string, error) {
+	return getDriverName(c, &rbdProvisioner, rbdDriverSuffix, "rbd-provisioner")
+}
+
+// getCephFSDriverName returns the name of the cephfs driver.
+func getCephFSDriverName(c kubernetes.Interface) (string, error) {
+	return getDriverName(c, &cephfsProvisioner, cephfsDriverSuffix, "cephfs-provisioner")
+}
@@ -0,0 +1,39 @@
+package ceph_csi
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CSI driver discovery", Label("unit"), func() {
+	It("should pick the ceph-csi drivers regardless of their prefix", func() {
+		drivers, err := selectCSIDrivers([]string{
+			"rook-ceph.rbd.csi.ceph.com",
+			"cephfs.csi.ceph.com",
+			"ebs.csi.aws.com",
+		}, csiDriverNames{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(drivers).To(Equal(csiDriverNames{
+			rbd:    "rook-ceph.rbd.csi.ceph.com",
+			cephfs: "cephfs.csi.ceph.com",
+		}))
+	})
+
+	It("should not confuse drivers sharing a suffix", func() {
+		Expect(isDriverOfType("cephfs.csi.ceph.com", rbdDriverSuffix)).To(BeFalse())
+		Expect(isDriverOfType("myrbd.csi.ceph.com", rbdDriverSuffix)).To(BeFalse())
+		Expect(isDriverOfType("openshift-storage.rbd.csi.ceph.com", rbdDriverSuffix)).To(BeTrue())
+	})
+
+	It("should require an override when a driver type is ambiguous", func() {
+		names := []string{"rook-ceph.rbd.csi.ceph.com", "rbd.csi.ceph.com"}
+
+		_, err := selectCSIDrivers(names, csiDriverNames{})
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("-rbd-provisioner"))
+
+		drivers, err := selectCSIDrivers(names, csiDriverNames{rbd: "rbd.csi.ceph.com"})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(drivers.rbd).To(Equal("rbd.csi.ceph.com"))
+	})
+})
@@ -0,0 +1,249 @@
+package ceph_csi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	snapapi "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultVolumeNamePrefix is the prefix ceph-csi uses for the rbd images
+	// and cephfs subvolumes it creates when volumeNamePrefix is not set.
+	defaultVolumeNamePrefix = "csi-vol-"
+
+	// defaultSnapshotNamePrefix is the prefix ceph-csi uses for the rbd
+	// images and cephfs subvolume snapshots backing a VolumeSnapshot.
+	defaultSnapshotNamePrefix = "csi-snap-"
+
+	// staticVolumeAttribute marks a PV whose rbd image or cephfs subvolume
+	// was created outside of ceph-csi.
+	staticVolumeAttribute = "staticVolume"
+)
+
+// uuidSuffix matches the uuid at the end of a ceph-csi volume or snapshot
+// handle, e.g. 0001-0009-rook-ceph-0000000000000002-<uuid>.
+var uuidSuffix = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// uuidFromHandle returns the uuid part of a ceph-csi volume or snapshot
+// handle.
+func uuidFromHandle(handle string) (string, error) {
+	uuid := uuidSuffix.FindString(handle)
+	if uuid == "" {
+		return "", fmt.Errorf("handle %q does not end with a uuid", handle)
+	}
+
+	return uuid, nil
+}
+
+// isStaticVolume checks if the volume attributes are those of a static PV.
+func isStaticVolume(attrs map[string]string) bool {
+	return attrs[staticVolumeAttribute] == "true"
+}
+
+// claimName returns the namespace/name of the PVC a PV is bound to.
+func claimName(pv *v1.PersistentVolume) string {
+	if pv.Spec.ClaimRef == nil {
+		return ""
+	}
+
+	return pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+}
+
+// rbdImageRef identifies the rbd image backing a PersistentVolume.
+type rbdImageRef struct {
+	pvName string
+	claim  string
+	pool   string
+	image  string
+}
+
+func (ref rbdImageRef) String() string {
+	return fmt.Sprintf("PVC %s (PV %s) -> rbd image %s/%s", ref.claim, ref.pvName, ref.pool, ref.image)
+}
+
+// getRBDImageRef resolves the rbd image of a PV provisioned by ceph-csi. The
+// imageName and pool volume attributes are used when they are set, otherwise
+// the image name is derived from the volumeHandle. The volumeHandle of a
+// static PV is the image name.
+func getRBDImageRef(pv *v1.PersistentVolume) (rbdImageRef, error) {
+	if pv.Spec.CSI == nil {
+		return rbdImageRef{}, fmt.Errorf("PV %s is not a CSI volume", pv.Name)
+	}
+	attrs := pv.Spec.CSI.VolumeAttributes
+
+	ref := rbdImageRef{
+		pvName: pv.Name,
+		claim:  claimName(pv),
+		pool:   attrs["pool"],
+		image:  attrs["imageName"],
+	}
+	if ref.pool == "" {
+		ref.pool = defaultRbdPool
+	}
+	if ref.image == "" && isStaticVolume(attrs) {
+		ref.image = pv.Spec.CSI.VolumeHandle
+	}
+	if ref.image == "" {
+		uuid, err := uuidFromHandle(pv.Spec.CSI.VolumeHandle)
+		if err != nil {
+			return rbdImageRef{}, fmt.Errorf("failed to resolve image of PV %s: %w", pv.Name, err)
+		}
+		ref.image = defaultVolumeNamePrefix + uuid
+	}
+
+	return ref, nil
+}
+
+// cephfsSubVolumeRef identifies the cephfs subvolume backing a
+// PersistentVolume.
+type cephfsSubVolumeRef struct {
+	pvName    string
+	claim     string
+	fsName    string
+	group     string
+	subVolume string
+	path      string
+}
+
+func (ref cephfsSubVolumeRef) String() string {
+	return fmt.Sprintf("PVC %s (PV %s) -> subvolume %s/%s/%s", ref.claim, ref.pvName, ref.fsName, ref.group, ref.subVolume)
+}
+
+// getCephFSSubVolumeRef resolves the cephfs subvolume of a PV provisioned by
+// ceph-csi. The subvolumeName, subvolumePath and fsName volume attributes are
+// used when they are set, otherwise the subvolume name is derived from the
+// volumeHandle. The subvolume of a static PV is taken from its rootPath.
+func getCephFSSubVolumeRef(pv *v1.PersistentVolume) (cephfsSubVolumeRef, error) {
+	if pv.Spec.CSI == nil {
+		return cephfsSubVolumeRef{}, fmt.Errorf("PV %s is not a CSI volume", pv.Name)
+	}
+	attrs := pv.Spec.CSI.VolumeAttributes
+
+	ref := cephfsSubVolumeRef{
+		pvName:    pv.Name,
+		claim:     claimName(pv),
+		fsName:    attrs["fsName"],
+		group:     defaultSubvolumegroup,
+		subVolume: attrs["subvolumeName"],
+		path:      attrs["subvolumePath"],
+	}
+	if ref.fsName == "" {
+		ref.fsName = defaultFileSystemName
+	}
+	if ref.subVolume == "" && isStaticVolume(attrs) {
+		group, subVolume, err := subVolumeFromPath(attrs["rootPath"])
+		if err != nil {
+			return cephfsSubVolumeRef{}, fmt.Errorf("failed to resolve subvolume of PV %s: %w", pv.Name, err)
+		}
+		ref.group = group
+		ref.subVolume = subVolume
+		ref.path = attrs["rootPath"]
+	}
+	if ref.subVolume == "" {
+		uuid, err := uuidFromHandle(pv.Spec.CSI.VolumeHandle)
+		if err != nil {
+			return cephfsSubVolumeRef{}, fmt.Errorf("failed to resolve subvolume of PV %s: %w", pv.Name, err)
+		}
+		ref.subVolume = defaultVolumeNamePrefix + uuid
+	}
+
+	return ref, nil
+}
+
+// subVolumeFromPath returns the subvolumegroup and subvolume of a subvolume
+// path, i.e. /volumes/<group>/<subvolume>/<uuid>.
+func subVolumeFromPath(path string) (string, string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "volumes" {
+		return "", "", fmt.Errorf("%q is not the path of a subvolume", path)
+	}
+
+	return parts[1], parts[2], nil
+}
+
+// snapshotUUID returns the uuid of the snapshotHandle of a
+// VolumeSnapshotContent.
+func snapshotUUID(vsc *snapapi.VolumeSnapshotContent) (string, error) {
+	if vsc.Status == nil || vsc.Status.SnapshotHandle == nil {
+		return "", fmt.Errorf("VolumeSnapshotContent %s has no snapshotHandle", vsc.Name)
+	}
+	uuid, err := uuidFromHandle(*vsc.Status.SnapshotHandle)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve snapshot of VolumeSnapshotContent %s: %w", vsc.Name, err)
+	}
+
+	return uuid, nil
+}
+
+// snapshotName returns the namespace/name of the VolumeSnapshot a
+// VolumeSnapshotContent is bound to.
+func snapshotName(vsc *snapapi.VolumeSnapshotContent) string {
+	return vsc.Spec.VolumeSnapshotRef.Namespace + "/" + vsc.Spec.VolumeSnapshotRef.Name
+}
+
+// rbdSnapshotRef identifies the rbd image backing a VolumeSnapshot. ceph-csi
+// creates it as a clone of the source image in the pool of the source image.
+type rbdSnapshotRef struct {
+	contentName string
+	snapshot    string
+	pool        string
+	image       string
+}
+
+func (ref rbdSnapshotRef) String() string {
+	return fmt.Sprintf("VolumeSnapshot %s (VolumeSnapshotContent %s) -> rbd image %s/%s",
+		ref.snapshot, ref.contentName, ref.pool, ref.image)
+}
+
+// getRBDSnapshotRef resolves the rbd snapshot image of a VolumeSnapshotContent
+// taken from the source image.
+func getRBDSnapshotRef(vsc *snapapi.VolumeSnapshotContent, source rbdImageRef) (rbdSnapshotRef, error) {
+	uuid, err := snapshotUUID(vsc)
+	if err != nil {
+		return rbdSnapshotRef{}, err
+	}
+
+	return rbdSnapshotRef{
+		contentName: vsc.Name,
+		snapshot:    snapshotName(vsc),
+		pool:        source.pool,
+		image:       defaultSnapshotNamePrefix + uuid,
+	}, nil
+}
+
+// cephfsSnapshotRef identifies the cephfs subvolume snapshot backing a
+// VolumeSnapshot.
+type cephfsSnapshotRef struct {
+	contentName string
+	snapshot    string
+	fsName      string
+	group       string
+	subVolume   string
+	name        string
+}
+
+func (ref cephfsSnapshotRef) String() string {
+	return fmt.Sprintf("VolumeSnapshot %s (VolumeSnapshotContent %s) -> subvolume snapshot %s/%s/%s@%s",
+		ref.snapshot, ref.contentName, ref.fsName, ref.group, ref.subVolume, ref.name)
+}
+
+// getCephFSSnapshotRef resolves the subvolume snapshot of a
+// VolumeSnapshotContent taken from the source subvolume.
+func getCephFSSnapshotRef(vsc *snapapi.VolumeSnapshotContent, source cephfsSubVolumeRef) (cephfsSnapshotRef, error) {
+	uuid, err := snapshotUUID(vsc)
+	if err != nil {
+		return cephfsSnapshotRef{}, err
+	}
+
+	return cephfsSnapshotRef{
+		contentName: vsc.Name,
+		snapshot:    snapshotName(vsc),
+		fsName:      source.fsName,
+		group:       source.group,
+		subVolume:   source.subVolume,
+		name:        defaultSnapshotNamePrefix + uuid,
+	}, nil
+}
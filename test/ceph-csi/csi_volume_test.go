@@ -0,0 +1,126 @@
+package ceph_csi
+
+import (
+	snapapi "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newCSIPersistentVolume(name, handle string, attrs map[string]string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Namespace: "rbd-1234", Name: "rbd-file-pvc"},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					VolumeHandle:     handle,
+					VolumeAttributes: attrs,
+				},
+			},
+		},
+	}
+}
+
+var _ = Describe("CSI volume handles", Label("unit"), func() {
+	const handle = "0001-0009-rook-ceph-0000000000000004-b0285c97-a0ce-11eb-8c66-0242ac110002"
+
+	It("should prefer the imageName and pool volume attributes", func() {
+		pv := newCSIPersistentVolume("pvc-1", handle, map[string]string{
+			"imageName": "foo-b0285c97-a0ce-11eb-8c66-0242ac110002",
+			"pool":      "otherpool",
+		})
+
+		ref, err := getRBDImageRef(pv)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ref.pool).To(Equal("otherpool"))
+		Expect(ref.image).To(Equal("foo-b0285c97-a0ce-11eb-8c66-0242ac110002"))
+		Expect(ref.claim).To(Equal("rbd-1234/rbd-file-pvc"))
+	})
+
+	It("should derive the image name from the volumeHandle", func() {
+		ref, err := getRBDImageRef(newCSIPersistentVolume("pvc-1", handle, nil))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ref.pool).To(Equal(defaultRbdPool))
+		Expect(ref.image).To(Equal("csi-vol-b0285c97-a0ce-11eb-8c66-0242ac110002"))
+	})
+
+	It("should reject handles without uuid", func() {
+		_, err := getRBDImageRef(newCSIPersistentVolume("pvc-1", "static-image", nil))
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should use the volumeHandle of static PVs as image name", func() {
+		ref, err := getRBDImageRef(newCSIPersistentVolume("static-1", "static-image", map[string]string{
+			"staticVolume": "true",
+			"pool":         "otherpool",
+		}))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ref.pool).To(Equal("otherpool"))
+		Expect(ref.image).To(Equal("static-image"))
+	})
+
+	It("should resolve the subvolume of static PVs from the rootPath", func() {
+		ref, err := getCephFSSubVolumeRef(newCSIPersistentVolume("static-2", "static-subvolume", map[string]string{
+			"staticVolume": "true",
+			"rootPath":     "/volumes/static/static-subvolume/3f1c",
+		}))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ref.group).To(Equal("static"))
+		Expect(ref.subVolume).To(Equal("static-subvolume"))
+		Expect(ref.path).To(Equal("/volumes/static/static-subvolume/3f1c"))
+
+		_, err = getCephFSSubVolumeRef(newCSIPersistentVolume("static-3", "static-dir", map[string]string{
+			"staticVolume": "true",
+			"rootPath":     "/static-dir",
+		}))
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should resolve the cephfs subvolume and its path", func() {
+		pv := newCSIPersistentVolume("pvc-2", handle, map[string]string{
+			"fsName":        "myfs",
+			"subvolumeName": "csi-vol-b0285c97-a0ce-11eb-8c66-0242ac110002",
+			"subvolumePath": "/volumes/csi/csi-vol-b0285c97-a0ce-11eb-8c66-0242ac110002/3f1c",
+		})
+
+		ref, err := getCephFSSubVolumeRef(pv)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ref.fsName).To(Equal("myfs"))
+		Expect(ref.group).To(Equal(defaultSubvolumegroup))
+		Expect(ref.subVolume).To(Equal("csi-vol-b0285c97-a0ce-11eb-8c66-0242ac110002"))
+		Expect(ref.path).To(Equal("/volumes/csi/csi-vol-b0285c97-a0ce-11eb-8c66-0242ac110002/3f1c"))
+	})
+
+	It("should resolve the snapshot image and subvolume snapshot", func() {
+		snapHandle := "0001-0009-rook-ceph-0000000000000004-d24a7e19-a0ce-11eb-8c66-0242ac110002"
+		vsc := &snapapi.VolumeSnapshotContent{
+			ObjectMeta: metav1.ObjectMeta{Name: "snapcontent-1"},
+			Spec: snapapi.VolumeSnapshotContentSpec{
+				VolumeSnapshotRef: v1.ObjectReference{Namespace: "rbd-1234", Name: "rbd-pvc-snapshot"},
+			},
+			Status: &snapapi.VolumeSnapshotContentStatus{SnapshotHandle: &snapHandle},
+		}
+
+		rbdRef, err := getRBDSnapshotRef(vsc, rbdImageRef{pool: "otherpool"})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(rbdRef.pool).To(Equal("otherpool"))
+		Expect(rbdRef.image).To(Equal("csi-snap-d24a7e19-a0ce-11eb-8c66-0242ac110002"))
+		Expect(rbdRef.snapshot).To(Equal("rbd-1234/rbd-pvc-snapshot"))
+
+		cephfsRef, err := getCephFSSnapshotRef(vsc, cephfsSubVolumeRef{
+			fsName:    "myfs",
+			group:     defaultSubvolumegroup,
+			subVolume: "csi-vol-b0285c97-a0ce-11eb-8c66-0242ac110002",
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cephfsRef.subVolume).To(Equal("csi-vol-b0285c97-a0ce-11eb-8c66-0242ac110002"))
+		Expect(cephfsRef.name).To(Equal("csi-snap-d24a7e19-a0ce-11eb-8c66-0242ac110002"))
+	})
+
+	It("should reject snapshot contents without snapshotHandle", func() {
+		_, err := getRBDSnapshotRef(&snapapi.VolumeSnapshotContent{}, rbdImageRef{})
+		Expect(err).Should(HaveOccurred())
+	})
+})
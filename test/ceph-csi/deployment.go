@@ -2,8 +2,9 @@ package ceph_csi
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"io/fs"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -37,13 +38,24 @@ func execCommandInPodWithName(
 		PreserveWhitespace: true,
 	}
 
-	return e2epod.ExecWithOptions(f, podOpt)
+	return execWithRetry(f, &podOpt)
 }
 
 // Create deployment based on manifest
 func createDeployment(path string, deployTimeout int, f *framework.Framework) (*appsv1.Deployment, error) {
+	return createDeploymentWithParams(path, manifestParams{}, deployTimeout, f)
+}
+
+// createDeploymentWithParams renders the deployment manifest with the params,
+// e.g. another number of replicas, and creates it.
+func createDeploymentWithParams(
+	path string,
+	params manifestParams,
+	deployTimeout int,
+	f *framework.Framework,
+) (*appsv1.Deployment, error) {
 	deploy := &appsv1.Deployment{}
-	if err := unmarshal(path, deploy); err != nil {
+	if err := unmarshalManifest(path, params, deploy); err != nil {
 		return nil, err
 	}
 	deploy.Namespace = f.UniqueName
@@ -137,17 +149,19 @@ func waitForDeploymentComplete(clientSet kubernetes.Interface, name, ns string,
 			return false, err
 		}
 
-		// TODO need to check rolling update
-
 		// When the deployment status and its underlying resources reach the
-		// desired state, we're done
-		if deployment.Status.Replicas == deployment.Status.ReadyReplicas {
+		// desired state, we're done. A rolling update is complete when the
+		// new template is observed and only updated replicas are left.
+		if deployment.Status.ObservedGeneration >= deployment.Generation &&
+			deployment.Status.UpdatedReplicas == deployment.Status.Replicas &&
+			deployment.Status.Replicas == deployment.Status.ReadyReplicas {
 			return true, nil
 		}
 		framework.Logf(
-			"deployment status: expected replica count %d running replica count %d",
+			"deployment status: expected replica count %d running replica count %d updated replica count %d",
 			deployment.Status.Replicas,
-			deployment.Status.ReadyReplicas)
+			deployment.Status.ReadyReplicas,
+			deployment.Status.UpdatedReplicas)
 		reason = fmt.Sprintf("deployment status: %#v", deployment.Status.String())
 
 		return false, nil
@@ -183,9 +197,9 @@ type yamlResource struct {
 }
 
 func (yr *yamlResource) Do(action kubectlAction) error {
-	data, err := os.ReadFile(yr.filename)
+	data, err := readManifest(yr.filename)
 	if err != nil {
-		if os.IsNotExist(err) && yr.allowMissing {
+		if errors.Is(err, fs.ErrNotExist) && yr.allowMissing {
 			return nil
 		}
 
@@ -205,47 +219,6 @@ func (yr *yamlResource) Do(action kubectlAction) error {
 	return nil
 }
 
-// yamlResourceNamespaced takes a filename and calls
-// replaceNamespaceInTemplate() on it. There are several options for adjusting
-// templates, each has their own comment.
-type yamlResourceNamespaced struct {
-	filename  string
-	namespace string
-
-	// set the number of replicas in a Deployment to 1.
-	oneReplica bool
-
-	// enable topology support (for RBD)
-	enableTopology bool
-	domainLabel    string
-}
-
-func (yrn *yamlResourceNamespaced) Do(action kubectlAction) error {
-	data, err := replaceNamespaceInTemplate(yrn.filename)
-	if err != nil {
-		return fmt.Errorf("failed to read content from %q: %w", yrn.filename, err)
-	}
-
-	if yrn.oneReplica {
-		data = oneReplicaDeployYaml(data)
-	}
-
-	if yrn.enableTopology {
-		data = enableTopologyInTemplate(data)
-	}
-
-	if yrn.domainLabel != "" {
-		data = addTopologyDomainsToDSYaml(data, yrn.domainLabel)
-	}
-
-	err = retryKubectlInput(yrn.namespace, action, data, deployTimeout)
-	if err != nil {
-		return fmt.Errorf("failed to %s resource %q in namespace %q: %w", action, yrn.filename, yrn.namespace, err)
-	}
-
-	return nil
-}
-
 type rookNFSResource struct {
 	f           *framework.Framework
 	modules     []string
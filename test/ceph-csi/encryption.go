@@ -0,0 +1,247 @@
+package ceph_csi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// kmsConfigMapName is the configmap in the ceph-csi namespace that
+	// ceph-csi reads the KMS configurations from when no KMS config file is
+	// mounted into its pods.
+	kmsConfigMapName = "csi-kms-connection-details"
+
+	// encryptionPassphraseKey is the key of the passphrase in the secrets
+	// the local KMS types read it from.
+	encryptionPassphraseKey = "encryptionPassphrase"
+	encryptionPassphrase    = "ceph-csi-test-passphrase"
+
+	// encryptionSecretName is the secret the secrets-metadata KMS reads its
+	// passphrase from.
+	encryptionSecretName = "ceph-csi-test-encryption-secret"
+
+	// encryptedSecretSuffix is appended to the names of the copies of the
+	// rbd secrets that carry the passphrase for the kubernetes secret KMS.
+	encryptedSecretSuffix = "-encrypted"
+
+	// luksHeaderSize is the number of bytes of an image that are read to
+	// find the LUKS magic.
+	luksHeaderSize = 512
+)
+
+// luksMagic starts the header of a LUKS1 and LUKS2 device.
+var luksMagic = []byte("LUKS\xba\xbe")
+
+// encryptionKMS is a KMS that keeps the passphrases in the kubernetes cluster,
+// so the encryption specs do not need an external service.
+type encryptionKMS struct {
+	name string
+	// kmsID is the encryptionKMSID of the storage class, it is empty for
+	// the kubernetes secret KMS that ceph-csi uses without an ID.
+	kmsID string
+}
+
+var (
+	// secretsMetadataKMS stores a passphrase per volume in the image
+	// metadata, encrypted with the passphrase of encryptionSecretName.
+	secretsMetadataKMS = encryptionKMS{name: "secrets-metadata", kmsID: "ceph-csi-test-secrets-metadata"}
+	// kubernetesSecretKMS reads the passphrase from the secrets of the
+	// storage and snapshot classes.
+	kubernetesSecretKMS = encryptionKMS{name: "kubernetes secret"}
+
+	encryptionKMSes = []encryptionKMS{secretsMetadataKMS, kubernetesSecretKMS}
+)
+
+func rbdEncryptedProvisionerSecretName() string {
+	return rbdProvisionerSecretName + encryptedSecretSuffix
+}
+
+func rbdEncryptedNodePluginSecretName() string {
+	return rbdNodePluginSecretName + encryptedSecretSuffix
+}
+
+// provisionerSecretName returns the secret the storage and snapshot classes
+// of encrypted volumes use for the provisioner operations.
+func (kms encryptionKMS) provisionerSecretName() string {
+	if kms.kmsID == "" {
+		return rbdEncryptedProvisionerSecretName()
+	}
+
+	return rbdProvisionerSecretName
+}
+
+// storageClassParameters returns the parameters of an rbd storage class for
+// volumes encrypted with the KMS.
+func (kms encryptionKMS) storageClassParameters() map[string]string {
+	params := map[string]string{"encrypted": "true"}
+	if kms.kmsID != "" {
+		params["encryptionKMSID"] = kms.kmsID
+
+		return params
+	}
+	params["csi.storage.k8s.io/provisioner-secret-name"] = rbdEncryptedProvisionerSecretName()
+	params["csi.storage.k8s.io/controller-expand-secret-name"] = rbdEncryptedProvisionerSecretName()
+	params["csi.storage.k8s.io/node-stage-secret-name"] = rbdEncryptedNodePluginSecretName()
+
+	return params
+}
+
+// createEncryptionKMS stores the passphrase and the configuration of the KMS
+// in the cluster.
+func createEncryptionKMS(c kubernetes.Interface, kms encryptionKMS) error {
+	if kms.kmsID == "" {
+		for name, copyName := range map[string]string{
+			rbdProvisionerSecretName: rbdEncryptedProvisionerSecretName(),
+			rbdNodePluginSecretName:  rbdEncryptedNodePluginSecretName(),
+		} {
+			if err := copySecretWithPassphrase(c, name, copyName); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err := ensureSecret(io.Discard, c, encryptionSecretName, map[string][]byte{
+		encryptionPassphraseKey: []byte(encryptionPassphrase),
+	})
+	if err != nil {
+		return err
+	}
+	config, err := json.Marshal(map[string]string{
+		"encryptionKMSType": "metadata",
+		"secretName":        encryptionSecretName,
+		"secretNamespace":   cephCSISecretNamespace,
+	})
+	if err != nil {
+		return err
+	}
+
+	return setKMSConfig(c, kms.kmsID, string(config))
+}
+
+// deleteEncryptionKMS removes what createEncryptionKMS stored, it does not
+// fail for parts that are already gone.
+func deleteEncryptionKMS(c kubernetes.Interface, kms encryptionKMS) error {
+	var names []string
+	if kms.kmsID == "" {
+		names = []string{rbdEncryptedProvisionerSecretName(), rbdEncryptedNodePluginSecretName()}
+	} else {
+		if err := unsetKMSConfig(c, kms.kmsID); err != nil {
+			return err
+		}
+		names = []string{encryptionSecretName}
+	}
+
+	var errs []error
+	for _, name := range names {
+		err := c.CoreV1().Secrets(cephCSISecretNamespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to delete secret %s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// copySecretWithPassphrase copies a secret of cephCSISecretNamespace and adds
+// the passphrase to the copy.
+func copySecretWithPassphrase(c kubernetes.Interface, name, copyName string) error {
+	secret, err := c.CoreV1().Secrets(cephCSISecretNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get secret %s: %w", name, err)
+	}
+	data := map[string][]byte{}
+	for k, v := range secret.Data {
+		data[k] = v
+	}
+	data[encryptionPassphraseKey] = []byte(encryptionPassphrase)
+
+	return ensureSecret(io.Discard, c, copyName, data)
+}
+
+// setKMSConfig adds the KMS configuration to the KMS configmap, the configmap
+// is created when it does not exist.
+func setKMSConfig(c kubernetes.Interface, kmsID, config string) error {
+	ctx := context.TODO()
+	cm, err := c.CoreV1().ConfigMaps(cephCSINamespace).Get(ctx, kmsConfigMapName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      kmsConfigMapName,
+				Namespace: cephCSINamespace,
+			},
+			Data: map[string]string{kmsID: config},
+		}
+		if _, err := c.CoreV1().ConfigMaps(cephCSINamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create configmap %s: %w", kmsConfigMapName, err)
+		}
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get configmap %s: %w", kmsConfigMapName, err)
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[kmsID] = config
+	if _, err := c.CoreV1().ConfigMaps(cephCSINamespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update configmap %s: %w", kmsConfigMapName, err)
+	}
+
+	return nil
+}
+
+// unsetKMSConfig removes the KMS configuration from the KMS configmap, the
+// configmap is deleted when no other configuration is left in it.
+func unsetKMSConfig(c kubernetes.Interface, kmsID string) error {
+	ctx := context.TODO()
+	cm, err := c.CoreV1().ConfigMaps(cephCSINamespace).Get(ctx, kmsConfigMapName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get configmap %s: %w", kmsConfigMapName, err)
+	}
+	if _, ok := cm.Data[kmsID]; !ok {
+		return nil
+	}
+
+	delete(cm.Data, kmsID)
+	if len(cm.Data) == 0 {
+		err = c.CoreV1().ConfigMaps(cephCSINamespace).Delete(ctx, kmsConfigMapName, metav1.DeleteOptions{})
+	} else {
+		_, err = c.CoreV1().ConfigMaps(cephCSINamespace).Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove %s from configmap %s: %w", kmsID, kmsConfigMapName, err)
+	}
+
+	return nil
+}
+
+// validateRBDImageEncrypted checks that the image starts with a LUKS header,
+// i.e. that ceph-csi formatted the image with dm-crypt before the filesystem
+// was created on it.
+func validateRBDImageEncrypted(backend CephBackend, ref rbdImageRef) error {
+	header, err := backend.ReadImage(ref.pool, ref.image, luksHeaderSize)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ref, err)
+	}
+	if !bytes.HasPrefix(header, luksMagic) {
+		return fmt.Errorf("%s: image has no LUKS header", ref)
+	}
+
+	return nil
+}
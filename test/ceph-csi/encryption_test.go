@@ -0,0 +1,82 @@
+package ceph_csi
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("Encryption", Label("unit"), func() {
+	It("should find the LUKS header of encrypted images", func() {
+		backend := newFakeCephBackend("fake-fsid")
+		backend.addImage("replicapool", rbdImageInfo{Name: "csi-vol-1"})
+		backend.addImage("replicapool", rbdImageInfo{Name: "csi-vol-2"})
+		backend.writeImage("replicapool", "csi-vol-1", luksMagic)
+
+		Expect(validateRBDImageEncrypted(backend, rbdImageRef{pool: "replicapool", image: "csi-vol-1"})).To(Succeed())
+		Expect(validateRBDImageEncrypted(backend, rbdImageRef{pool: "replicapool", image: "csi-vol-2"})).
+			To(MatchError(ContainSubstring("image has no LUKS header")))
+		Expect(validateRBDImageEncrypted(backend, rbdImageRef{pool: "replicapool", image: "csi-vol-3"})).
+			To(MatchError(errCephObjectNotFound))
+	})
+
+	It("should add and remove the secrets-metadata KMS", func() {
+		c := fake.NewSimpleClientset()
+		ctx := context.TODO()
+
+		Expect(createEncryptionKMS(c, secretsMetadataKMS)).To(Succeed())
+		cm, err := c.CoreV1().ConfigMaps(cephCSINamespace).Get(ctx, kmsConfigMapName, metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cm.Data[secretsMetadataKMS.kmsID]).To(ContainSubstring(`"encryptionKMSType":"metadata"`))
+		secret, err := c.CoreV1().Secrets(cephCSISecretNamespace).Get(ctx, encryptionSecretName, metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(secret.Data).To(HaveKey(encryptionPassphraseKey))
+
+		Expect(deleteEncryptionKMS(c, secretsMetadataKMS)).To(Succeed())
+		_, err = c.CoreV1().ConfigMaps(cephCSINamespace).Get(ctx, kmsConfigMapName, metav1.GetOptions{})
+		Expect(apierrs.IsNotFound(err)).To(BeTrue())
+		Expect(deleteEncryptionKMS(c, secretsMetadataKMS)).To(Succeed())
+	})
+
+	It("should keep the other configurations of the KMS configmap", func() {
+		c := fake.NewSimpleClientset(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: kmsConfigMapName, Namespace: cephCSINamespace},
+			Data:       map[string]string{"vault-test": `{"encryptionKMSType":"vault"}`},
+		})
+
+		Expect(createEncryptionKMS(c, secretsMetadataKMS)).To(Succeed())
+		Expect(deleteEncryptionKMS(c, secretsMetadataKMS)).To(Succeed())
+
+		cm, err := c.CoreV1().ConfigMaps(cephCSINamespace).Get(context.TODO(), kmsConfigMapName, metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cm.Data).To(Equal(map[string]string{"vault-test": `{"encryptionKMSType":"vault"}`}))
+	})
+
+	It("should copy the rbd secrets with the passphrase for the kubernetes secret KMS", func() {
+		c := fake.NewSimpleClientset()
+		for _, name := range []string{rbdProvisionerSecretName, rbdNodePluginSecretName} {
+			Expect(ensureSecret(GinkgoWriter, c, name, map[string][]byte{"userID": []byte(name)})).To(Succeed())
+		}
+
+		Expect(createEncryptionKMS(c, kubernetesSecretKMS)).To(Succeed())
+		secret, err := c.CoreV1().Secrets(cephCSISecretNamespace).Get(context.TODO(),
+			rbdEncryptedNodePluginSecretName(), metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(secret.Data).To(Equal(map[string][]byte{
+			"userID":                []byte(rbdNodePluginSecretName),
+			encryptionPassphraseKey: []byte(encryptionPassphrase),
+		}))
+		Expect(kubernetesSecretKMS.storageClassParameters()).To(
+			HaveKeyWithValue("csi.storage.k8s.io/node-stage-secret-name", rbdEncryptedNodePluginSecretName()))
+
+		Expect(deleteEncryptionKMS(c, kubernetesSecretKMS)).To(Succeed())
+		_, err = c.CoreV1().Secrets(cephCSISecretNamespace).Get(context.TODO(),
+			rbdEncryptedNodePluginSecretName(), metav1.GetOptions{})
+		Expect(apierrs.IsNotFound(err)).To(BeTrue())
+	})
+})
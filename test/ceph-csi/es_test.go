@@ -17,9 +17,7 @@ import (
 )
 
 func installEs(crdsPath, operatorPath, esPath string, f *framework.Framework) {
-	if err := exec.
-		Command("kubectl", "create", "-f", crdsPath, "-f", operatorPath).
-		Run(); err != nil {
+	if err := runKubectlWithManifests(kubectlCreate, "", crdsPath, operatorPath); err != nil {
 		framework.Failf("create es crds and operator error %v", err)
 	}
 
@@ -42,9 +40,7 @@ func installEs(crdsPath, operatorPath, esPath string, f *framework.Framework) {
 		framework.Failf("es operator pod is not running %v", err)
 	}
 
-	if err := exec.
-		Command("kubectl", "create", "-f", esPath, "-n", f.UniqueName).
-		Run(); err != nil {
+	if err := runKubectlWithManifests(kubectlCreate, f.UniqueName, esPath); err != nil {
 		framework.Failf("create ElasticSearch error %v", err)
 	}
 
@@ -73,9 +69,7 @@ func installEs(crdsPath, operatorPath, esPath string, f *framework.Framework) {
 }
 
 func uninstallEs(crdsPath, operatorPath, esPath string, f *framework.Framework) {
-	if err := exec.
-		Command("kubectl", "delete", "-f", esPath, "-n", f.UniqueName).
-		Run(); err != nil {
+	if err := runKubectlWithManifests(kubectlDelete, f.UniqueName, esPath); err != nil {
 		framework.Logf("delete ElasticSearch error %v", err)
 	}
 
@@ -97,9 +91,7 @@ func uninstallEs(crdsPath, operatorPath, esPath string, f *framework.Framework)
 		framework.Logf("delete ElasticSearch pods error %v", err)
 	}
 
-	if err := exec.
-		Command("kubectl", "delete", "-f", operatorPath, "-f", crdsPath).
-		Run(); err != nil {
+	if err := runKubectlWithManifests(kubectlDelete, "", operatorPath, crdsPath); err != nil {
 		framework.Logf("delete es crds and operator error %v", err)
 	}
 
@@ -135,7 +127,7 @@ var _ = Describe("ElasticSearch", func() {
 				"manifest/eck/operator.yaml",
 				"manifest/eck/elasticsearch.yaml", f)
 		})
-		It("should be able to run ElasticSearch using ceph rbd plugin", Label("es"), func() {
+		It("should be able to run ElasticSearch using ceph rbd plugin", Label("es", "rwo", "file"), func() {
 			secret, err := f.ClientSet.CoreV1().Secrets(f.UniqueName).Get(context.Background(), "elasticsearch-sample-es-elastic-user", metav1.GetOptions{})
 			if err != nil {
 				framework.Failf("get elasticsearch-sample-es-elastic-user secret error %v", err)
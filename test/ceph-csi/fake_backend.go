@@ -0,0 +1,427 @@
+package ceph_csi
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// fakeCephBackend is an in-memory CephBackend. It lets the validation helpers
+// run without a ceph cluster, the add* and remove* methods are used to
+// arrange the state of the fake cluster.
+type fakeCephBackend struct {
+	mu sync.Mutex
+
+	fsID string
+	df   cephDF
+
+	// images is keyed by pool, then by image name.
+	images map[string]map[string]*rbdImageInfo
+	// imageSnaps is keyed by "pool/image".
+	imageSnaps map[string][]rbdSnapInfo
+	// trash is keyed by pool.
+	trash map[string][]rbdTrashInfo
+	// imageData is keyed by "pool/image".
+	imageData map[string][]byte
+
+	// subVolumes is keyed by "fsName/group", then by subvolume name.
+	subVolumes map[string]map[string]*cephfsSubVolumeInfo
+	// subVolumeSnaps is keyed by "fsName/group/subvolume".
+	subVolumeSnaps map[string][]cephfsSnapshot
+
+	filesystems []cephFilesystem
+	// omapKeys is keyed by "pool/namespace/object".
+	omapKeys map[string][]string
+	// auth is keyed by the entity name.
+	auth map[string]*cephAuthEntity
+}
+
+func newFakeCephBackend(fsID string) *fakeCephBackend {
+	return &fakeCephBackend{
+		fsID:           fsID,
+		images:         map[string]map[string]*rbdImageInfo{},
+		imageSnaps:     map[string][]rbdSnapInfo{},
+		trash:          map[string][]rbdTrashInfo{},
+		imageData:      map[string][]byte{},
+		subVolumes:     map[string]map[string]*cephfsSubVolumeInfo{},
+		subVolumeSnaps: map[string][]cephfsSnapshot{},
+		omapKeys:       map[string][]string{},
+		auth:           map[string]*cephAuthEntity{},
+	}
+}
+
+func (fb *fakeCephBackend) addImage(pool string, info rbdImageInfo) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if fb.images[pool] == nil {
+		fb.images[pool] = map[string]*rbdImageInfo{}
+	}
+	fb.images[pool][info.Name] = &info
+}
+
+// removeImage deletes the image from the pool, when toTrash is set the image
+// is moved to the trash of the pool instead.
+func (fb *fakeCephBackend) removeImage(pool, image string, toTrash bool) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	info, ok := fb.images[pool][image]
+	if !ok {
+		return
+	}
+	delete(fb.images[pool], image)
+	delete(fb.imageSnaps, pool+"/"+image)
+	delete(fb.imageData, pool+"/"+image)
+	if toTrash {
+		fb.trash[pool] = append(fb.trash[pool], rbdTrashInfo{ID: info.ID, Name: info.Name})
+	}
+}
+
+// purgeTrash empties the trash of the pool, as the mgr does for the images
+// ceph-csi moves to the trash.
+func (fb *fakeCephBackend) purgeTrash(pool string) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	delete(fb.trash, pool)
+}
+
+func (fb *fakeCephBackend) addImageSnapshot(pool, image string, snap rbdSnapInfo) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	key := pool + "/" + image
+	fb.imageSnaps[key] = append(fb.imageSnaps[key], snap)
+}
+
+// writeImage sets the data at the start of the image, the rest of the image
+// reads as zeros.
+func (fb *fakeCephBackend) writeImage(pool, image string, data []byte) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.imageData[pool+"/"+image] = append([]byte(nil), data...)
+}
+
+func (fb *fakeCephBackend) addSubVolume(fsName, group, subVolume string, info cephfsSubVolumeInfo) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	key := fsName + "/" + group
+	if fb.subVolumes[key] == nil {
+		fb.subVolumes[key] = map[string]*cephfsSubVolumeInfo{}
+	}
+	fb.subVolumes[key][subVolume] = &info
+}
+
+func (fb *fakeCephBackend) removeSubVolume(fsName, group, subVolume string) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	delete(fb.subVolumes[fsName+"/"+group], subVolume)
+	delete(fb.subVolumeSnaps, fsName+"/"+group+"/"+subVolume)
+}
+
+func (fb *fakeCephBackend) addSubVolumeSnapshot(fsName, group, subVolume, snap string) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	key := fsName + "/" + group + "/" + subVolume
+	fb.subVolumeSnaps[key] = append(fb.subVolumeSnaps[key], cephfsSnapshot{Name: snap})
+}
+
+func (fb *fakeCephBackend) addFilesystem(fs cephFilesystem) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.filesystems = append(fb.filesystems, fs)
+}
+
+func (fb *fakeCephBackend) setOmapKeys(pool, namespace, object string, keys ...string) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.omapKeys[pool+"/"+namespace+"/"+object] = keys
+}
+
+func (fb *fakeCephBackend) setDF(df cephDF) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.df = df
+}
+
+func (fb *fakeCephBackend) addAuthEntity(entity cephAuthEntity) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	fb.auth[entity.Entity] = &entity
+}
+
+func (fb *fakeCephBackend) ClusterID() (string, error) {
+	return fb.fsID, nil
+}
+
+func (fb *fakeCephBackend) ListImages(pool string) ([]string, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	images := []string{}
+	for name := range fb.images[pool] {
+		images = append(images, name)
+	}
+	sort.Strings(images)
+
+	return images, nil
+}
+
+func (fb *fakeCephBackend) ImageInfo(pool, image string) (*rbdImageInfo, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	info, ok := fb.images[pool][image]
+	if !ok {
+		return nil, fmt.Errorf("failed to get info of image %s: %w", image, errCephObjectNotFound)
+	}
+	infoCopy := *info
+
+	return &infoCopy, nil
+}
+
+func (fb *fakeCephBackend) ListImageSnapshots(pool, image string) ([]rbdSnapInfo, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if _, ok := fb.images[pool][image]; !ok {
+		return nil, fmt.Errorf("failed to list snapshots of image %s: %w", image, errCephObjectNotFound)
+	}
+
+	return append([]rbdSnapInfo{}, fb.imageSnaps[pool+"/"+image]...), nil
+}
+
+func (fb *fakeCephBackend) ListTrash(pool string) ([]rbdTrashInfo, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	return append([]rbdTrashInfo{}, fb.trash[pool]...), nil
+}
+
+func (fb *fakeCephBackend) ReadImage(pool, image string, length int) ([]byte, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if _, ok := fb.images[pool][image]; !ok {
+		return nil, fmt.Errorf("failed to read image %s: %w", image, errCephObjectNotFound)
+	}
+	data := make([]byte, length)
+	copy(data, fb.imageData[pool+"/"+image])
+
+	return data, nil
+}
+
+func (fb *fakeCephBackend) CreateImage(pool, image string, size int64) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if _, ok := fb.images[pool][image]; ok {
+		return fmt.Errorf("failed to create image %s: already exists", image)
+	}
+	if fb.images[pool] == nil {
+		fb.images[pool] = map[string]*rbdImageInfo{}
+	}
+	id := fmt.Sprintf("%x", len(fb.images[pool])+1)
+	fb.images[pool][image] = &rbdImageInfo{
+		Name:            image,
+		ID:              id,
+		Size:            size >> 20 << 20,
+		Order:           22,
+		ObjectSize:      1 << 22,
+		BlockNamePrefix: "rbd_data." + id,
+		Format:          2,
+		Features:        []string{"layering"},
+	}
+
+	return nil
+}
+
+func (fb *fakeCephBackend) DeleteImage(pool, image string) error {
+	if _, err := fb.ImageInfo(pool, image); err != nil {
+		return fmt.Errorf("failed to delete image %s: %w", image, errCephObjectNotFound)
+	}
+	fb.removeImage(pool, image, false)
+
+	return nil
+}
+
+func (fb *fakeCephBackend) ListSubVolumes(fsName, group string) ([]cephfsSubVolume, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	subVols := []cephfsSubVolume{}
+	for name := range fb.subVolumes[fsName+"/"+group] {
+		subVols = append(subVols, cephfsSubVolume{Name: name})
+	}
+	sort.Slice(subVols, func(i, j int) bool {
+		return subVols[i].Name < subVols[j].Name
+	})
+
+	return subVols, nil
+}
+
+func (fb *fakeCephBackend) SubVolumeInfo(fsName, group, subVolume string) (*cephfsSubVolumeInfo, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	info, ok := fb.subVolumes[fsName+"/"+group][subVolume]
+	if !ok {
+		return nil, fmt.Errorf("failed to get info of subvolume %s: %w", subVolume, errCephObjectNotFound)
+	}
+	infoCopy := *info
+
+	return &infoCopy, nil
+}
+
+func (fb *fakeCephBackend) ListSubVolumeSnapshots(fsName, group, subVolume string) ([]cephfsSnapshot, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if _, ok := fb.subVolumes[fsName+"/"+group][subVolume]; !ok {
+		return nil, fmt.Errorf("failed to list snapshots of subvolume %s: %w", subVolume, errCephObjectNotFound)
+	}
+
+	return append([]cephfsSnapshot{}, fb.subVolumeSnaps[fsName+"/"+group+"/"+subVolume]...), nil
+}
+
+func (fb *fakeCephBackend) CreateSubVolume(fsName, group, subVolume string, size int64) error {
+	if _, err := fb.SubVolumeInfo(fsName, group, subVolume); err == nil {
+		return fmt.Errorf("failed to create subvolume %s: already exists", subVolume)
+	}
+	fb.addSubVolume(fsName, group, subVolume, cephfsSubVolumeInfo{
+		Path:       "/volumes/" + group + "/" + subVolume + "/0a",
+		BytesQuota: cephfsQuota(size),
+		State:      "complete",
+		Type:       "subvolume",
+	})
+
+	return nil
+}
+
+func (fb *fakeCephBackend) DeleteSubVolume(fsName, group, subVolume string) error {
+	if _, err := fb.SubVolumeInfo(fsName, group, subVolume); err != nil {
+		return fmt.Errorf("failed to delete subvolume %s: %w", subVolume, errCephObjectNotFound)
+	}
+	fb.removeSubVolume(fsName, group, subVolume)
+
+	return nil
+}
+
+func (fb *fakeCephBackend) ListFilesystems() ([]cephFilesystem, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	return append([]cephFilesystem{}, fb.filesystems...), nil
+}
+
+func (fb *fakeCephBackend) ListOmapKeys(pool, namespace, object string) ([]string, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	return append([]string{}, fb.omapKeys[pool+"/"+namespace+"/"+object]...), nil
+}
+
+func (fb *fakeCephBackend) RemoveOmapKey(pool, namespace, object, key string) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	objKey := pool + "/" + namespace + "/" + object
+	keys, ok := fb.omapKeys[objKey]
+	if !ok {
+		return fmt.Errorf("failed to remove omap key %s of %s: %w", key, object, errCephObjectNotFound)
+	}
+	remaining := []string{}
+	for _, k := range keys {
+		if k != key {
+			remaining = append(remaining, k)
+		}
+	}
+	fb.omapKeys[objKey] = remaining
+
+	return nil
+}
+
+// RemoveObject removes the omap of the object, the fake has no object data
+// besides the omap.
+func (fb *fakeCephBackend) RemoveObject(pool, namespace, object string) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	objKey := pool + "/" + namespace + "/" + object
+	if _, ok := fb.omapKeys[objKey]; !ok {
+		return fmt.Errorf("failed to remove object %s: %w", object, errCephObjectNotFound)
+	}
+	delete(fb.omapKeys, objKey)
+
+	return nil
+}
+
+func (fb *fakeCephBackend) DF() (*cephDF, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	df := fb.df
+	df.Pools = append([]cephDFPool{}, fb.df.Pools...)
+
+	return &df, nil
+}
+
+func (fb *fakeCephBackend) AuthGet(entity string) (*cephAuthEntity, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	auth, ok := fb.auth[entity]
+	if !ok {
+		return nil, fmt.Errorf("failed to get auth of %s: %w", entity, errCephObjectNotFound)
+	}
+	authCopy := *auth
+	authCopy.Caps = copyCaps(auth.Caps)
+
+	return &authCopy, nil
+}
+
+func (fb *fakeCephBackend) AuthGetOrCreate(entity string, caps map[string]string) (*cephAuthEntity, error) {
+	fb.mu.Lock()
+	if _, ok := fb.auth[entity]; !ok {
+		fb.auth[entity] = &cephAuthEntity{
+			Entity: entity,
+			Key:    base64.StdEncoding.EncodeToString([]byte("key of " + entity)),
+			Caps:   copyCaps(caps),
+		}
+	}
+	fb.mu.Unlock()
+
+	return fb.AuthGet(entity)
+}
+
+func (fb *fakeCephBackend) AuthCaps(entity string, caps map[string]string) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	auth, ok := fb.auth[entity]
+	if !ok {
+		return fmt.Errorf("failed to set caps of %s: %w", entity, errCephObjectNotFound)
+	}
+	auth.Caps = copyCaps(caps)
+
+	return nil
+}
+
+func copyCaps(caps map[string]string) map[string]string {
+	c := make(map[string]string, len(caps))
+	for daemon, cap := range caps {
+		c[daemon] = cap
+	}
+
+	return c
+}
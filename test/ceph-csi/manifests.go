@@ -0,0 +1,171 @@
+package ceph_csi
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+
+	v1 "k8s.io/api/core/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// manifestPrefix is the directory the specs use to refer to manifests, e.g.
+// manifest/rbd/block-rwo-pvc.yaml.
+const manifestPrefix = "manifest/"
+
+// embeddedManifests holds the manifest tree, so the compiled test binary does
+// not depend on the working directory.
+//
+//go:embed manifest
+var embeddedManifests embed.FS
+
+// manifestDir is an optional directory with the same layout as the manifest
+// directory. Files in it take precedence over the embedded ones.
+var manifestDir string
+
+// overlayFS serves files from upper and falls back to lower for the files
+// that upper does not have.
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+
+	return o.lower.Open(name)
+}
+
+// manifestFS returns the file system the manifests are read from, rooted at
+// the manifest directory.
+func manifestFS() fs.FS {
+	embedded, err := fs.Sub(embeddedManifests, strings.TrimSuffix(manifestPrefix, "/"))
+	if err != nil {
+		// the embedded tree always has the manifest directory
+		panic(err)
+	}
+	if manifestDir == "" {
+		return embedded
+	}
+
+	return overlayFS{upper: os.DirFS(manifestDir), lower: embedded}
+}
+
+// readManifest returns the content of a file. Paths below manifest/ are
+// resolved through manifestFS, other paths are read from disk.
+func readManifest(path string) ([]byte, error) {
+	name, ok := strings.CutPrefix(path, manifestPrefix)
+	if !ok {
+		return os.ReadFile(path)
+	}
+
+	return fs.ReadFile(manifestFS(), name)
+}
+
+// manifestParams are rendered into the manifest templates, so one manifest
+// can be used for several variants of a resource. Every manifest defines the
+// defaults for the zero values. The resources of a spec are created in the
+// namespace of the framework, so the manifests do not template it.
+type manifestParams struct {
+	// Name is the name of the resource, ClaimName the PVC a pod, deployment
+	// or snapshot uses and DataSource the PVC or snapshot a PVC is cloned or
+	// restored from.
+	Name         string
+	ClaimName    string
+	DataSource   string
+	StorageClass string
+	Size         string
+	VolumeMode   v1.PersistentVolumeMode
+	Image        string
+	// Replicas is a pointer so an explicit 0 is not replaced by the default
+	// of the manifest, text/template prints the value it points to.
+	Replicas     *int32
+	NodeSelector map[string]string
+}
+
+// manifestFuncs are the functions available in the manifest templates.
+var manifestFuncs = template.FuncMap{
+	"rbdStorageClass":    func() string { return defaultRbdSc },
+	"cephfsStorageClass": func() string { return defaultCephfsSc },
+	"quote":              strconv.Quote,
+}
+
+// renderManifest reads the manifest and executes it as a text/template with
+// the params.
+func renderManifest(path string, params manifestParams) ([]byte, error) {
+	data, err := readManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(path).Funcs(manifestFuncs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %q: %w", path, err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, params); err != nil {
+		return nil, fmt.Errorf("failed to render template %q: %w", path, err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// unmarshalYAML decodes a YAML document into obj.
+func unmarshalYAML(data []byte, obj interface{}) error {
+	data, err := utilyaml.ToJSON(data)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, obj)
+}
+
+// unmarshalManifest renders the manifest with the params and decodes it into
+// obj.
+func unmarshalManifest(path string, params manifestParams, obj interface{}) error {
+	data, err := renderManifest(path, params)
+	if err != nil {
+		return err
+	}
+
+	return unmarshalYAML(data, obj)
+}
+
+// runKubectlWithManifests runs kubectl with the manifests fed through stdin,
+// in the order they are passed.
+func runKubectlWithManifests(action kubectlAction, namespace string, paths ...string) error {
+	var input bytes.Buffer
+	for _, path := range paths {
+		data, err := readManifest(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", path, err)
+		}
+		input.WriteString("---\n")
+		input.Write(data)
+		input.WriteString("\n")
+	}
+
+	args := []string{string(action), "-f", "-"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stdin = &input
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run kubectl %s: %w: %s", strings.Join(args, " "), err, out)
+	}
+
+	return nil
+}
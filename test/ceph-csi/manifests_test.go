@@ -0,0 +1,112 @@
+package ceph_csi
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("Manifests", Label("unit"), func() {
+	BeforeEach(func() {
+		saved := manifestDir
+		DeferCleanup(func() {
+			manifestDir = saved
+		})
+		manifestDir = ""
+	})
+
+	It("should read the embedded manifests", func() {
+		pvc := &v1.PersistentVolumeClaim{}
+		Expect(unmarshal("manifest/rbd/block-rwo-pvc.yaml", pvc)).To(Succeed())
+		Expect(pvc.Spec.StorageClassName).To(HaveValue(Equal(manifestRbdSc)))
+	})
+
+	It("should prefer the files of the override directory", func() {
+		manifestDir = GinkgoT().TempDir()
+		Expect(os.MkdirAll(filepath.Join(manifestDir, "rbd"), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(manifestDir, "rbd", "block-rwo-pvc.yaml"),
+			[]byte("metadata:\n  name: overridden\n"), 0o600)).To(Succeed())
+
+		pvc := &v1.PersistentVolumeClaim{}
+		Expect(unmarshal("manifest/rbd/block-rwo-pvc.yaml", pvc)).To(Succeed())
+		Expect(pvc.Name).To(Equal("overridden"))
+
+		pvc = &v1.PersistentVolumeClaim{}
+		Expect(unmarshal("manifest/rbd/file-rwo-pvc.yaml", pvc)).To(Succeed())
+		Expect(pvc.Name).NotTo(BeEmpty())
+	})
+
+	It("should fail for unknown manifests", func() {
+		_, err := readManifest("manifest/rbd/missing.yaml")
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should render the defaults of the templates", func() {
+		deploy := &appsv1.Deployment{}
+		Expect(unmarshal("manifest/rbd/block-deploy.yaml", deploy)).To(Succeed())
+		Expect(deploy.Name).To(Equal("nginx-deployment-block"))
+		Expect(deploy.Spec.Replicas).To(HaveValue(BeEquivalentTo(2)))
+		Expect(deploy.Spec.Template.Spec.NodeSelector).To(BeEmpty())
+		Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.14.2"))
+		claim := deploy.Spec.Template.Spec.Volumes[0].Ephemeral.VolumeClaimTemplate.Spec
+		Expect(claim.VolumeMode).To(HaveValue(Equal(v1.PersistentVolumeBlock)))
+		Expect(claim.Resources.Requests.Storage().String()).To(Equal("1Gi"))
+	})
+
+	It("should render the params into the templates", func() {
+		replicas := int32(3)
+		params := manifestParams{
+			StorageClass: "fast-rbd",
+			Size:         "5Gi",
+			VolumeMode:   v1.PersistentVolumeFilesystem,
+			Image:        "registry.example.com/nginx:1.25",
+			Replicas:     &replicas,
+			NodeSelector: map[string]string{"topology.kubernetes.io/zone": "zone-a"},
+		}
+
+		sts := &appsv1.StatefulSet{}
+		Expect(unmarshalManifest("manifest/rbd/block-statefulset.yaml", params, sts)).To(Succeed())
+		Expect(sts.Spec.Replicas).To(HaveValue(BeEquivalentTo(3)))
+		Expect(sts.Spec.Template.Spec.NodeSelector).To(Equal(params.NodeSelector))
+		Expect(sts.Spec.Template.Spec.Containers[0].Image).To(Equal(params.Image))
+		claim := sts.Spec.VolumeClaimTemplates[0].Spec
+		Expect(claim.StorageClassName).To(HaveValue(Equal("fast-rbd")))
+		Expect(claim.VolumeMode).To(HaveValue(Equal(v1.PersistentVolumeFilesystem)))
+		Expect(claim.Resources.Requests.Storage().String()).To(Equal("5Gi"))
+
+		pod, err := loadAppWithParams("manifest/cephfs/rwx-pod.yaml", params)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(pod.Spec.NodeSelector).To(Equal(params.NodeSelector))
+	})
+
+	It("should keep an explicit zero of the params", func() {
+		replicas := int32(0)
+		deploy := &appsv1.Deployment{}
+		Expect(unmarshalManifest("manifest/rbd/block-deploy.yaml", manifestParams{Replicas: &replicas}, deploy)).
+			To(Succeed())
+		Expect(deploy.Spec.Replicas).To(HaveValue(BeEquivalentTo(0)))
+	})
+
+	It("should render the names of the resources and the ones they refer to", func() {
+		params := manifestParams{Name: "clone-2", ClaimName: "claim-2", DataSource: "source-2"}
+
+		pvc := &v1.PersistentVolumeClaim{}
+		Expect(unmarshalManifest("manifest/cephfs/pvc-clone.yaml", params, pvc)).To(Succeed())
+		Expect(pvc.Name).To(Equal("clone-2"))
+		Expect(pvc.Spec.DataSource.Name).To(Equal("source-2"))
+
+		pod, err := loadAppWithParams("manifest/rbd/block-rwo-pod.yaml", params)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(pod.Name).To(Equal("clone-2"))
+		Expect(pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("claim-2"))
+
+		deploy := &appsv1.Deployment{}
+		Expect(unmarshalManifest("manifest/cephfs/deployment.yaml", params, deploy)).To(Succeed())
+		Expect(deploy.Name).To(Equal("clone-2"))
+		Expect(deploy.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("claim-2"))
+	})
+})
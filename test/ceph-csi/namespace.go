@@ -3,8 +3,6 @@ package ceph_csi
 import (
 	"context"
 	"fmt"
-	"os"
-	"strings"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
@@ -71,12 +69,3 @@ func deleteNamespace(c kubernetes.Interface, name string) error {
 		return false, nil
 	})
 }
-
-func replaceNamespaceInTemplate(filePath string) (string, error) {
-	read, err := os.ReadFile(filePath)
-	if err != nil {
-		return "", err
-	}
-
-	return strings.ReplaceAll(string(read), "namespace: default", fmt.Sprintf("namespace: %s", cephCSINamespace)), nil
-}
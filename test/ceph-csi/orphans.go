@@ -0,0 +1,415 @@
+package ceph_csi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+const (
+	// csiVolumesDirectory and csiSnapsDirectory are the rados objects in which
+	// ceph-csi keeps the omap entries that map request names to volumes and
+	// snapshots.
+	csiVolumesDirectory = "csi.volumes.default"
+	csiSnapsDirectory   = "csi.snaps.default"
+	csiVolumeOmapPrefix = "csi.volume."
+	csiSnapOmapPrefix   = "csi.snap."
+
+	// cephfsRadosNamespace is the rados namespace in the metadata pool where
+	// ceph-csi keeps the omap entries of cephfs volumes.
+	cephfsRadosNamespace = "csi"
+
+	// rbdTrashKind is the kind of the orphans in the rbd trash. ceph-csi
+	// moves deleted images to the trash and has the mgr purge them
+	// asynchronously, so they are only orphans once trashPurgeTimeout passed.
+	rbdTrashKind      = "rbd trash image"
+	trashPurgeTimeout = 3 * time.Minute
+)
+
+// detectOrphans enables the orphan detection after the suite.
+var detectOrphans bool
+
+func isRBDDriver(driver string) bool {
+	return isDriverOfType(driver, rbdDriverSuffix)
+}
+
+func isCephFSDriver(driver string) bool {
+	return isDriverOfType(driver, cephfsDriverSuffix)
+}
+
+// cephOrphan is a ceph object created by ceph-csi that no PersistentVolume or
+// VolumeSnapshotContent refers to anymore.
+type cephOrphan struct {
+	kind     string
+	location string
+	name     string
+}
+
+func (o cephOrphan) String() string {
+	return fmt.Sprintf("%s %s/%s", o.kind, o.location, o.name)
+}
+
+// liveCSIObjects holds the names of the ceph objects that kubernetes still
+// refers to.
+type liveCSIObjects struct {
+	// pvNames and snapContentNames are the request names of the omap
+	// entries.
+	pvNames          map[string]bool
+	snapContentNames map[string]bool
+	// rbdImages is keyed by "pool/image".
+	rbdImages map[string]bool
+	// subVolumes is keyed by "fsName/group/subvolume".
+	subVolumes map[string]bool
+	// snapshots holds the names of the snapshot images and subvolume
+	// snapshots.
+	snapshots map[string]bool
+}
+
+func newLiveCSIObjects() *liveCSIObjects {
+	return &liveCSIObjects{
+		pvNames:          map[string]bool{},
+		snapContentNames: map[string]bool{},
+		rbdImages:        map[string]bool{},
+		subVolumes:       map[string]bool{},
+		snapshots:        map[string]bool{},
+	}
+}
+
+// getLiveCSIObjects collects the ceph objects referenced by the
+// PersistentVolumes and VolumeSnapshotContents of the ceph-csi drivers.
+func getLiveCSIObjects(c kubernetes.Interface) (*liveCSIObjects, error) {
+	live := newLiveCSIObjects()
+
+	pvList, err := c.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pv: %w", err)
+	}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Spec.CSI == nil {
+			continue
+		}
+		switch {
+		case isRBDDriver(pv.Spec.CSI.Driver):
+			ref, err := getRBDImageRef(pv)
+			if err != nil {
+				framework.Logf("skipping PV %s: %v", pv.Name, err)
+
+				continue
+			}
+			live.rbdImages[ref.pool+"/"+ref.image] = true
+		case isCephFSDriver(pv.Spec.CSI.Driver):
+			ref, err := getCephFSSubVolumeRef(pv)
+			if err != nil {
+				framework.Logf("skipping PV %s: %v", pv.Name, err)
+
+				continue
+			}
+			live.subVolumes[ref.fsName+"/"+ref.group+"/"+ref.subVolume] = true
+		default:
+			continue
+		}
+		live.pvNames[pv.Name] = true
+	}
+
+	sclient, err := newSnapshotClient()
+	if err != nil {
+		return nil, err
+	}
+	vscList, err := sclient.VolumeSnapshotContents().List(context.TODO(), metav1.ListOptions{})
+	if apierrs.IsNotFound(err) {
+		// the snapshot CRDs are not installed
+		return live, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumesnapshotcontents: %w", err)
+	}
+	for i := range vscList.Items {
+		vsc := &vscList.Items[i]
+		if !isRBDDriver(vsc.Spec.Driver) && !isCephFSDriver(vsc.Spec.Driver) {
+			continue
+		}
+		live.snapContentNames[vsc.Name] = true
+		if vsc.Status == nil || vsc.Status.SnapshotHandle == nil {
+			continue
+		}
+		uuid, err := uuidFromHandle(*vsc.Status.SnapshotHandle)
+		if err != nil {
+			framework.Logf("skipping VolumeSnapshotContent %s: %v", vsc.Name, err)
+
+			continue
+		}
+		live.snapshots[defaultSnapshotNamePrefix+uuid] = true
+	}
+
+	return live, nil
+}
+
+// findRBDOrphans returns the csi images in the pool and its trash that are not
+// referenced by kubernetes. Images in the trash are only accepted while a live
+// image is cloned from them.
+func findRBDOrphans(backend CephBackend, live *liveCSIObjects, pool string) ([]cephOrphan, error) {
+	var orphans []cephOrphan
+
+	images, err := backend.ListImages(pool)
+	if err != nil {
+		return nil, err
+	}
+	parents := map[string]bool{}
+	for _, image := range images {
+		// the -temp images are the intermediate clones of a volume
+		name := strings.TrimSuffix(image, "-temp")
+		switch {
+		case strings.HasPrefix(name, defaultVolumeNamePrefix) && !live.rbdImages[pool+"/"+name]:
+			orphans = append(orphans, cephOrphan{kind: "rbd image", location: pool, name: image})
+
+			continue
+		case strings.HasPrefix(name, defaultSnapshotNamePrefix) && !live.snapshots[name]:
+			orphans = append(orphans, cephOrphan{kind: "rbd snapshot image", location: pool, name: image})
+
+			continue
+		}
+
+		info, err := backend.ImageInfo(pool, image)
+		if err != nil {
+			return nil, err
+		}
+		if info.Parent != nil {
+			parents[info.Parent.Pool+"/"+info.Parent.Image] = true
+		}
+	}
+
+	trash, err := backend.ListTrash(pool)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range trash {
+		if !strings.HasPrefix(t.Name, "csi-") || parents[pool+"/"+t.Name] {
+			continue
+		}
+		orphans = append(orphans, cephOrphan{kind: rbdTrashKind, location: pool, name: t.Name})
+	}
+
+	return orphans, nil
+}
+
+// findCephFSOrphans returns the csi subvolumes and subvolume snapshots of the
+// subvolumegroup that are not referenced by kubernetes.
+func findCephFSOrphans(backend CephBackend, live *liveCSIObjects, fsName, group string) ([]cephOrphan, error) {
+	var orphans []cephOrphan
+
+	subVols, err := backend.ListSubVolumes(fsName, group)
+	if err != nil {
+		return nil, err
+	}
+	location := fsName + "/" + group
+	for _, sv := range subVols {
+		if !strings.HasPrefix(sv.Name, defaultVolumeNamePrefix) {
+			continue
+		}
+
+		snaps, err := backend.ListSubVolumeSnapshots(fsName, group, sv.Name)
+		if err != nil {
+			return nil, err
+		}
+		liveSnaps := 0
+		for _, snap := range snaps {
+			if !strings.HasPrefix(snap.Name, defaultSnapshotNamePrefix) {
+				continue
+			}
+			if live.snapshots[snap.Name] {
+				liveSnaps++
+
+				continue
+			}
+			orphans = append(orphans, cephOrphan{
+				kind:     "cephfs subvolume snapshot",
+				location: location + "/" + sv.Name,
+				name:     snap.Name,
+			})
+		}
+
+		// a deleted subvolume is retained as long as it has snapshots
+		if !live.subVolumes[location+"/"+sv.Name] && liveSnaps == 0 {
+			orphans = append(orphans, cephOrphan{kind: "cephfs subvolume", location: location, name: sv.Name})
+		}
+	}
+
+	return orphans, nil
+}
+
+// findOmapOrphans returns the csi omap entries in the pool and namespace that
+// refer to request names kubernetes does not know about.
+func findOmapOrphans(backend CephBackend, live *liveCSIObjects, pool, namespace string) ([]cephOrphan, error) {
+	var orphans []cephOrphan
+
+	location := pool
+	if namespace != "" {
+		location = pool + "/" + namespace
+	}
+
+	keys, err := backend.ListOmapKeys(pool, namespace, csiVolumesDirectory)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, csiVolumeOmapPrefix)
+		if name != key && !live.pvNames[name] {
+			orphans = append(orphans, cephOrphan{kind: "omap " + csiVolumesDirectory, location: location, name: key})
+		}
+	}
+
+	keys, err = backend.ListOmapKeys(pool, namespace, csiSnapsDirectory)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, csiSnapOmapPrefix)
+		if name != key && !live.snapContentNames[name] {
+			orphans = append(orphans, cephOrphan{kind: "omap " + csiSnapsDirectory, location: location, name: key})
+		}
+	}
+
+	return orphans, nil
+}
+
+// orphanRBDPools returns the rbd pools the storage classes of the suite
+// provision volumes in: the rbd pool and the pools of the topology specs.
+func orphanRBDPools() ([]string, error) {
+	pools := []string{defaultRbdPool}
+	topology, err := parseTopologyPools(rbdTopologyPools)
+	if err != nil {
+		return nil, err
+	}
+	for _, tp := range topology {
+		if !contains(pools, tp.pool) {
+			pools = append(pools, tp.pool)
+		}
+	}
+
+	return pools, nil
+}
+
+// findCephOrphans diffs the rbd images, rbd trash and csi omap entries of the
+// rbd pools, and the cephfs subvolumes, subvolume snapshots and csi omap
+// entries of the default filesystem against the live kubernetes objects.
+func findCephOrphans(backend CephBackend, live *liveCSIObjects, rbdPools []string) ([]cephOrphan, error) {
+	var orphans []cephOrphan
+
+	for _, pool := range rbdPools {
+		rbdOrphans, err := findRBDOrphans(backend, live, pool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check rbd pool %s: %w", pool, err)
+		}
+		orphans = append(orphans, rbdOrphans...)
+
+		omapOrphans, err := findOmapOrphans(backend, live, pool, radosNamespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check omap of pool %s: %w", pool, err)
+		}
+		orphans = append(orphans, omapOrphans...)
+	}
+
+	cephfsOrphans, err := findCephFSOrphans(backend, live, defaultFileSystemName, defaultSubvolumegroup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check filesystem %s: %w", defaultFileSystemName, err)
+	}
+	orphans = append(orphans, cephfsOrphans...)
+
+	filesystems, err := backend.ListFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	for _, fs := range filesystems {
+		if fs.Name != defaultFileSystemName {
+			continue
+		}
+		omapOrphans, err := findOmapOrphans(backend, live, fs.MetadataPool, cephfsRadosNamespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check omap of pool %s: %w", fs.MetadataPool, err)
+		}
+		orphans = append(orphans, omapOrphans...)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].String() < orphans[j].String()
+	})
+
+	return orphans, nil
+}
+
+// waitForCephOrphans runs findCephOrphans until the rbd trash holds no orphans
+// anymore, as the trash of the volumes deleted at the end of the specs is
+// still being purged. The live objects are read again on every run, so the
+// PVs and VolumeSnapshotContents deleted or created while waiting are taken
+// into account. The orphans of the last run are returned when the timeout
+// passes.
+func waitForCephOrphans(
+	ctx context.Context,
+	backend CephBackend,
+	getLive func() (*liveCSIObjects, error),
+	rbdPools []string,
+	interval, timeout time.Duration,
+) ([]cephOrphan, error) {
+	var orphans []cephOrphan
+	err := wait.PollUntilContextTimeout(ctx, interval, timeout, true, func(_ context.Context) (bool, error) {
+		live, err := getLive()
+		if err != nil {
+			return false, err
+		}
+		orphans, err = findCephOrphans(backend, live, rbdPools)
+		if err != nil {
+			return false, err
+		}
+		for _, o := range orphans {
+			if o.kind == rbdTrashKind {
+				framework.Logf("waiting for the purge of %s", o)
+
+				return false, nil
+			}
+		}
+
+		return true, nil
+	})
+	if err != nil && !wait.Interrupted(err) {
+		return nil, err
+	}
+
+	return orphans, nil
+}
+
+// validateNoCephOrphans fails when the ceph cluster holds csi objects that no
+// kubernetes object refers to.
+func validateNoCephOrphans(f *framework.Framework) error {
+	pools, err := orphanRBDPools()
+	if err != nil {
+		return err
+	}
+	getLive := func() (*liveCSIObjects, error) {
+		return getLiveCSIObjects(f.ClientSet)
+	}
+	orphans, err := waitForCephOrphans(context.TODO(), getCephBackend(f), getLive, pools, poll, trashPurgeTimeout)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		framework.Logf("no orphaned ceph objects found")
+
+		return nil
+	}
+
+	lines := make([]string, 0, len(orphans))
+	for _, o := range orphans {
+		lines = append(lines, o.String())
+	}
+
+	return fmt.Errorf("found %d orphaned ceph objects:\n%s", len(orphans), strings.Join(lines, "\n"))
+}
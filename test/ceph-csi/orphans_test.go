@@ -0,0 +1,221 @@
+package ceph_csi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// The fixtures of the unit specs that run the validation helpers against the
+// fake ceph backend.
+const (
+	fakeFSID     = "fake-fsid"
+	fakeMetaPool = "myfs-metadata"
+
+	// fakeVolumeUUID is the uuid of a ceph-csi volume and fakeVolume its
+	// image and subvolume.
+	fakeVolumeUUID = "b0285c97-a0ce-11eb-8c66-0242ac110002"
+	fakeVolume     = defaultVolumeNamePrefix + fakeVolumeUUID
+)
+
+// newFakeCephCluster returns a fake backend with the default filesystem, its
+// metadata pool is fakeMetaPool.
+func newFakeCephCluster() *fakeCephBackend {
+	backend := newFakeCephBackend(fakeFSID)
+	backend.addFilesystem(cephFilesystem{Name: defaultFileSystemName, MetadataPool: fakeMetaPool})
+
+	return backend
+}
+
+// failingListBackend fails the listing of the rbd trash or the filesystems
+// with the error set for it.
+type failingListBackend struct {
+	*fakeCephBackend
+	listTrashErr       error
+	listFilesystemsErr error
+}
+
+func (b *failingListBackend) ListTrash(pool string) ([]rbdTrashInfo, error) {
+	if b.listTrashErr != nil {
+		return nil, b.listTrashErr
+	}
+
+	return b.fakeCephBackend.ListTrash(pool)
+}
+
+func (b *failingListBackend) ListFilesystems() ([]cephFilesystem, error) {
+	if b.listFilesystemsErr != nil {
+		return nil, b.listFilesystemsErr
+	}
+
+	return b.fakeCephBackend.ListFilesystems()
+}
+
+var _ = Describe("Orphan detection", Label("unit"), func() {
+	const (
+		liveVol   = fakeVolume
+		orphanVol = "csi-vol-c1396d08-a0ce-11eb-8c66-0242ac110002"
+		liveSnap  = "csi-snap-d24a7e19-a0ce-11eb-8c66-0242ac110002"
+	)
+
+	var (
+		backend *fakeCephBackend
+		live    *liveCSIObjects
+	)
+	getLive := func() (*liveCSIObjects, error) {
+		return live, nil
+	}
+
+	BeforeEach(func() {
+		backend = newFakeCephCluster()
+		live = newLiveCSIObjects()
+	})
+
+	It("should not report objects that kubernetes refers to", func() {
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: liveVol})
+		backend.addSubVolume(defaultFileSystemName, defaultSubvolumegroup, liveVol, cephfsSubVolumeInfo{})
+		backend.addSubVolumeSnapshot(defaultFileSystemName, defaultSubvolumegroup, liveVol, liveSnap)
+		backend.setOmapKeys(defaultRbdPool, radosNamespace, csiVolumesDirectory, csiVolumeOmapPrefix+"pvc-1")
+		backend.setOmapKeys(fakeMetaPool, cephfsRadosNamespace, csiSnapsDirectory, csiSnapOmapPrefix+"snapcontent-1")
+
+		live.rbdImages[defaultRbdPool+"/"+liveVol] = true
+		live.subVolumes[defaultFileSystemName+"/"+defaultSubvolumegroup+"/"+liveVol] = true
+		live.snapshots[liveSnap] = true
+		live.pvNames["pvc-1"] = true
+		live.snapContentNames["snapcontent-1"] = true
+
+		Expect(findCephOrphans(backend, live, []string{defaultRbdPool})).To(BeEmpty())
+	})
+
+	It("should report images, trash, subvolumes and omap entries without owner", func() {
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: orphanVol, ID: "12ab"})
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: "csi-vol-e35b8f2a-a0ce-11eb-8c66-0242ac110002", ID: "34cd"})
+		backend.removeImage(defaultRbdPool, "csi-vol-e35b8f2a-a0ce-11eb-8c66-0242ac110002", true)
+		backend.addSubVolume(defaultFileSystemName, defaultSubvolumegroup, orphanVol, cephfsSubVolumeInfo{})
+		backend.setOmapKeys(defaultRbdPool, radosNamespace, csiVolumesDirectory, csiVolumeOmapPrefix+"pvc-gone")
+
+		orphans, err := findCephOrphans(backend, live, []string{defaultRbdPool})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(orphans).To(ConsistOf(
+			cephOrphan{kind: "rbd image", location: defaultRbdPool, name: orphanVol},
+			cephOrphan{kind: "rbd trash image", location: defaultRbdPool, name: "csi-vol-e35b8f2a-a0ce-11eb-8c66-0242ac110002"},
+			cephOrphan{kind: "cephfs subvolume", location: defaultFileSystemName + "/" + defaultSubvolumegroup, name: orphanVol},
+			cephOrphan{kind: "omap " + csiVolumesDirectory, location: defaultRbdPool, name: csiVolumeOmapPrefix + "pvc-gone"},
+		))
+	})
+
+	It("should accept trashed parents of live clones and retained subvolumes", func() {
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: liveSnap, ID: "12ab"})
+		backend.removeImage(defaultRbdPool, liveSnap, true)
+		backend.addImage(defaultRbdPool, rbdImageInfo{
+			Name:   liveVol,
+			Parent: &rbdImageParent{Pool: defaultRbdPool, Image: liveSnap},
+		})
+		backend.addSubVolume(defaultFileSystemName, defaultSubvolumegroup, orphanVol, cephfsSubVolumeInfo{State: subVolumeSnapshotRetained})
+		backend.addSubVolumeSnapshot(defaultFileSystemName, defaultSubvolumegroup, orphanVol, liveSnap)
+
+		live.rbdImages[defaultRbdPool+"/"+liveVol] = true
+		live.snapshots[liveSnap] = true
+
+		Expect(findCephOrphans(backend, live, []string{defaultRbdPool})).To(BeEmpty())
+	})
+
+	It("should check every rbd pool", func() {
+		backend.addImage("zone-a-pool", rbdImageInfo{Name: orphanVol})
+		backend.setOmapKeys("zone-a-pool", radosNamespace, csiVolumesDirectory, csiVolumeOmapPrefix+"pvc-gone")
+
+		Expect(findCephOrphans(backend, live, []string{defaultRbdPool})).To(BeEmpty())
+		Expect(findCephOrphans(backend, live, []string{defaultRbdPool, "zone-a-pool"})).To(ConsistOf(
+			cephOrphan{kind: "rbd image", location: "zone-a-pool", name: orphanVol},
+			cephOrphan{kind: "omap " + csiVolumesDirectory, location: "zone-a-pool", name: csiVolumeOmapPrefix + "pvc-gone"},
+		))
+	})
+
+	It("should add the topology pools to the rbd pool", func() {
+		DeferCleanup(func(value string) { rbdTopologyPools = value }, rbdTopologyPools)
+
+		rbdTopologyPools = "zone-b=pool-b,zone-a=pool-a,zone-c=" + defaultRbdPool
+		Expect(orphanRBDPools()).To(Equal([]string{defaultRbdPool, "pool-a", "pool-b"}))
+
+		rbdTopologyPools = "zone-a"
+		_, err := orphanRBDPools()
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should wait for the purge of the trash", func() {
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: orphanVol, ID: "12ab"})
+		backend.removeImage(defaultRbdPool, orphanVol, true)
+		purge := time.AfterFunc(50*time.Millisecond, func() { backend.purgeTrash(defaultRbdPool) })
+		DeferCleanup(purge.Stop)
+
+		orphans, err := waitForCephOrphans(context.TODO(), backend, getLive, []string{defaultRbdPool},
+			10*time.Millisecond, 5*time.Second)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(orphans).To(BeEmpty())
+	})
+
+	It("should report the trash that is not purged in time", func() {
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: orphanVol, ID: "12ab"})
+		backend.removeImage(defaultRbdPool, orphanVol, true)
+
+		orphans, err := waitForCephOrphans(context.TODO(), backend, getLive, []string{defaultRbdPool},
+			10*time.Millisecond, 50*time.Millisecond)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(orphans).To(ConsistOf(cephOrphan{kind: rbdTrashKind, location: defaultRbdPool, name: orphanVol}))
+	})
+
+	It("should read the live objects again while waiting", func() {
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: liveVol})
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: orphanVol, ID: "12ab"})
+		backend.removeImage(defaultRbdPool, orphanVol, true)
+		purge := time.AfterFunc(50*time.Millisecond, func() { backend.purgeTrash(defaultRbdPool) })
+		DeferCleanup(purge.Stop)
+		// the PV of liveVol is deleted after the first run, its image is
+		// an orphan once the trash is purged
+		reads := 0
+		getLive := func() (*liveCSIObjects, error) {
+			reads++
+			current := newLiveCSIObjects()
+			if reads == 1 {
+				current.rbdImages[defaultRbdPool+"/"+liveVol] = true
+			}
+
+			return current, nil
+		}
+
+		orphans, err := waitForCephOrphans(context.TODO(), backend, getLive, []string{defaultRbdPool},
+			10*time.Millisecond, 5*time.Second)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reads).To(BeNumerically(">", 1))
+		Expect(orphans).To(ConsistOf(cephOrphan{kind: "rbd image", location: defaultRbdPool, name: liveVol}))
+	})
+
+	It("should fail when the live objects can not be read", func() {
+		getLive := func() (*liveCSIObjects, error) {
+			return nil, errors.New("failed to list pv: connection refused")
+		}
+
+		_, err := waitForCephOrphans(context.TODO(), backend, getLive, []string{defaultRbdPool},
+			10*time.Millisecond, time.Minute)
+		Expect(err).To(MatchError(ContainSubstring("connection refused")))
+	})
+
+	It("should not wait when the cluster can not be checked", func() {
+		failing := &failingListBackend{fakeCephBackend: backend, listTrashErr: errors.New("connection timed out")}
+
+		_, err := waitForCephOrphans(context.TODO(), failing, getLive, []string{defaultRbdPool},
+			10*time.Millisecond, time.Minute)
+		Expect(err).To(MatchError(ContainSubstring("connection timed out")))
+		Expect(err.Error()).To(ContainSubstring("failed to check rbd pool " + defaultRbdPool))
+	})
+
+	It("should fail when the filesystems can not be listed", func() {
+		failing := &failingListBackend{fakeCephBackend: backend, listFilesystemsErr: errors.New("connection timed out")}
+
+		_, err := findCephOrphans(failing, live, []string{defaultRbdPool})
+		Expect(err).To(MatchError(ContainSubstring("connection timed out")))
+	})
+})
@@ -18,15 +18,18 @@ import (
 )
 
 func createPod(path string, timeout int, f *framework.Framework) (*v1.Pod, error) {
-	app := &v1.Pod{}
-	if err := unmarshal(path, app); err != nil {
+	return createPodWithParams(path, manifestParams{}, timeout, f)
+}
+
+// createPodWithParams renders the pod manifest with the params, e.g. another
+// image or node selector, and creates it.
+func createPodWithParams(path string, params manifestParams, timeout int, f *framework.Framework) (*v1.Pod, error) {
+	app, err := loadAppWithParams(path, params)
+	if err != nil {
 		return nil, err
 	}
-	for i := range app.Spec.Containers {
-		app.Spec.Containers[i].ImagePullPolicy = v1.PullIfNotPresent
-	}
 
-	app, err := f.ClientSet.CoreV1().Pods(f.UniqueName).Create(context.TODO(), app, metav1.CreateOptions{})
+	app, err = f.ClientSet.CoreV1().Pods(f.UniqueName).Create(context.TODO(), app, metav1.CreateOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create app: %w", err)
 	}
@@ -80,14 +83,17 @@ func waitForDaemonSets(name, ns string, c kubernetes.Interface, t int) error {
 		}
 		dNum := ds.Status.DesiredNumberScheduled
 		ready := ds.Status.NumberReady
+		updated := ds.Status.UpdatedNumberScheduled
 		framework.Logf(
-			"%d / %d pods ready in namespace '%s' in daemonset '%s' (%d seconds elapsed)",
+			"%d / %d pods ready, %d updated in namespace '%s' in daemonset '%s' (%d seconds elapsed)",
 			ready,
 			dNum,
+			updated,
 			ns,
 			ds.ObjectMeta.Name,
 			int(time.Since(start).Seconds()))
-		if ready != dNum {
+		// a changed pod template is rolled out once all pods are updated
+		if ds.Status.ObservedGeneration < ds.Generation || updated != dNum || ready != dNum {
 			return false, nil
 		}
 
@@ -317,8 +323,12 @@ func execCommandInPodAndAllowFail(f *framework.Framework, c, ns string, opt *met
 }
 
 func loadApp(path string) (*v1.Pod, error) {
+	return loadAppWithParams(path, manifestParams{})
+}
+
+func loadAppWithParams(path string, params manifestParams) (*v1.Pod, error) {
 	app := v1.Pod{}
-	if err := unmarshal(path, &app); err != nil {
+	if err := unmarshalManifest(path, params, &app); err != nil {
 		return nil, err
 	}
 	for i := range app.Spec.Containers {
@@ -346,6 +356,28 @@ func createAppErr(c kubernetes.Interface, app *v1.Pod, timeout int, errString st
 	return waitForPodInRunningState(app.Name, app.Namespace, c, timeout, errString)
 }
 
+// validateRWOPConflict creates a second pod from the manifest of a running pod
+// that uses a ReadWriteOncePod claim, and checks that the scheduler rejects
+// it. The second pod is deleted again.
+func validateRWOPConflict(podPath string, f *framework.Framework) {
+	app, err := loadApp(podPath)
+	if err != nil {
+		framework.Failf("failed to load pod: %v", err)
+	}
+	app.Name += "-conflict"
+	app.Namespace = f.UniqueName
+
+	err = createAppErr(f.ClientSet, app, deployTimeout, errRWOPConflict)
+	if err != nil {
+		framework.Failf("second pod of ReadWriteOncePod claim not rejected: %v", err)
+	}
+
+	err = deletePod(app.Name, app.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+}
+
 func waitForPodInRunningState(name, ns string, c kubernetes.Interface, t int, expectedError string) error {
 	timeout := time.Duration(t) * time.Minute
 	start := time.Now()
@@ -362,6 +394,10 @@ func waitForPodInRunningState(name, ns string, c kubernetes.Interface, t int, ex
 		}
 		switch pod.Status.Phase {
 		case v1.PodRunning:
+			if expectedError != "" {
+				return false, fmt.Errorf("pod %s is running, expected error %q", name, expectedError)
+			}
+
 			return true, nil
 		case v1.PodFailed, v1.PodSucceeded:
 			return false, conditions.ErrPodCompleted
@@ -447,7 +483,11 @@ func calculateSHA512sum(f *framework.Framework, app *v1.Pod, filePath string, op
 		return "", fmt.Errorf("error: sha512sum could not be calculated %v", stdErr)
 	}
 	// extract checksum from sha512sum output.
-	checkSum := strings.Split(sha512sumOut, "")[0]
+	fields := strings.Fields(sha512sumOut)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("error: sha512sum of %s returned no checksum", filePath)
+	}
+	checkSum := fields[0]
 	framework.Logf("Calculated checksum  %s", checkSum)
 
 	return checkSum, nil
@@ -509,3 +549,71 @@ func recreateCSIPods(f *framework.Framework, podLabels, daemonsetName, deploymen
 
 	return nil
 }
+
+// writeToFileInContainer writes random data to the file and flushes it to
+// the volume, the write fails when the device of the volume is gone.
+func writeToFileInContainer(f *framework.Framework, app *v1.Pod, filePath string) error {
+	cmd := fmt.Sprintf("dd if=/dev/urandom of=%s bs=1M count=4 conv=fsync", filePath)
+	_, stdErr, err := execCommandInContainerByPodName(f, cmd, app.Namespace, app.Name, app.Spec.Containers[0].Name)
+	if err != nil {
+		return fmt.Errorf("could not write to file %s: %w ; stderr: %s", filePath, err, stdErr)
+	}
+
+	return nil
+}
+
+// validateNodePluginRestart writes data to the volume mounted at mountPath in
+// the pod, restarts the nodeplugin pods of the daemonset and checks that the
+// pod can still read the data and write new data afterwards. The checks are
+// retried until deployTimeout, e.g. while the volume healer reattaches rbd-nbd
+// devices.
+func validateNodePluginRestart(
+	f *framework.Framework,
+	app *v1.Pod,
+	mountPath, daemonsetName, deploymentName string,
+) error {
+	dataPath := mountPath + "/restart-data"
+	if err := writeToFileInContainer(f, app, dataPath); err != nil {
+		return err
+	}
+	opt := &metav1.ListOptions{FieldSelector: "metadata.name=" + app.Name}
+	checkSum, err := calculateSHA512sum(f, app, dataPath, opt)
+	if err != nil {
+		return err
+	}
+
+	selector, err := getDaemonSetLabelSelector(f, cephCSINamespace, daemonsetName)
+	if err != nil {
+		return err
+	}
+	if err = recreateCSIPods(f, selector, daemonsetName, deploymentName); err != nil {
+		return err
+	}
+
+	timeout := time.Duration(deployTimeout) * time.Minute
+	var lastErr error
+	err = wait.PollUntilContextTimeout(context.TODO(), poll, timeout, true, func(_ context.Context) (bool, error) {
+		got, sumErr := calculateSHA512sum(f, app, dataPath, opt)
+		if sumErr != nil {
+			lastErr = sumErr
+			framework.Logf("volume not readable yet: %v", sumErr)
+
+			return false, nil
+		}
+		if got != checkSum {
+			return false, fmt.Errorf("checksum of %s changed from %s to %s", dataPath, checkSum, got)
+		}
+		if lastErr = writeToFileInContainer(f, app, mountPath+"/restart-data-after"); lastErr != nil {
+			framework.Logf("volume not writable yet: %v", lastErr)
+
+			return false, nil
+		}
+
+		return true, nil
+	})
+	if wait.Interrupted(err) {
+		err = fmt.Errorf("volume not usable after the restart of %s: %w", daemonsetName, lastErr)
+	}
+
+	return err
+}
@@ -0,0 +1,313 @@
+package ceph_csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+// skipPreflight disables the prerequisite checks before the first cluster
+// spec.
+var skipPreflight bool
+
+// the ceph users of ceph-csi and their caps, as documented in the README.
+const (
+	rbdNodePluginUser     = "csi-rbd-node"
+	rbdProvisionerUser    = "csi-rbd-provisioner"
+	cephFSNodePluginUser  = "csi-cephfs-node"
+	cephFSProvisionerUser = "csi-cephfs-provisioner"
+	healthCheckerUser     = "healthchecker"
+)
+
+var (
+	healthCheckerCaps = map[string]string{
+		"mon": "allow r, allow command quorum_status, allow command version",
+		"osd": "allow rwx pool=default.rgw.meta, allow r pool=.rgw.root, allow rw pool=default.rgw.control, " +
+			"allow rx pool=default.rgw.log, allow x pool=default.rgw.buckets.index",
+		"mgr": "allow command config",
+	}
+	rbdUserCaps = map[string]string{
+		"mon": "profile rbd",
+		"osd": "profile rbd",
+		"mgr": "allow rw",
+	}
+	cephFSProvisionerCaps = map[string]string{
+		"mon": "allow r",
+		"osd": "allow rw tag cephfs metadata=*",
+		"mgr": "allow rw",
+	}
+	cephFSNodePluginCaps = map[string]string{
+		"mon": "allow r",
+		"osd": "allow rw tag cephfs *=*",
+		"mgr": "allow rw",
+		"mds": "allow rw",
+	}
+)
+
+// csiSecret is a secret ceph-csi reads the credentials of a ceph user from.
+type csiSecret struct {
+	name string
+	// idKey and keyKey are the keys of the user name and the cephx key in
+	// the secret data.
+	idKey  string
+	keyKey string
+	// user is the name of the ceph user bootstrap creates for the secret,
+	// without the client. prefix.
+	user string
+	// caps are the caps the user needs.
+	caps map[string]string
+}
+
+// csiSecrets returns the secrets the storage and snapshot classes of the
+// suite reference.
+func csiSecrets() []csiSecret {
+	return []csiSecret{
+		{
+			name: rbdNodePluginSecretName, idKey: "userID", keyKey: "userKey",
+			user: rbdNodePluginUser, caps: rbdUserCaps,
+		},
+		{
+			name: rbdProvisionerSecretName, idKey: "userID", keyKey: "userKey",
+			user: rbdProvisionerUser, caps: rbdUserCaps,
+		},
+		{
+			name: cephFSNodePluginSecretName, idKey: "adminID", keyKey: "adminKey",
+			user: cephFSNodePluginUser, caps: cephFSNodePluginCaps,
+		},
+		{
+			name: cephFSProvisionerSecretName, idKey: "adminID", keyKey: "adminKey",
+			user: cephFSProvisionerUser, caps: cephFSProvisionerCaps,
+		},
+	}
+}
+
+// secretCredentials returns the user name and key stored in the secret data.
+func secretCredentials(secret csiSecret, data map[string][]byte) (string, string, error) {
+	var missing []string
+	for _, key := range []string{secret.idKey, secret.keyKey} {
+		if len(data[key]) == 0 {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) != 0 {
+		return "", "", fmt.Errorf("secret %s has no %s", secret.name, strings.Join(missing, ", "))
+	}
+
+	return string(data[secret.idKey]), string(data[secret.keyKey]), nil
+}
+
+// validateCephUser checks that the user of the secret exists with the key of
+// the secret and the caps ceph-csi needs.
+func validateCephUser(backend CephBackend, secret csiSecret, data map[string][]byte) error {
+	id, key, err := secretCredentials(secret, data)
+	if err != nil {
+		return err
+	}
+
+	auth, err := backend.AuthGet("client." + id)
+	if err != nil {
+		return err
+	}
+	if auth.Key != key {
+		return fmt.Errorf("key of client.%s does not match secret %s", id, secret.name)
+	}
+
+	var mismatches []string
+	for _, daemon := range sortedKeys(secret.caps, auth.Caps) {
+		if want, got := secret.caps[daemon], auth.Caps[daemon]; want != got {
+			mismatches = append(mismatches, fmt.Sprintf("%s caps are %q, expected %q", daemon, got, want))
+		}
+	}
+	if len(mismatches) != 0 {
+		return fmt.Errorf("client.%s: %s", id, strings.Join(mismatches, ", "))
+	}
+
+	return nil
+}
+
+// sortedKeys returns the keys of the maps in order, without duplicates.
+func sortedKeys(maps ...map[string]string) []string {
+	var keys []string
+	for _, m := range maps {
+		for k := range m {
+			if !contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// validatePools checks that the rbd pool and the cephfs filesystem with its
+// data pool exist.
+func validatePools(backend CephBackend) error {
+	df, err := backend.DF()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	found := false
+	for _, pool := range df.Pools {
+		if pool.Name == defaultRbdPool {
+			found = true
+
+			break
+		}
+	}
+	if !found {
+		errs = append(errs, fmt.Errorf("rbd pool %s not found", defaultRbdPool))
+	}
+
+	filesystems, err := backend.ListFilesystems()
+	if err != nil {
+		return err
+	}
+	var fs *cephFilesystem
+	for i := range filesystems {
+		if filesystems[i].Name == defaultFileSystemName {
+			fs = &filesystems[i]
+
+			break
+		}
+	}
+	switch {
+	case fs == nil:
+		errs = append(errs, fmt.Errorf("filesystem %s not found", defaultFileSystemName))
+	case !contains(fs.DataPools, defaultFileSystemDataPool):
+		errs = append(errs, fmt.Errorf("data pool %s is not a data pool of filesystem %s, found %s",
+			defaultFileSystemDataPool, defaultFileSystemName, strings.Join(fs.DataPools, ", ")))
+	}
+
+	return errors.Join(errs...)
+}
+
+// check is a named step of a command, it passes when run returns nil.
+type check struct {
+	name string
+	run  func() error
+}
+
+// runChecks runs all checks and writes a pass/fail table, it returns an error
+// when a check failed.
+func runChecks(w io.Writer, checks []check) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAILS")
+	failed := 0
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			failed++
+			fmt.Fprintf(tw, "%s\tFAIL\t%s\n", c.name, strings.ReplaceAll(err.Error(), "\n", "; "))
+
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tPASS\t\n", c.name)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+
+	return nil
+}
+
+// preflightTimeout is how long, in minutes, the checks wait for the ceph-csi
+// workloads to become ready.
+const preflightTimeout = 1
+
+// preflightChecks returns the checks for the prerequisites listed in the
+// README.
+func preflightChecks(f *framework.Framework) []check {
+	c := f.ClientSet
+	backend := getCephBackend(f)
+	ctx := context.TODO()
+
+	checks := []check{
+		{name: "kubernetes api", run: func() error {
+			_, err := c.Discovery().ServerVersion()
+
+			return err
+		}},
+		{name: "namespace " + cephCSINamespace, run: func() error {
+			_, err := c.CoreV1().Namespaces().Get(ctx, cephCSINamespace, metav1.GetOptions{})
+
+			return err
+		}},
+		{name: "rbd csi driver", run: func() error {
+			_, err := getRBDDriverName(c)
+
+			return err
+		}},
+		{name: "cephfs csi driver", run: func() error {
+			_, err := getCephFSDriverName(c)
+
+			return err
+		}},
+	}
+
+	for _, ds := range []string{rbdNodePluginDaemonSet, cephFSNodePluginDaemonSet} {
+		ds := ds
+		checks = append(checks, check{name: "daemonset " + ds, run: func() error {
+			return waitForDaemonSets(ds, cephCSINamespace, c, preflightTimeout)
+		}})
+	}
+	for _, deploy := range []string{rbdProvisionerDeployment, cephFSProvisionerDeployment} {
+		deploy := deploy
+		checks = append(checks, check{name: "deployment " + deploy, run: func() error {
+			return waitForDeploymentComplete(c, deploy, cephCSINamespace, preflightTimeout)
+		}})
+	}
+
+	checks = append(checks,
+		check{name: "ceph cluster", run: func() error {
+			_, err := backend.ClusterID()
+
+			return err
+		}},
+		check{name: "pools", run: func() error {
+			return validatePools(backend)
+		}},
+	)
+
+	for _, secret := range csiSecrets() {
+		secret := secret
+		checks = append(checks, check{
+			name: fmt.Sprintf("secret %s/%s", cephCSISecretNamespace, secret.name),
+			run: func() error {
+				s, err := c.CoreV1().Secrets(cephCSISecretNamespace).Get(ctx, secret.name, metav1.GetOptions{})
+				if apierrs.IsNotFound(err) {
+					return fmt.Errorf("secret %s not found in namespace %s", secret.name, cephCSISecretNamespace)
+				}
+				if err != nil {
+					return err
+				}
+
+				return validateCephUser(backend, secret, s.Data)
+			},
+		})
+	}
+
+	return checks
+}
+
+// Preflight checks the prerequisites of the suite and writes a pass/fail
+// table to w.
+func Preflight(w io.Writer) error {
+	f, err := newClusterFramework("preflight")
+	if err != nil {
+		return err
+	}
+
+	return runChecks(w, preflightChecks(f))
+}
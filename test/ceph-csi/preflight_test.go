@@ -0,0 +1,74 @@
+package ceph_csi
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Preflight", Label("unit"), func() {
+	var backend *fakeCephBackend
+
+	BeforeEach(func() {
+		backend = newFakeCephBackend("fake-fsid")
+		backend.addAuthEntity(cephAuthEntity{
+			Entity: "client.csi-cephfs-node",
+			Key:    "AQC8G+VkrE7hLRAAKhOIlNbrcwkYsJ3zhkSZhQ==",
+			Caps:   cephFSNodePluginCaps,
+		})
+	})
+
+	secret := csiSecret{name: "rook-csi-cephfs-node", idKey: "adminID", keyKey: "adminKey", caps: cephFSNodePluginCaps}
+
+	It("should accept a user with the key and caps of the secret", func() {
+		Expect(validateCephUser(backend, secret, map[string][]byte{
+			"adminID":  []byte("csi-cephfs-node"),
+			"adminKey": []byte("AQC8G+VkrE7hLRAAKhOIlNbrcwkYsJ3zhkSZhQ=="),
+		})).To(Succeed())
+	})
+
+	It("should reject secrets without the credential keys", func() {
+		err := validateCephUser(backend, secret, map[string][]byte{
+			"userID":  []byte("csi-cephfs-node"),
+			"userKey": []byte("AQC8G+VkrE7hLRAAKhOIlNbrcwkYsJ3zhkSZhQ=="),
+		})
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("adminID, adminKey"))
+	})
+
+	It("should reject users with another key or other caps", func() {
+		err := validateCephUser(backend, secret, map[string][]byte{
+			"adminID":  []byte("csi-cephfs-node"),
+			"adminKey": []byte("AQDifferentKey=="),
+		})
+		Expect(err).To(MatchError(ContainSubstring("does not match")))
+
+		backend.addAuthEntity(cephAuthEntity{
+			Entity: "client.csi-cephfs-node",
+			Key:    "AQC8G+VkrE7hLRAAKhOIlNbrcwkYsJ3zhkSZhQ==",
+			Caps:   map[string]string{"mon": "allow r", "osd": "allow rw tag cephfs *=*"},
+		})
+		err = validateCephUser(backend, secret, map[string][]byte{
+			"adminID":  []byte("csi-cephfs-node"),
+			"adminKey": []byte("AQC8G+VkrE7hLRAAKhOIlNbrcwkYsJ3zhkSZhQ=="),
+		})
+		Expect(err).To(MatchError(ContainSubstring(`mds caps are "", expected "allow rw"`)))
+	})
+
+	It("should report missing users", func() {
+		err := validateCephUser(backend, secret, map[string][]byte{
+			"adminID":  []byte("csi-cephfs-provisioner"),
+			"adminKey": []byte("AQC8G+VkCCuMHBAAWs2d1TikE48ocV9p/0j/Lw=="),
+		})
+		Expect(errors.Is(err, errCephObjectNotFound)).To(BeTrue())
+	})
+
+	It("should check the pools and the filesystem", func() {
+		Expect(validatePools(backend)).ShouldNot(Succeed())
+
+		backend.setDF(cephDF{Pools: []cephDFPool{{Name: defaultRbdPool}}})
+		backend.addFilesystem(cephFilesystem{Name: defaultFileSystemName, DataPools: []string{defaultFileSystemDataPool}})
+		Expect(validatePools(backend)).To(Succeed())
+	})
+})
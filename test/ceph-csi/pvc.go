@@ -2,22 +2,31 @@ package ceph_csi
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/kubernetes/test/e2e/framework"
 	e2epv "k8s.io/kubernetes/test/e2e/framework/pv"
 )
 
 func createPVC(path string, f *framework.Framework) (*v1.PersistentVolumeClaim, error) {
+	return createPVCWithParams(path, manifestParams{}, f)
+}
+
+// createPVCWithParams renders the PVC manifest with the params, e.g. another
+// storage class, size or volumeMode, and creates it.
+func createPVCWithParams(path string, params manifestParams, f *framework.Framework) (*v1.PersistentVolumeClaim, error) {
 	pvc := &v1.PersistentVolumeClaim{}
-	err := unmarshal(path, &pvc)
+	err := unmarshalManifest(path, params, &pvc)
 	if err != nil {
 		return nil, err
 	}
@@ -93,49 +102,112 @@ func createPVCAndvalidatePV(c kubernetes.Interface, pvc *v1.PersistentVolumeClai
 	})
 }
 
-func expandPVC(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim, t int) error {
-	patchBytes := []byte(`{"spec":{"resources":{"requests":{"storage":"2Gi"}}}}`)
-	_, err := c.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(
+// expansionMode is how a volume is expanded, online while a pod uses it or
+// offline without a pod.
+type expansionMode string
+
+const (
+	onlineExpansion  expansionMode = "online"
+	offlineExpansion expansionMode = "offline"
+)
+
+// volumeExpansions are the sizes and modes the expansion specs expand the
+// 1Gi volumes of the manifests with.
+var volumeExpansions = []struct {
+	size string
+	mode expansionMode
+}{
+	{size: "2Gi", mode: onlineExpansion},
+	{size: "3Gi", mode: offlineExpansion},
+}
+
+// resizePVC requests the size for the PVC.
+func resizePVC(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim, size resource.Quantity) error {
+	patchBytes, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"resources": map[string]interface{}{
+				"requests": map[string]string{"storage": size.String()},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(
 		context.TODO(),
 		pvc.Name,
 		types.StrategicMergePatchType,
 		patchBytes,
 		metav1.PatchOptions{})
 	if err != nil {
-		framework.Failf("failed to patch PVC with larger size: %v", err)
+		return fmt.Errorf("failed to resize PVC %s to %s: %w", pvc.Name, size.String(), err)
+	}
+
+	return nil
+}
+
+// expandPVC resizes the PVC and waits for the expansion. An online expansion
+// is complete when the capacity of the PVC reached the size. An offline
+// expansion only waits for the PV, the filesystem and the capacity of the PVC
+// are expanded when a pod uses the volume again, wait for that with
+// waitForPVCCapacity.
+func expandPVC(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim, size resource.Quantity, mode expansionMode, t int) error {
+	if err := resizePVC(c, pvc, size); err != nil {
+		return err
 	}
 
+	if mode == offlineExpansion {
+		return waitForPVCapacity(c, pvc, size, t)
+	}
+
+	return waitForPVCCapacity(c, pvc, size, t)
+}
+
+// waitForPVCapacity waits until the PV of the PVC has at least the size.
+func waitForPVCapacity(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim, size resource.Quantity, t int) error {
 	timeout := time.Duration(t) * time.Minute
-	ctx := context.Background()
 	start := time.Now()
 
-	return wait.PollUntilContextTimeout(ctx, poll, timeout, false, func(ctx context.Context) (bool, error) {
-		framework.Logf("waiting for PVC %s (%d seconds elapsed)", pvc.Name, int(time.Since(start).Seconds()))
-		pvc, err = c.CoreV1().PersistentVolumeClaims(pvc.Namespace).
-			Get(ctx, pvc.Name, metav1.GetOptions{})
+	return wait.PollUntilContextTimeout(context.TODO(), poll, timeout, true, func(ctx context.Context) (bool, error) {
+		pv, err := getBoundPersistentVolume(c, pvc)
+		if err != nil {
+			return false, err
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		framework.Logf("waiting for PV %s with capacity %s to reach %s (%d seconds elapsed)",
+			pv.Name, capacity.String(), size.String(), int(time.Since(start).Seconds()))
+
+		return capacity.Cmp(size) >= 0, nil
+	})
+}
+
+// waitForPVCCapacity waits until the PVC is bound with at least the size and
+// no resize of its filesystem is pending.
+func waitForPVCCapacity(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim, size resource.Quantity, t int) error {
+	timeout := time.Duration(t) * time.Minute
+	start := time.Now()
+
+	return wait.PollUntilContextTimeout(context.TODO(), poll, timeout, true, func(ctx context.Context) (bool, error) {
+		claim, err := c.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
 		if err != nil {
 			framework.Logf("Error getting pvc %q in namespace %q: %v", pvc.Name, pvc.Namespace, err)
 			if isRetryableAPIError(err) {
 				return false, nil
 			}
-			if apierrs.IsNotFound(err) {
-				return false, nil
-			}
 
 			return false, fmt.Errorf("failed to get pvc: %w", err)
 		}
+		capacity := claim.Status.Capacity[v1.ResourceStorage]
+		framework.Logf("waiting for PVC %s with capacity %s to reach %s (%d seconds elapsed)",
+			pvc.Name, capacity.String(), size.String(), int(time.Since(start).Seconds()))
 
-		if pvc.Spec.VolumeName == "" {
-			return false, nil
-		}
-
-		if pvc.Status.Phase != v1.ClaimBound {
+		if claim.Status.Phase != v1.ClaimBound || capacity.Cmp(size) < 0 {
 			return false, nil
 		}
-
-		for _, cond := range pvc.Status.Conditions {
-			framework.Logf("pvc status: %s conditions: %s", pvc.Status.Phase, cond.Type)
-			if cond.Type == v1.PersistentVolumeClaimFileSystemResizePending {
+		for _, cond := range claim.Status.Conditions {
+			framework.Logf("pvc status: %s conditions: %s", claim.Status.Phase, cond.Type)
+			if cond.Type == v1.PersistentVolumeClaimFileSystemResizePending ||
+				cond.Type == v1.PersistentVolumeClaimResizing {
 				return false, nil
 			}
 		}
@@ -144,6 +216,32 @@ func expandPVC(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim, t int) err
 	})
 }
 
+// validateResizeRejected checks that resizing the PVC to the size is rejected
+// and that the requested size of the PVC is unchanged.
+func validateResizeRejected(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim, size resource.Quantity) error {
+	claim, err := getPersistentVolumeClaim(c, pvc.Namespace, pvc.Name)
+	if err != nil {
+		return err
+	}
+	requested := claim.Spec.Resources.Requests[v1.ResourceStorage]
+
+	err = resizePVC(c, pvc, size)
+	if err == nil {
+		return fmt.Errorf("resize of PVC %s from %s to %s was accepted", pvc.Name, requested.String(), size.String())
+	}
+	framework.Logf("resize of PVC %s rejected: %v", pvc.Name, err)
+
+	claim, err = getPersistentVolumeClaim(c, pvc.Namespace, pvc.Name)
+	if err != nil {
+		return err
+	}
+	if got := claim.Spec.Resources.Requests[v1.ResourceStorage]; got.Cmp(requested) != 0 {
+		return fmt.Errorf("requested size of PVC %s changed from %s to %s", pvc.Name, requested.String(), got.String())
+	}
+
+	return nil
+}
+
 // getPersistentVolumeClaim returns the PersistentVolumeClaim with the given
 // name in the given namespace and retries if there is any API error.
 func getPersistentVolumeClaim(c kubernetes.Interface, namespace, name string) (*v1.PersistentVolumeClaim, error) {
@@ -200,6 +298,55 @@ func getPersistentVolume(c kubernetes.Interface, name string) (*v1.PersistentVol
 	return pv, err
 }
 
+// getBoundPersistentVolume returns the PersistentVolume the PVC is bound to.
+func getBoundPersistentVolume(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim) (*v1.PersistentVolume, error) {
+	claim, err := getPersistentVolumeClaim(c, pvc.Namespace, pvc.Name)
+	if err != nil {
+		return nil, err
+	}
+	if claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("pvc %s/%s is not bound", pvc.Namespace, pvc.Name)
+	}
+
+	return getPersistentVolume(c, claim.Spec.VolumeName)
+}
+
+// listPersistentVolumeClaims returns all PersistentVolumeClaims in the
+// namespace.
+func listPersistentVolumeClaims(c kubernetes.Interface, namespace string) ([]v1.PersistentVolumeClaim, error) {
+	pvcList, err := c.CoreV1().PersistentVolumeClaims(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pvc in namespace %s: %w", namespace, err)
+	}
+
+	return pvcList.Items, nil
+}
+
+// waitForPVDeleted waits until the PV is gone, e.g. after the PVC of a generic
+// ephemeral volume was garbage collected together with its pod.
+func waitForPVDeleted(c kubernetes.Interface, name string, t int) error {
+	timeout := time.Duration(t) * time.Minute
+	start := time.Now()
+
+	return wait.PollUntilContextTimeout(context.TODO(), poll, timeout, true, func(ctx context.Context) (bool, error) {
+		pv, err := c.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			framework.Logf("PV %s (status: %s) has not been deleted yet (%d seconds elapsed)",
+				name, pv.Status.Phase, int(time.Since(start).Seconds()))
+
+			return false, nil
+		}
+		if isRetryableAPIError(err) {
+			return false, nil
+		}
+		if !apierrs.IsNotFound(err) {
+			return false, fmt.Errorf("get on PV %v failed with error other than \"not found\": %w", name, err)
+		}
+
+		return true, nil
+	})
+}
+
 func deletePVCAndValidatePV(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim, t int) error {
 	timeout := time.Duration(t) * time.Minute
 	nameSpace := pvc.Namespace
@@ -264,3 +411,108 @@ func deletePVCAndValidatePV(c kubernetes.Interface, pvc *v1.PersistentVolumeClai
 		return true, nil
 	})
 }
+
+// deletePVC deletes the PVC and waits until it is gone. Unlike
+// deletePVCAndValidatePV it does not wait for the PV, e.g. for a PV with the
+// Retain reclaim policy that stays Released.
+func deletePVC(c kubernetes.Interface, pvc *v1.PersistentVolumeClaim, t int) error {
+	timeout := time.Duration(t) * time.Minute
+	ctx := context.TODO()
+	framework.Logf("Deleting PersistentVolumeClaim %v on namespace %v", pvc.Name, pvc.Namespace)
+	err := c.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(ctx, pvc.Name, metav1.DeleteOptions{})
+	if err != nil {
+		return fmt.Errorf("delete of PVC %v failed: %w", pvc.Name, err)
+	}
+
+	return wait.PollUntilContextTimeout(ctx, poll, timeout, true, func(ctx context.Context) (bool, error) {
+		_, err := c.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
+		if err == nil {
+			return false, nil
+		}
+		if isRetryableAPIError(err) {
+			return false, nil
+		}
+		if !apierrs.IsNotFound(err) {
+			return false, fmt.Errorf("get on deleted PVC %v failed with error other than \"not found\": %w", pvc.Name, err)
+		}
+
+		return true, nil
+	})
+}
+
+// deletePV deletes the PV and waits until it is gone.
+func deletePV(c kubernetes.Interface, name string, t int) error {
+	framework.Logf("Deleting PersistentVolume %v", name)
+	err := c.CoreV1().PersistentVolumes().Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil {
+		return fmt.Errorf("delete of PV %v failed: %w", name, err)
+	}
+
+	return waitForPVDeleted(c, name, t)
+}
+
+// createPVCForPV creates the PVC of the manifest bound to the PV, with the
+// storage class of the PV, e.g. none for a static PV, so no volume is
+// provisioned for it.
+func createPVCForPV(path string, pv *v1.PersistentVolume, f *framework.Framework) (*v1.PersistentVolumeClaim, error) {
+	pvc := &v1.PersistentVolumeClaim{}
+	if err := unmarshal(path, &pvc); err != nil {
+		return nil, err
+	}
+	pvc.Namespace = f.UniqueName
+	storageClass := pv.Spec.StorageClassName
+	pvc.Spec.StorageClassName = &storageClass
+	pvc.Spec.VolumeName = pv.Name
+
+	if err := createPVCAndvalidatePV(f.ClientSet, pvc, deployTimeout); err != nil {
+		return nil, fmt.Errorf("failed to create pvc: %w", err)
+	}
+
+	return pvc, nil
+}
+
+// waitForPVPhase waits until the PV is in the phase, e.g. Released after the
+// PVC of a PV with the Retain reclaim policy was deleted.
+func waitForPVPhase(c kubernetes.Interface, name string, phase v1.PersistentVolumePhase, t int) error {
+	timeout := time.Duration(t) * time.Minute
+	start := time.Now()
+
+	return wait.PollUntilContextTimeout(context.TODO(), poll, timeout, true, func(ctx context.Context) (bool, error) {
+		pv, err := c.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if isRetryableAPIError(err) {
+				return false, nil
+			}
+
+			return false, fmt.Errorf("failed to get pv: %w", err)
+		}
+		if pv.Status.Phase != phase {
+			framework.Logf("waiting for PV %s in phase %s to be %s (%d seconds elapsed)",
+				name, pv.Status.Phase, phase, int(time.Since(start).Seconds()))
+
+			return false, nil
+		}
+
+		return true, nil
+	})
+}
+
+// clearPVClaimRef removes the claimRef of a Released PV, the PV becomes
+// Available and can be bound by a new PVC.
+func clearPVClaimRef(c kubernetes.Interface, name string) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pv, err := c.CoreV1().PersistentVolumes().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		pv.Spec.ClaimRef = nil
+		_, err = c.CoreV1().PersistentVolumes().Update(context.TODO(), pv, metav1.UpdateOptions{})
+
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to clear claimRef of pv %s: %w", name, err)
+	}
+
+	return nil
+}
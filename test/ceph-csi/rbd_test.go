@@ -2,61 +2,197 @@ package ceph_csi
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
+	"strings"
 
+	snapapi "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
 	. "github.com/onsi/ginkgo/v2"
 	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/kubernetes/test/e2e/framework"
+	e2enode "k8s.io/kubernetes/test/e2e/framework/node"
 	"k8s.io/pod-security-admission/api"
 )
 
-var (
-	defaultRbdSc = "csi-rbd-sc"
-)
+func listRBDImages(f *framework.Framework, pool string) ([]string, error) {
+	return getCephBackend(f).ListImages(pool)
+}
 
-func rbdOptions(pool string) string {
-	if radosNamespace != "" {
-		return "--pool=" + pool + " --namespace " + radosNamespace
+// rbdImageExists checks if the image exists in the pool.
+func rbdImageExists(f *framework.Framework, pool, image string) (bool, error) {
+	_, err := getCephBackend(f).ImageInfo(pool, image)
+	if errors.Is(err, errCephObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
 
-	return "--pool=" + pool
+	return true, nil
 }
 
-func listRBDImages(f *framework.Framework, pool string) ([]string, error) {
-	var imgInfos []string
+// rbdImageInTrash checks if the image has been moved to the trash of the pool.
+func rbdImageInTrash(f *framework.Framework, pool, image string) (bool, error) {
+	trash, err := getCephBackend(f).ListTrash(pool)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range trash {
+		if t.Name == image {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// validateRBDImages resolves the rbd image of every PVC and checks that
+// precisely that image exists. The result of each PVC is logged and all
+// failures are reported at once. The resolved images are returned, so their
+// removal can be validated after the PVCs are deleted.
+func validateRBDImages(f *framework.Framework, pvcs ...*v1.PersistentVolumeClaim) []rbdImageRef {
+	refs := make([]rbdImageRef, 0, len(pvcs))
+	var failures []string
+	for _, pvc := range pvcs {
+		pv, err := getBoundPersistentVolume(f.ClientSet, pvc)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("PVC %s/%s: %v", pvc.Namespace, pvc.Name, err))
+
+			continue
+		}
+		ref, err := getRBDImageRef(pv)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("PVC %s/%s: %v", pvc.Namespace, pvc.Name, err))
+
+			continue
+		}
+
+		exists, err := rbdImageExists(f, ref.pool, ref.image)
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("%s: %v", ref, err))
+		case !exists:
+			failures = append(failures, fmt.Sprintf("%s: image not found", ref))
+		default:
+			framework.Logf("%s: image found", ref)
+		}
+		refs = append(refs, ref)
+	}
+
+	if len(failures) != 0 {
+		framework.Failf("backend images not matching kubernetes resources:\n%s", strings.Join(failures, "\n"))
+	}
+
+	return refs
+}
+
+// validateRBDImagesInNamespace validates the rbd images of all PVCs in the
+// test namespace, e.g. the ones created from volumeClaimTemplates.
+func validateRBDImagesInNamespace(f *framework.Framework, pvcCount int) []rbdImageRef {
+	pvcList, err := listPersistentVolumeClaims(f.ClientSet, f.UniqueName)
+	if err != nil {
+		framework.Failf("failed to list pvc: %v", err)
+	}
+	if len(pvcList) != pvcCount {
+		framework.Failf("found %d pvc in namespace %s, expected %d", len(pvcList), f.UniqueName, pvcCount)
+	}
+
+	pvcs := make([]*v1.PersistentVolumeClaim, 0, len(pvcList))
+	for i := range pvcList {
+		pvcs = append(pvcs, &pvcList[i])
+	}
 
-	stdout, err := exec.Command("rbd", "ls", "--format=json", rbdOptions(pool)).CombinedOutput()
+	return validateRBDImages(f, pvcs...)
+}
+
+// validateRBDImagesDeleted checks that the images of deleted PVCs are gone
+// from the pool. Images that ceph-csi moved to the trash count as deleted.
+func validateRBDImagesDeleted(f *framework.Framework, refs []rbdImageRef) {
+	var failures []string
+	for _, ref := range refs {
+		exists, err := rbdImageExists(f, ref.pool, ref.image)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", ref, err))
+
+			continue
+		}
+		if exists {
+			failures = append(failures, fmt.Sprintf("%s: image still exists", ref))
+
+			continue
+		}
+
+		inTrash, err := rbdImageInTrash(f, ref.pool, ref.image)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", ref, err))
+
+			continue
+		}
+		if inTrash {
+			framework.Logf("%s: image moved to trash", ref)
+		} else {
+			framework.Logf("%s: image deleted", ref)
+		}
+	}
+
+	if len(failures) != 0 {
+		framework.Failf("backend images of deleted PVCs not removed:\n%s", strings.Join(failures, "\n"))
+	}
+}
+
+// validateRBDSnapshot resolves the rbd image backing the snapshot, which was
+// taken from the source image, and checks that it exists.
+func validateRBDSnapshot(f *framework.Framework, snap *snapapi.VolumeSnapshot, source rbdImageRef) rbdSnapshotRef {
+	vsc, err := getVolumeSnapshotContent(snap)
+	if err != nil {
+		framework.Failf("failed to get volumesnapshotcontent: %v", err)
+	}
+	ref, err := getRBDSnapshotRef(vsc, source)
 	if err != nil {
-		return imgInfos, fmt.Errorf("failed to list images %s, %s", err.Error(), string(stdout))
+		framework.Failf("failed to resolve rbd snapshot: %v", err)
 	}
 
-	err = json.Unmarshal(stdout, &imgInfos)
+	exists, err := rbdImageExists(f, ref.pool, ref.image)
 	if err != nil {
-		return imgInfos, err
+		framework.Failf("%s: %v", ref, err)
 	}
+	if !exists {
+		framework.Failf("%s: snapshot image not found", ref)
+	}
+	framework.Logf("%s: snapshot image found", ref)
 
-	return imgInfos, nil
+	return ref
 }
 
-func validateRBDImageCount(f *framework.Framework, count int, pool string) {
-	imageList, err := listRBDImages(f, pool)
+// validateRBDSnapshotDeleted checks that the image of a deleted snapshot is
+// gone from the pool. An image that ceph-csi moved to the trash counts as
+// deleted.
+func validateRBDSnapshotDeleted(f *framework.Framework, ref rbdSnapshotRef) {
+	exists, err := rbdImageExists(f, ref.pool, ref.image)
 	if err != nil {
-		framework.Failf("failed to list rbd images: %v", err)
+		framework.Failf("%s: %v", ref, err)
 	}
-	if len(imageList) < count {
-		framework.Failf(
-			"backend images not matching kubernetes resource count,image count %d kubernetes resource count %d"+
-				"\nbackend image Info:\n %v",
-			len(imageList),
-			count,
-			imageList)
+	if exists {
+		framework.Failf("%s: snapshot image still exists", ref)
+	}
+
+	inTrash, err := rbdImageInTrash(f, ref.pool, ref.image)
+	if err != nil {
+		framework.Failf("%s: %v", ref, err)
+	}
+	if inTrash {
+		framework.Logf("%s: snapshot image moved to trash", ref)
+	} else {
+		framework.Logf("%s: snapshot image deleted", ref)
 	}
 }
 
+// validateRbdRwoVolume provisions a volume for a pod and checks that the image
+// and the mount match the parameters of the storage class.
 func validateRbdRwoVolume(pvcPath, podPath string, f *framework.Framework) {
 	pvc, err := createPVC(pvcPath, f)
 	if err != nil {
@@ -68,7 +204,13 @@ func validateRbdRwoVolume(pvcPath, podPath string, f *framework.Framework) {
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	validateRBDImageCount(f, 1, defaultRbdPool)
+	images := validateRBDImages(f, pvc)
+
+	By("validate storage class parameters")
+	err = validateRBDStorageClassParameters(f, pvc, pod)
+	if err != nil {
+		framework.Failf("%v", err)
+	}
 
 	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
 	if err != nil {
@@ -80,7 +222,7 @@ func validateRbdRwoVolume(pvcPath, podPath string, f *framework.Framework) {
 		framework.Failf("failed to delete pvc: %v", err)
 	}
 
-	validateRBDImageCount(f, 0, defaultRbdPool)
+	validateRBDImagesDeleted(f, images)
 }
 
 func validateRdbBlock(pod *v1.Pod, f *framework.Framework) {
@@ -115,7 +257,7 @@ func validateRbdRwxVolume(pvcPath, podPath, anotherPodPath string, f *framework.
 		framework.Failf("failed to create another pod: %v", err)
 	}
 
-	validateRBDImageCount(f, 1, defaultRbdPool)
+	images := validateRBDImages(f, pvc)
 
 	validateRdbBlock(pod, f)
 	validateRdbBlock(anotherPod, f)
@@ -135,7 +277,7 @@ func validateRbdRwxVolume(pvcPath, podPath, anotherPodPath string, f *framework.
 		framework.Failf("failed to delete pvc: %v", err)
 	}
 
-	validateRBDImageCount(f, 0, defaultRbdPool)
+	validateRBDImagesDeleted(f, images)
 }
 
 func validateRbdVolumeClone(pvcPath, podPath, clonePvcPath, clonePodPath string, f *framework.Framework) {
@@ -149,7 +291,7 @@ func validateRbdVolumeClone(pvcPath, podPath, clonePvcPath, clonePodPath string,
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	validateRBDImageCount(f, 1, defaultRbdPool)
+	images := validateRBDImages(f, pvc)
 
 	clonePvc, err := createPVC(clonePvcPath, f)
 	if err != nil {
@@ -161,7 +303,7 @@ func validateRbdVolumeClone(pvcPath, podPath, clonePvcPath, clonePodPath string,
 		framework.Failf("failed to create pod clone: %v", err)
 	}
 
-	validateRBDImageCount(f, 3, defaultRbdPool)
+	images = append(images, validateRBDImages(f, clonePvc)...)
 
 	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
 	if err != nil {
@@ -183,7 +325,7 @@ func validateRbdVolumeClone(pvcPath, podPath, clonePvcPath, clonePodPath string,
 		framework.Failf("failed to delete clone pvc: %v", err)
 	}
 
-	validateRBDImageCount(f, 0, defaultRbdPool)
+	validateRBDImagesDeleted(f, images)
 }
 
 func createRbdVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPath, restorePodPath string, f *framework.Framework) {
@@ -199,8 +341,8 @@ func createRbdVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPath,
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	By("validate rbd image count")
-	validateRBDImageCount(f, 1, defaultRbdPool)
+	By("validate rbd image")
+	images := validateRBDImages(f, pvc)
 
 	snap := getSnapshot(snapshotPath)
 	snap.Namespace = f.UniqueName
@@ -212,8 +354,8 @@ func createRbdVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPath,
 		framework.Failf("failed to create snapshot: %v", err)
 	}
 
-	By("validate rbd image count")
-	validateRBDImageCount(f, 2, defaultRbdPool)
+	By("validate rbd snapshot image")
+	snapImage := validateRBDSnapshot(f, &snap, images[0])
 
 	By("delete pod")
 	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
@@ -227,8 +369,11 @@ func createRbdVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPath,
 		framework.Failf("failed to delete pvc: %v", err)
 	}
 
-	By("validate rbd image count")
-	validateRBDImageCount(f, 1, defaultRbdPool)
+	By("validate rbd image deleted")
+	validateRBDImagesDeleted(f, images)
+
+	By("validate rbd snapshot image kept after the source pvc is deleted")
+	validateRBDSnapshot(f, &snap, images[0])
 
 	By("create pvc from snapshot")
 	restorePVC, err := createPVC(restorePvcPath, f)
@@ -242,16 +387,19 @@ func createRbdVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPath,
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	By("validate rbd image count")
-	validateRBDImageCount(f, 2, defaultRbdPool)
+	By("validate restored rbd image")
+	restoreImages := validateRBDImages(f, restorePVC)
 
 	By("delete snapshot")
 	if err := deleteSnapshot(&snap, deployTimeout); err != nil {
 		framework.Failf("failed to delete snapshot: %v", err)
 	}
 
-	By("validate rbd image count")
-	validateRBDImageCount(f, 1, defaultRbdPool)
+	By("validate rbd snapshot image deleted")
+	validateRBDSnapshotDeleted(f, snapImage)
+
+	By("validate restored rbd image")
+	validateRBDImages(f, restorePVC)
 
 	By("delete pod")
 	err = deletePod(restorePod.Name, restorePod.Namespace, f.ClientSet, deployTimeout)
@@ -265,11 +413,19 @@ func createRbdVolumeFromSnapshot(pvcPath, podPath, snapshotPath, restorePvcPath,
 		framework.Failf("failed to delete restore pvc: %v", err)
 	}
 
-	By("validate rbd image count")
-	validateRBDImageCount(f, 0, defaultRbdPool)
+	By("validate restored rbd image deleted")
+	validateRBDImagesDeleted(f, restoreImages)
 }
 
-func validateRbdVolumeExpansion(pvcPath, podPath string, f *framework.Framework) {
+// validateRbdVolumeExpansion expands the volume to the size, online while the
+// pod uses it or offline after the pod was deleted, and reconciles the
+// capacity of the PVC with the PV, the volume in the pod and the image.
+func validateRbdVolumeExpansion(
+	pvcPath, podPath string,
+	size resource.Quantity,
+	mode expansionMode,
+	f *framework.Framework,
+) {
 	pvc, err := createPVC(pvcPath, f)
 	if err != nil {
 		framework.Failf("failed to create RBD pvc: %v", err)
@@ -280,20 +436,543 @@ func validateRbdVolumeExpansion(pvcPath, podPath string, f *framework.Framework)
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	validateRBDImageCount(f, 1, defaultRbdPool)
+	images := validateRBDImages(f, pvc)
 
-	By("validate volume size in pod")
-	validateTestVolumeSize(pod, 900, f)
+	By("validate volume capacity")
+	err = validateVolumeCapacity(f, pvc, pod)
+	if err != nil {
+		framework.Failf("%v", err)
+	}
+
+	if mode == offlineExpansion {
+		err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
+		if err != nil {
+			framework.Failf("failed to delete pod: %v", err)
+		}
+	}
 
-	expandPVC(f.ClientSet, pvc, deployTimeout)
+	By(fmt.Sprintf("expand pvc %s to %s", mode, size.String()))
+	err = expandPVC(f.ClientSet, pvc, size, mode, deployTimeout)
 	if err != nil {
 		framework.Failf("failed to expand PVC: %v", err)
 	}
 
-	validateRBDImageCount(f, 1, defaultRbdPool)
+	if mode == offlineExpansion {
+		pod, err = createPod(podPath, deployTimeout, f)
+		if err != nil {
+			framework.Failf("failed to create pod: %v", err)
+		}
+		err = waitForPVCCapacity(f.ClientSet, pvc, size, deployTimeout)
+		if err != nil {
+			framework.Failf("failed to expand PVC: %v", err)
+		}
+	}
+
+	By("validate volume capacity after expansion")
+	err = validateVolumeCapacity(f, pvc, pod)
+	if err != nil {
+		framework.Failf("%v", err)
+	}
+
+	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVCAndValidatePV(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	validateRBDImagesDeleted(f, images)
+}
+
+// validateRbdExpansionRejected checks that resizing the volume to the size is
+// rejected and that the image keeps its size.
+func validateRbdExpansionRejected(pvcPath string, size resource.Quantity, f *framework.Framework) {
+	pvc, err := createPVC(pvcPath, f)
+	if err != nil {
+		framework.Failf("failed to create RBD pvc: %v", err)
+	}
+
+	images := validateRBDImages(f, pvc)
+	sizes := map[string]int64{}
+	for _, ref := range images {
+		info, err := getCephBackend(f).ImageInfo(ref.pool, ref.image)
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+		sizes[ref.image] = info.Size
+	}
+
+	err = validateResizeRejected(f.ClientSet, pvc, size)
+	if err != nil {
+		framework.Failf("%v", err)
+	}
+
+	for _, ref := range images {
+		info, err := getCephBackend(f).ImageInfo(ref.pool, ref.image)
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+		if info.Size != sizes[ref.image] {
+			framework.Failf("%s: image size changed from %d to %d", ref, sizes[ref.image], info.Size)
+		}
+	}
+
+	err = deletePVCAndValidatePV(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	validateRBDImagesDeleted(f, images)
+}
+
+// validateRbdRwopVolume checks that a pod can use a ReadWriteOncePod volume
+// and that a second pod using the same claim is rejected.
+func validateRbdRwopVolume(pvcPath, podPath string, f *framework.Framework) {
+	pvc, err := createPVC(pvcPath, f)
+	if err != nil {
+		framework.Failf("failed to create rbd pvc: %v", err)
+	}
+
+	pod, err := createPod(podPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+
+	images := validateRBDImages(f, pvc)
+
+	validateRWOPConflict(podPath, f)
+
+	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVCAndValidatePV(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	validateRBDImagesDeleted(f, images)
+}
+
+// encryptedDataPath is the file the encryption specs write to the volume of
+// the file mode pods.
+const encryptedDataPath = "/var/lib/www/html/encrypted"
+
+// validateEncryptedRbdPod checks that the volume of the pod is a dm-crypt
+// device, that its rbd image has a LUKS header and, when checksum is set, that
+// the data written before reads back unchanged. The image is returned, so its
+// removal can be validated.
+func validateEncryptedRbdPod(
+	f *framework.Framework,
+	pod *v1.Pod,
+	pvc *v1.PersistentVolumeClaim,
+	checksum string,
+) rbdImageRef {
+	images := validateRBDImages(f, pvc)
+	if err := validateRBDImageEncrypted(getCephBackend(f), images[0]); err != nil {
+		framework.Failf("failed to validate encrypted image: %v", err)
+	}
+
+	// the device of the mount is looked up in sysfs, dm-crypt devices have
+	// a dm uuid starting with CRYPT-.
+	cmd := `cat /sys/dev/block/$(awk '$5 == "/var/lib/www/html" {print $3}' /proc/self/mountinfo)/dm/uuid`
+	stdout, stdErr, err := execCommandInContainerByPodName(f, cmd, pod.Namespace, pod.Name, pod.Spec.Containers[0].Name)
+	if err != nil {
+		framework.Failf("failed to find the device of the volume in pod %s: %v, %s", pod.Name, err, stdErr)
+	}
+	if !strings.HasPrefix(stdout, "CRYPT-") {
+		framework.Failf("volume of pod %s is not a crypt device, dm uuid is %q", pod.Name, strings.TrimSpace(stdout))
+	}
+
+	if checksum != "" {
+		opt := &metav1.ListOptions{FieldSelector: "metadata.name=" + pod.Name}
+		got, err := calculateSHA512sum(f, pod, encryptedDataPath, opt)
+		if err != nil {
+			framework.Failf("failed to calculate checksum in pod %s: %v", pod.Name, err)
+		}
+		if got != checksum {
+			framework.Failf("data in pod %s does not match, checksum is %s, expected %s", pod.Name, got, checksum)
+		}
+	}
+
+	return images[0]
+}
+
+// validateRbdEncryptedVolume writes data to an encrypted volume and checks
+// that it can be read back after the volume was staged again, from a clone and
+// from a volume restored from a snapshot.
+func validateRbdEncryptedVolume(f *framework.Framework) {
+	By("create pvc and pod")
+	pvc, err := createPVC("manifest/rbd/file-rwo-pvc.yaml", f)
+	if err != nil {
+		framework.Failf("failed to create RBD pvc: %v", err)
+	}
+	pod, err := createPod("manifest/rbd/file-rwo-pod.yaml", deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+	images := []rbdImageRef{validateEncryptedRbdPod(f, pod, pvc, "")}
+
+	By("write data to the encrypted volume")
+	cmd := fmt.Sprintf("dd if=/dev/urandom of=%s bs=1M count=4 && sync", encryptedDataPath)
+	_, stdErr, err := execCommandInContainerByPodName(f, cmd, pod.Namespace, pod.Name, pod.Spec.Containers[0].Name)
+	if err != nil {
+		framework.Failf("failed to write data in pod %s: %v, %s", pod.Name, err, stdErr)
+	}
+	opt := &metav1.ListOptions{FieldSelector: "metadata.name=" + pod.Name}
+	checksum, err := calculateSHA512sum(f, pod, encryptedDataPath, opt)
+	if err != nil {
+		framework.Failf("failed to calculate checksum in pod %s: %v", pod.Name, err)
+	}
+
+	By("read the data after the volume is staged again")
+	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+	pod, err = createPod("manifest/rbd/file-rwo-pod.yaml", deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+	validateEncryptedRbdPod(f, pod, pvc, checksum)
+
+	By("create snapshot")
+	snap := getSnapshot("manifest/rbd/file-snapshot.yaml")
+	snap.Namespace = f.UniqueName
+	snap.Spec.Source.PersistentVolumeClaimName = &pvc.Name
+	err = createSnapshot(&snap, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to create snapshot: %v", err)
+	}
+	snapImage := validateRBDSnapshot(f, &snap, images[0])
+
+	By("read the data of the volume restored from the snapshot")
+	restorePVC, err := createPVC("manifest/rbd/file-pvc-restore.yaml", f)
+	if err != nil {
+		framework.Failf("failed to create RBD pvc: %v", err)
+	}
+	restorePod, err := createPod("manifest/rbd/file-pod-restore.yaml", deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+	images = append(images, validateEncryptedRbdPod(f, restorePod, restorePVC, checksum))
+
+	By("read the data of the clone")
+	clonePVC, err := createPVC("manifest/rbd/file-pvc-clone.yaml", f)
+	if err != nil {
+		framework.Failf("failed to create RBD pvc clone: %v", err)
+	}
+	clonePod, err := createPod("manifest/rbd/file-pod-clone.yaml", deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod clone: %v", err)
+	}
+	images = append(images, validateEncryptedRbdPod(f, clonePod, clonePVC, checksum))
+
+	By("delete snapshot")
+	if err := deleteSnapshot(&snap, deployTimeout); err != nil {
+		framework.Failf("failed to delete snapshot: %v", err)
+	}
+	validateRBDSnapshotDeleted(f, snapImage)
+
+	By("delete pods and pvcs")
+	for _, p := range []*v1.Pod{pod, restorePod, clonePod} {
+		if err := deletePod(p.Name, p.Namespace, f.ClientSet, deployTimeout); err != nil {
+			framework.Failf("failed to delete pod %s: %v", p.Name, err)
+		}
+	}
+	for _, claim := range []*v1.PersistentVolumeClaim{pvc, restorePVC, clonePVC} {
+		if err := deletePVCAndValidatePV(f.ClientSet, claim, deployTimeout); err != nil {
+			framework.Failf("failed to delete pvc %s: %v", claim.Name, err)
+		}
+	}
+
+	validateRBDImagesDeleted(f, images)
+}
+
+// hasTopology checks that the PV can only be used on nodes with the topology
+// value.
+func hasTopology(pv *v1.PersistentVolume, key, value string) bool {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return false
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == key && expr.Operator == v1.NodeSelectorOpIn && contains(expr.Values, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// validateRbdTopology provisions a volume for a pod in every zone and checks
+// that its image is created in the pool of the zone.
+func validateRbdTopology(pools []topologyPool, f *framework.Framework) {
+	for _, p := range pools {
+		By(fmt.Sprintf("provision a volume in zone %s", p.zone))
+		pvc, err := createPVC("manifest/rbd/file-rwo-pvc.yaml", f)
+		if err != nil {
+			framework.Failf("failed to create RBD pvc: %v", err)
+		}
+
+		params := manifestParams{NodeSelector: map[string]string{topologyZoneLabel: p.zone}}
+		pod, err := createPodWithParams("manifest/rbd/file-rwo-pod.yaml", params, deployTimeout, f)
+		if err != nil {
+			framework.Failf("failed to create pod in zone %s: %v", p.zone, err)
+		}
+
+		images := validateRBDImages(f, pvc)
+		if images[0].pool != p.pool {
+			framework.Failf("%s: image of a pod in zone %s is in pool %s, expected %s",
+				images[0], p.zone, images[0].pool, p.pool)
+		}
+		pv, err := getBoundPersistentVolume(f.ClientSet, pvc)
+		if err != nil {
+			framework.Failf("failed to get pv: %v", err)
+		}
+		if !hasTopology(pv, rbdTopologyZoneKey, p.zone) {
+			framework.Failf("PV %s has no node affinity for %s=%s: %v", pv.Name, rbdTopologyZoneKey, p.zone,
+				pv.Spec.NodeAffinity)
+		}
+
+		err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
+		if err != nil {
+			framework.Failf("failed to delete pod: %v", err)
+		}
+
+		err = deletePVCAndValidatePV(f.ClientSet, pvc, deployTimeout)
+		if err != nil {
+			framework.Failf("failed to delete pvc: %v", err)
+		}
+
+		validateRBDImagesDeleted(f, images)
+	}
+}
+
+// waitForRBDDriver waits until the rbd nodeplugin and provisioner rolled out.
+func waitForRBDDriver(f *framework.Framework) {
+	if err := waitForDaemonSets(rbdNodePluginDaemonSet, cephCSINamespace, f.ClientSet, deployTimeout); err != nil {
+		framework.Failf("timeout waiting for daemonset %s: %v", rbdNodePluginDaemonSet, err)
+	}
+	err := waitForDeploymentComplete(f.ClientSet, rbdProvisionerDeployment, cephCSINamespace, deployTimeout)
+	if err != nil {
+		framework.Failf("timeout waiting for deployment %s: %v", rbdProvisionerDeployment, err)
+	}
+}
+
+// validateRbdStaticPV checks that a pod can use a static PV of an rbd image
+// created outside of ceph-csi, and that deleting the PV, which has the Retain
+// reclaim policy, keeps the image.
+func validateRbdStaticPV(f *framework.Framework) {
+	name := staticVolumeNamePrefix + f.UniqueName
+	DeferCleanup(func() {
+		err := getCephBackend(f).DeleteImage(defaultRbdPool, name)
+		if err != nil && !errors.Is(err, errCephObjectNotFound) {
+			framework.Failf("failed to delete image %s: %v", name, err)
+		}
+	})
+	DeferCleanup(func() {
+		err := f.ClientSet.CoreV1().PersistentVolumes().Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			framework.Failf("failed to delete pv %s: %v", name, err)
+		}
+	})
+
+	pv, err := createStaticRBDPV(f, name)
+	if err != nil {
+		framework.Failf("failed to create static pv: %v", err)
+	}
+
+	pvc, err := createPVCForPV("manifest/rbd/file-rwo-pvc.yaml", pv, f)
+	if err != nil {
+		framework.Failf("failed to create pvc: %v", err)
+	}
+
+	app, err := createPod("manifest/rbd/file-rwo-pod.yaml", deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+
+	images := validateRBDImages(f, pvc)
+
+	err = writeToFileInContainer(f, app, "/var/lib/www/html/static-data")
+	if err != nil {
+		framework.Failf("failed to write to the static volume: %v", err)
+	}
+
+	err = deletePod(app.Name, app.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVC(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	err = deletePV(f.ClientSet, pv.Name, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pv: %v", err)
+	}
+
+	for _, ref := range images {
+		exists, err := rbdImageExists(f, ref.pool, ref.image)
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+		if !exists {
+			framework.Failf("%s: image deleted with its Retain PV", ref)
+		}
+	}
+}
+
+// validateRbdRetainPolicy checks the lifecycle of a volume provisioned with
+// the Retain reclaim policy: the PV is Released with its PVC and keeps the
+// image and the data, a new PVC can bind it once its claimRef is cleared, and
+// the image is only removed by hand.
+func validateRbdRetainPolicy(pvcPath, podPath string, f *framework.Framework) {
+	pvc, err := createPVC(pvcPath, f)
+	if err != nil {
+		framework.Failf("failed to create RBD pvc: %v", err)
+	}
+
+	app, err := createPod(podPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+
+	images := validateRBDImages(f, pvc)
+
+	pv, err := getBoundPersistentVolume(f.ClientSet, pvc)
+	if err != nil {
+		framework.Failf("failed to get pv: %v", err)
+	}
+	// the PV and the image are removed by hand at the end of the spec, this
+	// only cleans up after a failure.
+	DeferCleanup(func() {
+		err := f.ClientSet.CoreV1().PersistentVolumes().Delete(context.TODO(), pv.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			framework.Failf("failed to delete pv %s: %v", pv.Name, err)
+		}
+		if err = deleteRetainedRBDVolume(getCephBackend(f), pv); err != nil {
+			framework.Failf("failed to delete the image of pv %s: %v", pv.Name, err)
+		}
+	})
+
+	dataPath := "/var/lib/www/html/retain-data"
+	if err = writeToFileInContainer(f, app, dataPath); err != nil {
+		framework.Failf("failed to write to the volume: %v", err)
+	}
+	opt := &metav1.ListOptions{FieldSelector: "metadata.name=" + app.Name}
+	checkSum, err := calculateSHA512sum(f, app, dataPath, opt)
+	if err != nil {
+		framework.Failf("failed to calculate checksum: %v", err)
+	}
+
+	err = deletePod(app.Name, app.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVC(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	By("the PV is Released and the image is kept")
+	err = waitForPVPhase(f.ClientSet, pv.Name, v1.VolumeReleased, deployTimeout)
+	if err != nil {
+		framework.Failf("pv %s not released: %v", pv.Name, err)
+	}
+	for _, ref := range images {
+		exists, err := rbdImageExists(f, ref.pool, ref.image)
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+		if !exists {
+			framework.Failf("%s: image of the Retain PV deleted", ref)
+		}
+	}
+
+	By("rebind the PV to a new PVC")
+	err = clearPVClaimRef(f.ClientSet, pv.Name)
+	if err != nil {
+		framework.Failf("failed to rebind pv: %v", err)
+	}
+	pvc, err = createPVCForPV(pvcPath, pv, f)
+	if err != nil {
+		framework.Failf("failed to create pvc: %v", err)
+	}
+	app, err = createPod(podPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+	opt = &metav1.ListOptions{FieldSelector: "metadata.name=" + app.Name}
+	got, err := calculateSHA512sum(f, app, dataPath, opt)
+	if err != nil {
+		framework.Failf("failed to calculate checksum: %v", err)
+	}
+	if got != checkSum {
+		framework.Failf("checksum of %s changed from %s to %s", dataPath, checkSum, got)
+	}
+
+	err = deletePod(app.Name, app.Namespace, f.ClientSet, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pod: %v", err)
+	}
+
+	err = deletePVC(f.ClientSet, pvc, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pvc: %v", err)
+	}
+
+	By("delete the PV and the image by hand")
+	err = deletePV(f.ClientSet, pv.Name, deployTimeout)
+	if err != nil {
+		framework.Failf("failed to delete pv: %v", err)
+	}
+	for _, ref := range images {
+		exists, err := rbdImageExists(f, ref.pool, ref.image)
+		if err != nil {
+			framework.Failf("%s: %v", ref, err)
+		}
+		if !exists {
+			framework.Failf("%s: image of the Retain PV deleted", ref)
+		}
+	}
+	err = deleteRetainedRBDVolume(getCephBackend(f), pv)
+	if err != nil {
+		framework.Failf("failed to delete the image of pv %s: %v", pv.Name, err)
+	}
+
+	validateRBDImagesDeleted(f, images)
+}
+
+// validateRbdNodePluginRestart checks that a mounted volume stays usable when
+// the rbd nodeplugin pods are restarted.
+func validateRbdNodePluginRestart(pvcPath, podPath string, f *framework.Framework) {
+	pvc, err := createPVC(pvcPath, f)
+	if err != nil {
+		framework.Failf("failed to create RBD pvc: %v", err)
+	}
+
+	pod, err := createPod(podPath, deployTimeout, f)
+	if err != nil {
+		framework.Failf("failed to create pod: %v", err)
+	}
+
+	images := validateRBDImages(f, pvc)
 
-	By("validate volume size in pod after expansion")
-	validateTestVolumeSize(pod, 1800, f)
+	By("restart the nodeplugin")
+	err = validateNodePluginRestart(f, pod, "/var/lib/www/html", rbdNodePluginDaemonSet, rbdProvisionerDeployment)
+	if err != nil {
+		framework.Failf("failed to validate the volume after the nodeplugin restart: %v", err)
+	}
 
 	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
 	if err != nil {
@@ -305,7 +984,7 @@ func validateRbdVolumeExpansion(pvcPath, podPath string, f *framework.Framework)
 		framework.Failf("failed to delete pvc: %v", err)
 	}
 
-	validateRBDImageCount(f, 0, defaultRbdPool)
+	validateRBDImagesDeleted(f, images)
 }
 
 func validateEphemeralPV(podPath string, f *framework.Framework) {
@@ -314,12 +993,21 @@ func validateEphemeralPV(podPath string, f *framework.Framework) {
 		framework.Failf("failed to create pod: %v", err)
 	}
 
-	validateRBDImageCount(f, 1, defaultRbdPool)
+	images := validateRBDImagesInNamespace(f, 1)
 
 	err = deletePod(pod.Name, pod.Namespace, f.ClientSet, deployTimeout)
 	if err != nil {
 		framework.Failf("failed to delete pod: %v", err)
 	}
+
+	// the PVC is owned by the pod and garbage collected with it
+	for _, image := range images {
+		if err := waitForPVDeleted(f.ClientSet, image.pvName, deployTimeout); err != nil {
+			framework.Failf("PV %s of ephemeral volume not deleted: %v", image.pvName, err)
+		}
+	}
+
+	validateRBDImagesDeleted(f, images)
 }
 
 func validateStatefulset(sfsPath string, f *framework.Framework) {
@@ -328,7 +1016,7 @@ func validateStatefulset(sfsPath string, f *framework.Framework) {
 		framework.Failf("failed to create statefulset: %v", err)
 	}
 
-	validateRBDImageCount(f, 2, defaultRbdPool)
+	validateRBDImagesInNamespace(f, int(*sfs.Spec.Replicas))
 
 	err = deleteStatefulset(sfs.Name, sfs.Namespace, f.ClientSet, deployTimeout)
 	if err != nil {
@@ -342,7 +1030,7 @@ func validateVolumeMetricsCollection(deployPath string, f *framework.Framework)
 		framework.Failf("failed to create deployment: %v", err)
 	}
 
-	validateRBDImageCount(f, 2, defaultRbdPool)
+	validateRBDImagesInNamespace(f, int(*deploy.Spec.Replicas))
 
 	validateVolumeMetrics(deploy, deployTimeout, f)
 
@@ -352,6 +1040,21 @@ func validateVolumeMetricsCollection(deployPath string, f *framework.Framework)
 	}
 }
 
+// useRbdStorageClass creates the default rbd storage class with the params
+// for the current spec.
+func useRbdStorageClass(params storageClassParams, f *framework.Framework) {
+	if err := createRBDStorageClass(f.ClientSet, f,
+		defaultRbdSc, params.options, params.parameters, deletePolicy); err != nil {
+		framework.Failf("failed to create storageclass %s with %s: %v", defaultRbdSc, params, err)
+	}
+	DeferCleanup(func() {
+		if err := deleteStorageClass(f.ClientSet, defaultRbdSc); err != nil {
+			framework.Failf("failed to delete storageclass %s: %v", defaultRbdSc, err)
+		}
+		waitForPvDeleted(deployTimeout, f)
+	})
+}
+
 var _ = Describe("Rbd", func() {
 	f := framework.NewDefaultFramework(rbdType)
 	f.NamespacePodSecurityEnforceLevel = api.LevelPrivileged
@@ -390,43 +1093,45 @@ var _ = Describe("Rbd", func() {
 				"manifest/rbd/file-rwo-pod.yaml", f)
 		})
 
-		It("should be able to provision File mode RWO volume from another volume", Label("rbd", "clone", "file"), func() {
-			validateRbdVolumeClone(
-				"manifest/rbd/file-rwo-pvc.yaml",
-				"manifest/rbd/file-rwo-pod.yaml",
-				"manifest/rbd/file-pvc-clone.yaml",
-				"manifest/rbd/file-pod-clone.yaml", f)
-		})
-
-		It("should be able to provision Block mode RWO volume from another volume", Label("rbd", "clone", "block"), func() {
-			validateRbdVolumeClone(
-				"manifest/rbd/block-rwo-pvc.yaml",
-				"manifest/rbd/block-rwo-pod.yaml",
-				"manifest/rbd/block-pvc-clone.yaml",
-				"manifest/rbd/block-pod-clone.yaml", f)
-		})
-
-		It("should be able to create ephemeral File mode volume", Label("rbd", "ephemeral", "file"), func() {
+		It("should be able to provision File mode RWO volume from another volume",
+			Label("rbd", "clone", "rwo", "file"), func() {
+				validateRbdVolumeClone(
+					"manifest/rbd/file-rwo-pvc.yaml",
+					"manifest/rbd/file-rwo-pod.yaml",
+					"manifest/rbd/file-pvc-clone.yaml",
+					"manifest/rbd/file-pod-clone.yaml", f)
+			})
+
+		It("should be able to provision Block mode RWO volume from another volume",
+			Label("rbd", "clone", "rwo", "block"), func() {
+				validateRbdVolumeClone(
+					"manifest/rbd/block-rwo-pvc.yaml",
+					"manifest/rbd/block-rwo-pod.yaml",
+					"manifest/rbd/block-pvc-clone.yaml",
+					"manifest/rbd/block-pod-clone.yaml", f)
+			})
+
+		It("should be able to create ephemeral File mode volume", Label("rbd", "ephemeral", "rwo", "file"), func() {
 			validateEphemeralPV("manifest/rbd/file-pod-ephemeral.yaml", f)
 		})
 
-		It("should be able to create ephemeral Block mode volume", Label("rbd", "ephemeral", "block"), func() {
+		It("should be able to create ephemeral Block mode volume", Label("rbd", "ephemeral", "rwo", "block"), func() {
 			validateEphemeralPV("manifest/rbd/block-pod-ephemeral.yaml", f)
 		})
 
-		It("should be able to create statefulset w/ File mode volume", Label("rbd", "statefulset", "file"), func() {
+		It("should be able to create statefulset w/ File mode volume", Label("rbd", "statefulset", "rwo", "file"), func() {
 			validateStatefulset("manifest/rbd/file-statefulset.yaml", f)
 		})
 
-		It("should be able to create statefulset w/ Block mode volume", Label("rbd", "statefulset", "block"), func() {
+		It("should be able to create statefulset w/ Block mode volume", Label("rbd", "statefulset", "rwo", "block"), func() {
 			validateStatefulset("manifest/rbd/block-statefulset.yaml", f)
 		})
 
-		It("should be able to collect metrics of Block mode volume", Label("rbd", "metrics", "block"), func() {
+		It("should be able to collect metrics of Block mode volume", Label("rbd", "metrics", "rwo", "block"), func() {
 			validateVolumeMetricsCollection("manifest/rbd/block-deploy.yaml", f)
 		})
 
-		It("should be able to collect metrics of File mode volume", Label("rbd", "metrics", "file"), func() {
+		It("should be able to collect metrics of File mode volume", Label("rbd", "metrics", "rwo", "file"), func() {
 			validateVolumeMetricsCollection("manifest/rbd/file-deploy.yaml", f)
 		})
 
@@ -465,7 +1170,7 @@ var _ = Describe("Rbd", func() {
 			waitForPvDeleted(deployTimeout, f)
 		})
 
-		It("should be able to provision File volume from snapshot", Label("rbd", "snapshot", "file"), func() {
+		It("should be able to provision File volume from snapshot", Label("rbd", "snapshot", "rwo", "file"), func() {
 			createRbdVolumeFromSnapshot(
 				"manifest/rbd/file-rwo-pvc.yaml",
 				"manifest/rbd/file-rwo-pod.yaml",
@@ -474,7 +1179,7 @@ var _ = Describe("Rbd", func() {
 				"manifest/rbd/file-pod-restore.yaml", f)
 		})
 
-		It("should be able to provision Block volume from snapshot", Label("rbd", "snapshot", "block"), func() {
+		It("should be able to provision Block volume from snapshot", Label("rbd", "snapshot", "rwo", "block"), func() {
 			createRbdVolumeFromSnapshot(
 				"manifest/rbd/block-rwo-pvc.yaml",
 				"manifest/rbd/block-rwo-pod.yaml",
@@ -499,17 +1204,308 @@ var _ = Describe("Rbd", func() {
 			waitForPvDeleted(deployTimeout, f)
 		})
 
-		It("should be able to expand volume", Label("rbd", "expansion", "file"), func() {
-			validateRbdVolumeExpansion(
-				"manifest/rbd/file-rwo-pvc.yaml",
-				"manifest/rbd/file-rwo-pod.yaml", f)
+		for _, exp := range volumeExpansions {
+			exp := exp
+			It(fmt.Sprintf("should be able to expand File mode volume %s to %s", exp.mode, exp.size),
+				Label("rbd", "expansion", "rwo", "file"), func() {
+					validateRbdVolumeExpansion(
+						"manifest/rbd/file-rwo-pvc.yaml",
+						"manifest/rbd/file-rwo-pod.yaml",
+						resource.MustParse(exp.size), exp.mode, f)
+				})
+
+			It(fmt.Sprintf("should be able to expand Block mode volume %s to %s", exp.mode, exp.size),
+				Label("rbd", "expansion", "rwo", "block"), func() {
+					validateRbdVolumeExpansion(
+						"manifest/rbd/block-rwo-pvc.yaml",
+						"manifest/rbd/block-rwo-pod.yaml",
+						resource.MustParse(exp.size), exp.mode, f)
+				})
+		}
+
+		It("should reject shrinking volume", Label("rbd", "expansion", "rwo", "file"), func() {
+			validateRbdExpansionRejected("manifest/rbd/file-rwo-pvc.yaml", resource.MustParse("512Mi"), f)
 		})
 
-		It("should be able to expand volume", Label("rbd", "expansion", "block"), func() {
-			validateRbdVolumeExpansion(
-				"manifest/rbd/block-rwo-pvc.yaml",
-				"manifest/rbd/block-rwo-pod.yaml", f)
+		It("should reject expanding volume of a storage class without allowVolumeExpansion",
+			Label("rbd", "expansion", "rwo", "file"), func() {
+				if err := setAllowVolumeExpansion(f.ClientSet, defaultRbdSc, false); err != nil {
+					framework.Failf("%v", err)
+				}
+				validateRbdExpansionRejected("manifest/rbd/file-rwo-pvc.yaml", resource.MustParse("2Gi"), f)
+			})
+	})
+
+	Context("[GA]", Label("encryption"), func() {
+		for _, kms := range encryptionKMSes {
+			kms := kms
+			Context("with the "+kms.name+" KMS", func() {
+				BeforeEach(func() {
+					_, err := f.DynamicClient.Resource(schema.GroupVersionResource{
+						Group:    "apiextensions.k8s.io",
+						Version:  "v1",
+						Resource: "customresourcedefinitions",
+					}).Get(context.Background(),
+						"volumesnapshotclasses.snapshot.storage.k8s.io", metav1.GetOptions{})
+					if err != nil {
+						framework.Logf("Get volumesnapshotclasses error due to %v", err)
+						Skip("Skip encryption cases")
+					}
+					if err := createEncryptionKMS(f.ClientSet, kms); err != nil {
+						framework.Failf("failed to create %s KMS: %v", kms.name, err)
+					}
+					if err := createRBDStorageClass(f.ClientSet, f,
+						defaultRbdSc, nil, kms.storageClassParameters(), deletePolicy); err != nil {
+						framework.Failf("failed to create storageclass %s: %v", defaultRbdSc, err)
+					}
+					if err := createRBDSnapshotClassWithSecret(f, kms.provisionerSecretName()); err != nil {
+						framework.Failf("failed to create snapshotclass csi-rbdplugin-snapclass: %v", err)
+					}
+				})
+
+				AfterEach(func() {
+					if err := deleteStorageClass(f.ClientSet, defaultRbdSc); err != nil {
+						framework.Failf("failed to delete storageclass %s: %v", defaultRbdSc, err)
+					}
+					if err := deleteRBDSnapshotClass(); err != nil {
+						framework.Failf("failed to delete snapshotclass csi-rbdplugin-snapclass: %v", err)
+					}
+					waitForPvDeleted(deployTimeout, f)
+					if err := deleteEncryptionKMS(f.ClientSet, kms); err != nil {
+						framework.Failf("failed to delete %s KMS: %v", kms.name, err)
+					}
+				})
+
+				It("should be able to use encrypted File mode volume", Label("rbd", "encryption", "rwo", "file"), func() {
+					validateRbdEncryptedVolume(f)
+				})
+			})
+		}
+	})
+
+	Context("[Alpha]", func() {
+		BeforeEach(func() {
+			if err := createRBDStorageClass(f.ClientSet, f,
+				defaultRbdSc, nil, nil, deletePolicy); err != nil {
+				framework.Failf("failed to create storageclass %s: %v", defaultRbdSc, err)
+			}
+		})
+
+		AfterEach(func() {
+			if err := deleteStorageClass(f.ClientSet, defaultRbdSc); err != nil {
+				framework.Failf("failed to delete storageclass %s: %v", defaultRbdSc, err)
+			}
+			waitForPvDeleted(deployTimeout, f)
+		})
+
+		It("should be able to provision File mode RWOP volume", Label("rbd", "rwop", "file"), func() {
+			validateRbdRwopVolume(
+				"manifest/rbd/file-rwop-pvc.yaml",
+				"manifest/rbd/file-rwop-pod.yaml", f)
+		})
+
+		It("should be able to provision Block mode RWOP volume", Label("rbd", "rwop", "block"), func() {
+			validateRbdRwopVolume(
+				"manifest/rbd/block-rwop-pvc.yaml",
+				"manifest/rbd/block-rwop-pod.yaml", f)
 		})
 	})
 
+	Context("[Alpha]", Label("topology"), func() {
+		var pools []topologyPool
+
+		// the changes to the nodes and the driver are undone in reverse
+		// order by DeferCleanup, the driver is restored before the labels
+		// it publishes.
+		BeforeEach(func() {
+			var err error
+			pools, err = parseTopologyPools(rbdTopologyPools)
+			if err != nil {
+				framework.Failf("invalid topology pools: %v", err)
+			}
+			if len(pools) == 0 {
+				Skip("Skip topology cases, no topology pools are configured")
+			}
+			nodes, err := e2enode.GetReadySchedulableNodes(context.TODO(), f.ClientSet)
+			if err != nil {
+				framework.Failf("failed to list nodes: %v", err)
+			}
+			if len(nodes.Items) < len(pools) {
+				Skip(fmt.Sprintf("Skip topology cases, %d zones need at least as many nodes, found %d",
+					len(pools), len(nodes.Items)))
+			}
+
+			savedLabels := saveNodeLabels(nodes.Items, topologyZoneLabel, rbdTopologyZoneKey)
+			DeferCleanup(func() {
+				if err := restoreNodeLabels(f.ClientSet, savedLabels); err != nil {
+					framework.Failf("failed to restore node labels: %v", err)
+				}
+			})
+			zones, err := assignZones(f.ClientSet, nodes.Items, pools)
+			if err != nil {
+				framework.Failf("failed to label nodes: %v", err)
+			}
+			framework.Logf("zones of the nodes: %v", zones)
+
+			savedArgs, err := enableRBDTopology(f.ClientSet, topologyZoneLabel)
+			if savedArgs != nil {
+				DeferCleanup(func() {
+					if err := restoreRBDDriverArgs(f.ClientSet, savedArgs); err != nil {
+						framework.Failf("failed to restore the rbd driver: %v", err)
+					}
+					waitForRBDDriver(f)
+				})
+			}
+			if err != nil {
+				framework.Failf("failed to enable topology: %v", err)
+			}
+			waitForRBDDriver(f)
+
+			param, err := topologyConstrainedPools(pools)
+			if err != nil {
+				framework.Failf("failed to build topologyConstrainedPools: %v", err)
+			}
+			if err := createRBDStorageClass(f.ClientSet, f, defaultRbdSc,
+				map[string]string{"volumeBindingMode": "WaitForFirstConsumer"},
+				map[string]string{"topologyConstrainedPools": param}, deletePolicy); err != nil {
+				framework.Failf("failed to create storageclass %s: %v", defaultRbdSc, err)
+			}
+			DeferCleanup(func() {
+				if err := deleteStorageClass(f.ClientSet, defaultRbdSc); err != nil {
+					framework.Failf("failed to delete storageclass %s: %v", defaultRbdSc, err)
+				}
+				waitForPvDeleted(deployTimeout, f)
+			})
+		})
+
+		It("should provision volumes in the pool of the zone of the node", Label("rbd", "topology", "rwo", "file"), func() {
+			validateRbdTopology(pools, f)
+		})
+	})
+
+	// the krbd mappings outlive the nodeplugin, the rbd-nbd processes run in
+	// the nodeplugin and the volume healer has to map the images again.
+	for _, m := range []struct {
+		maturity string
+		mounter  string
+		param    string
+	}{
+		{maturity: "[GA]", mounter: "krbd", param: ""},
+		{maturity: "[Alpha]", mounter: "rbd-nbd", param: "rbd-nbd"},
+	} {
+		m := m
+		Context(m.maturity, Label("restart"), func() {
+			BeforeEach(func() {
+				if err := createRBDStorageClass(f.ClientSet, f,
+					defaultRbdSc, nil, map[string]string{"mounter": m.param}, deletePolicy); err != nil {
+					framework.Failf("failed to create storageclass %s: %v", defaultRbdSc, err)
+				}
+			})
+
+			AfterEach(func() {
+				if err := deleteStorageClass(f.ClientSet, defaultRbdSc); err != nil {
+					framework.Failf("failed to delete storageclass %s: %v", defaultRbdSc, err)
+				}
+				waitForPvDeleted(deployTimeout, f)
+			})
+
+			It("should keep File mode volume mapped with "+m.mounter+" usable after a nodeplugin restart",
+				Label("rbd", "restart", "rwo", "file"), func() {
+					validateRbdNodePluginRestart(
+						"manifest/rbd/file-rwo-pvc.yaml",
+						"manifest/rbd/file-rwo-pod.yaml", f)
+				})
+		})
+	}
+
+	Context("[GA]", Label("static"), func() {
+		It("should be able to use static File mode volume and keep the image after the PV is deleted",
+			Label("rbd", "static", "rwo", "file"), func() {
+				validateRbdStaticPV(f)
+			})
+	})
+
+	Context("[GA]", Label("retain"), func() {
+		BeforeEach(func() {
+			if err := createRBDStorageClass(f.ClientSet, f,
+				defaultRbdSc, nil, nil, retainPolicy); err != nil {
+				framework.Failf("failed to create storageclass %s: %v", defaultRbdSc, err)
+			}
+		})
+
+		AfterEach(func() {
+			if err := deleteStorageClass(f.ClientSet, defaultRbdSc); err != nil {
+				framework.Failf("failed to delete storageclass %s: %v", defaultRbdSc, err)
+			}
+		})
+
+		It("should keep and rebind File mode volume with the Retain reclaim policy",
+			Label("rbd", "retain", "rwo", "file"), func() {
+				validateRbdRetainPolicy(
+					"manifest/rbd/file-rwo-pvc.yaml",
+					"manifest/rbd/file-rwo-pod.yaml", f)
+			})
+	})
+
+	// the core flows run once for each parameter set of the matrix, on File
+	// mode volumes, as the parameters are about the filesystem and the
+	// mapping of the image.
+	Context("[Beta]", Label("matrix"), func() {
+		DescribeTable("should be able to provision File mode RWO volume with",
+			Label("rbd", "matrix", "rwo", "file"), func(params storageClassParams) {
+				useRbdStorageClass(params, f)
+				validateRbdRwoVolume(
+					"manifest/rbd/file-rwo-pvc.yaml",
+					"manifest/rbd/file-rwo-pod.yaml", f)
+			}, storageClassEntries(rbdStorageClassMatrix))
+
+		DescribeTable("should be able to provision File mode RWO volume from another volume with",
+			Label("rbd", "matrix", "rwo", "file"), func(params storageClassParams) {
+				useRbdStorageClass(params, f)
+				validateRbdVolumeClone(
+					"manifest/rbd/file-rwo-pvc.yaml",
+					"manifest/rbd/file-rwo-pod.yaml",
+					"manifest/rbd/file-pvc-clone.yaml",
+					"manifest/rbd/file-pod-clone.yaml", f)
+			}, storageClassEntries(rbdStorageClassMatrix))
+
+		DescribeTable("should be able to provision File volume from snapshot with",
+			Label("rbd", "matrix", "rwo", "file"), func(params storageClassParams) {
+				_, err := f.DynamicClient.Resource(schema.GroupVersionResource{
+					Group:    "apiextensions.k8s.io",
+					Version:  "v1",
+					Resource: "customresourcedefinitions",
+				}).Get(context.Background(),
+					"volumesnapshotclasses.snapshot.storage.k8s.io", metav1.GetOptions{})
+				if err != nil {
+					framework.Logf("Get volumesnapshotclasses error due to %v", err)
+					Skip("Skip snapshot cases")
+				}
+				useRbdStorageClass(params, f)
+				if err := createRBDSnapshotClass(f); err != nil {
+					framework.Failf("failed to create snapshotclass csi-rbdplugin-snapclass: %v", err)
+				}
+				DeferCleanup(func() {
+					if err := deleteRBDSnapshotClass(); err != nil {
+						framework.Failf("failed to delete snapshotclass csi-rbdplugin-snapclass: %v", err)
+					}
+				})
+
+				createRbdVolumeFromSnapshot(
+					"manifest/rbd/file-rwo-pvc.yaml",
+					"manifest/rbd/file-rwo-pod.yaml",
+					"manifest/rbd/file-snapshot.yaml",
+					"manifest/rbd/file-pvc-restore.yaml",
+					"manifest/rbd/file-pod-restore.yaml", f)
+			}, storageClassEntries(rbdStorageClassMatrix))
+
+		DescribeTable("should be able to expand File mode volume online to 2Gi with",
+			Label("rbd", "matrix", "rwo", "file"), func(params storageClassParams) {
+				useRbdStorageClass(params, f)
+				validateRbdVolumeExpansion(
+					"manifest/rbd/file-rwo-pvc.yaml",
+					"manifest/rbd/file-rwo-pod.yaml",
+					resource.MustParse("2Gi"), onlineExpansion, f)
+			}, storageClassEntries(rbdStorageClassMatrix))
+	})
 })
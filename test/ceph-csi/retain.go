@@ -0,0 +1,82 @@
+package ceph_csi
+
+import (
+	"errors"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// ignoreNotFound drops errCephObjectNotFound, so a retained volume that was
+// partly removed already can be removed again.
+func ignoreNotFound(err error) error {
+	if errors.Is(err, errCephObjectNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// deleteRetainedRBDVolume removes the rbd image of a PV with the Retain
+// reclaim policy after the PV was deleted, together with the omap entries
+// ceph-csi keeps for the volume, like ceph-csi would have with the Delete
+// reclaim policy. Missing parts are skipped.
+func deleteRetainedRBDVolume(backend CephBackend, pv *v1.PersistentVolume) error {
+	ref, err := getRBDImageRef(pv)
+	if err != nil {
+		return err
+	}
+	uuid, err := uuidFromHandle(pv.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return err
+	}
+
+	if err = ignoreNotFound(backend.DeleteImage(ref.pool, ref.image)); err != nil {
+		return fmt.Errorf("%s: %w", ref, err)
+	}
+
+	return deleteVolumeOmap(backend, ref.pool, radosNamespace, pv.Name, uuid)
+}
+
+// deleteRetainedCephFSVolume removes the subvolume of a PV with the Retain
+// reclaim policy after the PV was deleted, together with the omap entries
+// ceph-csi keeps for the volume in the metadata pool of the filesystem.
+// Missing parts are skipped.
+func deleteRetainedCephFSVolume(backend CephBackend, pv *v1.PersistentVolume) error {
+	ref, err := getCephFSSubVolumeRef(pv)
+	if err != nil {
+		return err
+	}
+	uuid, err := uuidFromHandle(pv.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return err
+	}
+
+	err = ignoreNotFound(backend.DeleteSubVolume(ref.fsName, ref.group, ref.subVolume))
+	if err != nil {
+		return fmt.Errorf("%s: %w", ref, err)
+	}
+
+	filesystems, err := backend.ListFilesystems()
+	if err != nil {
+		return err
+	}
+	for _, fs := range filesystems {
+		if fs.Name == ref.fsName {
+			return deleteVolumeOmap(backend, fs.MetadataPool, cephfsRadosNamespace, pv.Name, uuid)
+		}
+	}
+
+	return fmt.Errorf("%s: filesystem not found", ref)
+}
+
+// deleteVolumeOmap removes the request name of the PV from the volumes
+// directory and the object with the attributes of the volume.
+func deleteVolumeOmap(backend CephBackend, pool, namespace, pvName, uuid string) error {
+	err := ignoreNotFound(backend.RemoveOmapKey(pool, namespace, csiVolumesDirectory, csiVolumeOmapPrefix+pvName))
+	if err != nil {
+		return err
+	}
+
+	return ignoreNotFound(backend.RemoveObject(pool, namespace, csiVolumeOmapPrefix+uuid))
+}
@@ -0,0 +1,140 @@
+package ceph_csi
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeVolumeHandle is the volume handle of fakeVolume.
+const fakeVolumeHandle = "0001-0009-rook-ceph-0000000000000004-" + fakeVolumeUUID
+
+// failingRemovalBackend fails the removal of an image, a subvolume or an omap
+// key with the error set for it.
+type failingRemovalBackend struct {
+	*fakeCephBackend
+	deleteImageErr     error
+	deleteSubVolumeErr error
+	removeOmapKeyErr   error
+}
+
+func (b *failingRemovalBackend) DeleteImage(pool, image string) error {
+	if b.deleteImageErr != nil {
+		return b.deleteImageErr
+	}
+
+	return b.fakeCephBackend.DeleteImage(pool, image)
+}
+
+func (b *failingRemovalBackend) DeleteSubVolume(fsName, group, subVolume string) error {
+	if b.deleteSubVolumeErr != nil {
+		return b.deleteSubVolumeErr
+	}
+
+	return b.fakeCephBackend.DeleteSubVolume(fsName, group, subVolume)
+}
+
+func (b *failingRemovalBackend) RemoveOmapKey(pool, namespace, object, key string) error {
+	if b.removeOmapKeyErr != nil {
+		return b.removeOmapKeyErr
+	}
+
+	return b.fakeCephBackend.RemoveOmapKey(pool, namespace, object, key)
+}
+
+var _ = Describe("Retained volumes", Label("unit"), func() {
+	var backend *fakeCephBackend
+
+	BeforeEach(func() {
+		backend = newFakeCephCluster()
+	})
+
+	It("should remove the rbd image and its omap entries", func() {
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: fakeVolume})
+		backend.setOmapKeys(defaultRbdPool, radosNamespace, csiVolumesDirectory,
+			csiVolumeOmapPrefix+"pvc-1", csiVolumeOmapPrefix+"pvc-2")
+		backend.setOmapKeys(defaultRbdPool, radosNamespace, csiVolumeOmapPrefix+fakeVolumeUUID, "csi.imagename")
+		pv := newCSIPersistentVolume("pvc-1", fakeVolumeHandle, nil)
+
+		Expect(deleteRetainedRBDVolume(backend, pv)).To(Succeed())
+		Expect(backend.ListImages(defaultRbdPool)).To(BeEmpty())
+		Expect(backend.ListOmapKeys(defaultRbdPool, radosNamespace, csiVolumesDirectory)).To(
+			ConsistOf(csiVolumeOmapPrefix + "pvc-2"))
+		Expect(backend.ListOmapKeys(defaultRbdPool, radosNamespace, csiVolumeOmapPrefix+fakeVolumeUUID)).To(BeEmpty())
+
+		Expect(deleteRetainedRBDVolume(backend, pv)).To(Succeed())
+	})
+
+	It("should remove the omap entries of an rbd image that is already gone", func() {
+		backend.setOmapKeys(defaultRbdPool, radosNamespace, csiVolumesDirectory, csiVolumeOmapPrefix+"pvc-1")
+		pv := newCSIPersistentVolume("pvc-1", fakeVolumeHandle, nil)
+
+		Expect(deleteRetainedRBDVolume(backend, pv)).To(Succeed())
+		Expect(backend.ListOmapKeys(defaultRbdPool, radosNamespace, csiVolumesDirectory)).To(BeEmpty())
+	})
+
+	It("should remove the subvolume and its omap entries in the metadata pool", func() {
+		backend.addSubVolume(defaultFileSystemName, defaultSubvolumegroup, fakeVolume, cephfsSubVolumeInfo{})
+		backend.setOmapKeys(fakeMetaPool, cephfsRadosNamespace, csiVolumesDirectory, csiVolumeOmapPrefix+"pvc-1")
+		backend.setOmapKeys(fakeMetaPool, cephfsRadosNamespace, csiVolumeOmapPrefix+fakeVolumeUUID, "csi.volname")
+		pv := newCSIPersistentVolume("pvc-1", fakeVolumeHandle, nil)
+
+		Expect(deleteRetainedCephFSVolume(backend, pv)).To(Succeed())
+		Expect(backend.ListSubVolumes(defaultFileSystemName, defaultSubvolumegroup)).To(BeEmpty())
+		Expect(backend.ListOmapKeys(fakeMetaPool, cephfsRadosNamespace, csiVolumesDirectory)).To(BeEmpty())
+		Expect(backend.ListOmapKeys(fakeMetaPool, cephfsRadosNamespace, csiVolumeOmapPrefix+fakeVolumeUUID)).
+			To(BeEmpty())
+
+		Expect(deleteRetainedCephFSVolume(backend, pv)).To(Succeed())
+	})
+
+	It("should keep the omap entries when the rbd image can not be removed", func() {
+		backend.addImage(defaultRbdPool, rbdImageInfo{Name: fakeVolume})
+		backend.setOmapKeys(defaultRbdPool, radosNamespace, csiVolumesDirectory, csiVolumeOmapPrefix+"pvc-1")
+		failing := &failingRemovalBackend{fakeCephBackend: backend, deleteImageErr: errors.New("image has watchers")}
+		pv := newCSIPersistentVolume("pvc-1", fakeVolumeHandle, nil)
+
+		err := deleteRetainedRBDVolume(failing, pv)
+		Expect(err).To(MatchError(ContainSubstring("image has watchers")))
+		Expect(backend.ListOmapKeys(defaultRbdPool, radosNamespace, csiVolumesDirectory)).To(
+			ConsistOf(csiVolumeOmapPrefix + "pvc-1"))
+	})
+
+	It("should keep the omap entries when the subvolume can not be removed", func() {
+		backend.addSubVolume(defaultFileSystemName, defaultSubvolumegroup, fakeVolume, cephfsSubVolumeInfo{})
+		backend.setOmapKeys(fakeMetaPool, cephfsRadosNamespace, csiVolumesDirectory, csiVolumeOmapPrefix+"pvc-1")
+		failing := &failingRemovalBackend{
+			fakeCephBackend:    backend,
+			deleteSubVolumeErr: errors.New("subvolume has pending clones"),
+		}
+		pv := newCSIPersistentVolume("pvc-1", fakeVolumeHandle, nil)
+
+		err := deleteRetainedCephFSVolume(failing, pv)
+		Expect(err).To(MatchError(ContainSubstring("subvolume has pending clones")))
+		Expect(backend.ListOmapKeys(fakeMetaPool, cephfsRadosNamespace, csiVolumesDirectory)).To(
+			ConsistOf(csiVolumeOmapPrefix + "pvc-1"))
+	})
+
+	It("should fail when the omap entries can not be removed", func() {
+		backend.setOmapKeys(defaultRbdPool, radosNamespace, csiVolumesDirectory, csiVolumeOmapPrefix+"pvc-1")
+		failing := &failingRemovalBackend{fakeCephBackend: backend, removeOmapKeyErr: errors.New("permission denied")}
+		pv := newCSIPersistentVolume("pvc-1", fakeVolumeHandle, nil)
+
+		Expect(deleteRetainedRBDVolume(failing, pv)).To(MatchError(ContainSubstring("permission denied")))
+	})
+
+	It("should fail when the filesystem of the subvolume is missing", func() {
+		pv := newCSIPersistentVolume("pvc-1", fakeVolumeHandle, nil)
+
+		err := deleteRetainedCephFSVolume(newFakeCephBackend(fakeFSID), pv)
+		Expect(err).To(MatchError(ContainSubstring("filesystem not found")))
+	})
+
+	It("should reject a volume handle without uuid", func() {
+		pv := newCSIPersistentVolume("pvc-1", "static-volume", nil)
+
+		Expect(deleteRetainedRBDVolume(backend, pv)).ShouldNot(Succeed())
+		Expect(deleteRetainedCephFSVolume(backend, pv)).ShouldNot(Succeed())
+	})
+})
@@ -22,9 +22,31 @@ func getSnapshotClass(path string) snapapi.VolumeSnapshotClass {
 	return sc
 }
 
+// setSnapshotClassParameters points the snapshot class at the configured
+// driver, secret and clusterID.
+func setSnapshotClassParameters(sc *snapapi.VolumeSnapshotClass, driver, secretName string) {
+	sc.Driver = driver
+	sc.Parameters["csi.storage.k8s.io/snapshotter-secret-name"] = secretName
+	sc.Parameters["csi.storage.k8s.io/snapshotter-secret-namespace"] = cephCSISecretNamespace
+	if cephCSIClusterID != "" {
+		sc.Parameters["clusterID"] = cephCSIClusterID
+	}
+}
+
 func createRBDSnapshotClass(f *framework.Framework) error {
+	return createRBDSnapshotClassWithSecret(f, rbdProvisionerSecretName)
+}
+
+// createRBDSnapshotClassWithSecret creates the rbd snapshot class with
+// another snapshotter secret, e.g. one that carries an encryption passphrase.
+func createRBDSnapshotClassWithSecret(f *framework.Framework, secretName string) error {
 	scPath := "manifest/rbd/snapshotclass.yaml"
 	sc := getSnapshotClass(scPath)
+	driver, err := getRBDDriverName(f.ClientSet)
+	if err != nil {
+		return err
+	}
+	setSnapshotClassParameters(&sc, driver, secretName)
 
 	sclient, err := newSnapshotClient()
 	if err != nil {
@@ -161,6 +183,11 @@ func deleteSnapshot(snap *snapapi.VolumeSnapshot, t int) error {
 func createCephfsSnapshotClass(f *framework.Framework) error {
 	scPath := "manifest/cephfs/snapshotclass.yaml"
 	sc := getSnapshotClass(scPath)
+	driver, err := getCephFSDriverName(f.ClientSet)
+	if err != nil {
+		return err
+	}
+	setSnapshotClassParameters(&sc, driver, cephFSProvisionerSecretName)
 
 	sclient, err := newSnapshotClient()
 	if err != nil {
@@ -185,3 +212,29 @@ func deleteCephfsSnapshotClass() error {
 
 	return sclient.VolumeSnapshotClasses().Delete(context.TODO(), sc.Name, metav1.DeleteOptions{})
 }
+
+// getVolumeSnapshotContent returns the VolumeSnapshotContent bound to the
+// snapshot.
+func getVolumeSnapshotContent(snap *snapapi.VolumeSnapshot) (*snapapi.VolumeSnapshotContent, error) {
+	sclient, err := newSnapshotClient()
+	if err != nil {
+		return nil, err
+	}
+
+	vs, err := sclient.
+		VolumeSnapshots(snap.Namespace).
+		Get(context.TODO(), snap.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volumesnapshot %s/%s: %w", snap.Namespace, snap.Name, err)
+	}
+	if vs.Status == nil || vs.Status.BoundVolumeSnapshotContentName == nil {
+		return nil, fmt.Errorf("volumesnapshot %s/%s is not bound", snap.Namespace, snap.Name)
+	}
+
+	vsc, err := sclient.VolumeSnapshotContents().Get(context.TODO(), *vs.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volumesnapshotcontent %s: %w", *vs.Status.BoundVolumeSnapshotContentName, err)
+	}
+
+	return vsc, nil
+}
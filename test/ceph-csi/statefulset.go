@@ -15,8 +15,14 @@ import (
 )
 
 func createStatefulset(path string, timeout int, f *framework.Framework) (*v1.StatefulSet, error) {
+	return createStatefulsetWithParams(path, manifestParams{}, timeout, f)
+}
+
+// createStatefulsetWithParams renders the statefulset manifest with the
+// params, e.g. another number of replicas, and creates it.
+func createStatefulsetWithParams(path string, params manifestParams, timeout int, f *framework.Framework) (*v1.StatefulSet, error) {
 	app := &v1.StatefulSet{}
-	if err := unmarshal(path, app); err != nil {
+	if err := unmarshalManifest(path, params, app); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,166 @@
+package ceph_csi
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+const (
+	// staticVolumeNamePrefix is the prefix of the rbd images and cephfs
+	// subvolumes the static specs create, it differs from the ceph-csi
+	// prefixes so the orphan detection ignores them.
+	staticVolumeNamePrefix = "ceph-csi-test-static-"
+
+	// staticVolumeSize is the size of the static volumes, it matches the
+	// default size of the PVC manifests.
+	staticVolumeSize = 1 << 30
+
+	// staticSecretSuffix is appended to the name of the copy of the cephfs
+	// nodeplugin secret that static volumes are staged with.
+	staticSecretSuffix = "-static"
+)
+
+// cephFSStaticNodePluginSecretName returns the secret static cephfs volumes are
+// staged with. ceph-csi stages them with the userID and userKey of the
+// secret, where the nodeplugin secret only has adminID and adminKey.
+func cephFSStaticNodePluginSecretName() string {
+	return cephFSNodePluginSecretName + staticSecretSuffix
+}
+
+// createCephFSStaticSecret copies the credentials of the cephfs nodeplugin
+// secret to the user keys of cephFSStaticNodePluginSecretName.
+func createCephFSStaticSecret(c kubernetes.Interface) error {
+	secret, err := c.CoreV1().Secrets(cephCSISecretNamespace).Get(
+		context.TODO(), cephFSNodePluginSecretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get secret %s: %w", cephFSNodePluginSecretName, err)
+	}
+
+	return ensureSecret(io.Discard, c, cephFSStaticNodePluginSecretName(), map[string][]byte{
+		"userID":  secret.Data["adminID"],
+		"userKey": secret.Data["adminKey"],
+	})
+}
+
+// deleteCephFSStaticSecret removes the secret createCephFSStaticSecret
+// created, it does not fail when the secret is already gone.
+func deleteCephFSStaticSecret(c kubernetes.Interface) error {
+	name := cephFSStaticNodePluginSecretName()
+	err := c.CoreV1().Secrets(cephCSISecretNamespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("failed to delete secret %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// getCSIClusterID returns the clusterID the storage classes of the suite use.
+func getCSIClusterID(f *framework.Framework) (string, error) {
+	if cephCSIClusterID != "" {
+		return cephCSIClusterID, nil
+	}
+
+	return getCephClusterID(f)
+}
+
+// newStaticPV returns a Filesystem mode ReadWriteOnce PV with the Retain
+// reclaim policy for a ceph object that was created outside of ceph-csi.
+func newStaticPV(name, driver, handle, nodeStageSecret string, attrs map[string]string) *v1.PersistentVolume {
+	volumeMode := v1.PersistentVolumeFilesystem
+	attrs[staticVolumeAttribute] = "true"
+
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(staticVolumeSize, resource.BinarySI),
+			},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			VolumeMode:                    &volumeMode,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:           driver,
+					VolumeHandle:     handle,
+					VolumeAttributes: attrs,
+					NodeStageSecretRef: &v1.SecretReference{
+						Name:      nodeStageSecret,
+						Namespace: cephCSISecretNamespace,
+					},
+				},
+			},
+		},
+	}
+}
+
+// createStaticRBDPV creates an rbd image and a static PV for it.
+func createStaticRBDPV(f *framework.Framework, name string) (*v1.PersistentVolume, error) {
+	driver, err := getRBDDriverName(f.ClientSet)
+	if err != nil {
+		return nil, err
+	}
+	clusterID, err := getCSIClusterID(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ceph clusterID: %w", err)
+	}
+	if err = getCephBackend(f).CreateImage(defaultRbdPool, name, staticVolumeSize); err != nil {
+		return nil, err
+	}
+
+	pv := newStaticPV(name, driver, name, rbdNodePluginSecretName, map[string]string{
+		"clusterID":     clusterID,
+		"pool":          defaultRbdPool,
+		"imageFeatures": "layering",
+	})
+	pv.Spec.CSI.FSType = "ext4"
+
+	return createStaticPV(f.ClientSet, pv)
+}
+
+// createStaticCephFSPV creates a cephfs subvolume and a static PV for it. The
+// PV is staged with cephFSStaticNodePluginSecretName, see
+// createCephFSStaticSecret.
+func createStaticCephFSPV(f *framework.Framework, name string) (*v1.PersistentVolume, error) {
+	driver, err := getCephFSDriverName(f.ClientSet)
+	if err != nil {
+		return nil, err
+	}
+	clusterID, err := getCSIClusterID(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ceph clusterID: %w", err)
+	}
+	backend := getCephBackend(f)
+	err = backend.CreateSubVolume(defaultFileSystemName, defaultSubvolumegroup, name, staticVolumeSize)
+	if err != nil {
+		return nil, err
+	}
+	info, err := backend.SubVolumeInfo(defaultFileSystemName, defaultSubvolumegroup, name)
+	if err != nil {
+		return nil, err
+	}
+
+	pv := newStaticPV(name, driver, name, cephFSStaticNodePluginSecretName(), map[string]string{
+		"clusterID": clusterID,
+		"fsName":    defaultFileSystemName,
+		"rootPath":  info.Path,
+	})
+
+	return createStaticPV(f.ClientSet, pv)
+}
+
+func createStaticPV(c kubernetes.Interface, pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	pv, err := c.CoreV1().PersistentVolumes().Create(context.TODO(), pv, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pv: %w", err)
+	}
+
+	return pv, nil
+}
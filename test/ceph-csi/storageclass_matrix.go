@@ -0,0 +1,69 @@
+package ceph_csi
+
+import (
+	"sort"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+)
+
+// storageClassParams is a set of storage class parameters the core flows of
+// the drivers are run with, on top of the defaults of the storage class
+// manifests.
+type storageClassParams struct {
+	// options are the scOptions of createRBDStorageClass, the cephfs
+	// driver takes its mount options as parameters.
+	options    map[string]string
+	parameters map[string]string
+}
+
+// String returns the parameters and options sorted by their name, without
+// the csi.storage.k8s.io/ prefix, e.g. "fstype=xfs mounter=rbd-nbd".
+func (p storageClassParams) String() string {
+	var pairs []string
+	for _, m := range []map[string]string{p.parameters, p.options} {
+		for k, v := range m {
+			pairs = append(pairs, strings.TrimPrefix(k, "csi.storage.k8s.io/")+"="+v)
+		}
+	}
+	if len(pairs) == 0 {
+		return "defaults"
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, " ")
+}
+
+// rbdStorageClassMatrix are the parameter sets of the rbd storage class
+// matrix, the default storage class uses ext4, the layering feature, krbd and
+// the discard mount option. The mountOptions of a set are appended to
+// discard, the noatime set mounts with both.
+var rbdStorageClassMatrix = []storageClassParams{
+	{parameters: map[string]string{"csi.storage.k8s.io/fstype": "ext4"}},
+	{parameters: map[string]string{"csi.storage.k8s.io/fstype": "xfs"}},
+	{parameters: map[string]string{"imageFeatures": "layering,exclusive-lock,object-map,fast-diff,deep-flatten"}},
+	{parameters: map[string]string{"mounter": "rbd-nbd"}},
+	{parameters: map[string]string{"csi.storage.k8s.io/fstype": "xfs", "mounter": "rbd-nbd"}},
+	{options: map[string]string{rbdMountOptions: "noatime"}},
+}
+
+// cephfsStorageClassMatrix are the parameter sets of the cephfs storage class
+// matrix.
+var cephfsStorageClassMatrix = []storageClassParams{
+	{parameters: map[string]string{"mounter": "kernel"}},
+	{parameters: map[string]string{"mounter": "fuse"}},
+	{parameters: map[string]string{"mounter": "kernel", "kernelMountOptions": "noatime"}},
+	{parameters: map[string]string{"mounter": "fuse", "fuseMountOptions": "noatime"}},
+}
+
+// storageClassEntries returns a table entry for each parameter set, so every
+// combination of a flow and a parameter set is a spec that passes or fails on
+// its own.
+func storageClassEntries(matrix []storageClassParams) []TableEntry {
+	entries := make([]TableEntry, 0, len(matrix))
+	for _, params := range matrix {
+		entries = append(entries, Entry(params.String(), params))
+	}
+
+	return entries
+}
@@ -0,0 +1,42 @@
+package ceph_csi
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	scv1 "k8s.io/api/storage/v1"
+)
+
+var _ = Describe("Storage class matrix", Label("unit"), func() {
+	It("should describe the parameter sets by the sorted parameters and options", func() {
+		params := storageClassParams{
+			options:    map[string]string{rbdMountOptions: "noatime"},
+			parameters: map[string]string{"mounter": "rbd-nbd", "csi.storage.k8s.io/fstype": "xfs"},
+		}
+		Expect(params.String()).To(Equal("fstype=xfs mountOptions=noatime mounter=rbd-nbd"))
+		Expect(storageClassParams{}.String()).To(Equal("defaults"))
+	})
+
+	It("should have a unique description for every parameter set", func() {
+		for _, matrix := range [][]storageClassParams{rbdStorageClassMatrix, cephfsStorageClassMatrix} {
+			seen := map[string]bool{}
+			for _, params := range matrix {
+				Expect(seen).NotTo(HaveKey(params.String()))
+				seen[params.String()] = true
+			}
+		}
+	})
+
+	It("should add the mount options to the ones of the rbd storage class", func() {
+		sc, err := getStorageClass("manifest/rbd/storageclass.yaml")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(sc.MountOptions).To(Equal([]string{"discard"}))
+
+		applyRBDStorageClassOptions(&sc, map[string]string{rbdMountOptions: "noatime,nodiratime"})
+		Expect(sc.MountOptions).To(Equal([]string{"discard", "noatime", "nodiratime"}))
+		Expect(sc.VolumeBindingMode).To(BeNil())
+
+		applyRBDStorageClassOptions(&sc, map[string]string{"volumeBindingMode": "WaitForFirstConsumer"})
+		Expect(sc.VolumeBindingMode).To(HaveValue(Equal(scv1.VolumeBindingWaitForFirstConsumer)))
+		Expect(sc.MountOptions).To(Equal([]string{"discard", "noatime", "nodiratime"}))
+	})
+})
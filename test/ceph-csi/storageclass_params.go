@@ -0,0 +1,221 @@
+package ceph_csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	scv1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+// defaultFsType is the filesystem csi-provisioner asks for when the storage
+// class does not set csi.storage.k8s.io/fstype.
+const defaultFsType = "ext4"
+
+// procMount is a line of /proc/mounts.
+type procMount struct {
+	device     string
+	mountPoint string
+	fsType     string
+	options    []string
+}
+
+// parseProcMounts returns the mount of the mount point in /proc/mounts, the
+// last one when several are stacked on it.
+func parseProcMounts(out, mountPoint string) (procMount, error) {
+	var mount *procMount
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != mountPoint {
+			continue
+		}
+		mount = &procMount{
+			device:     fields[0],
+			mountPoint: fields[1],
+			fsType:     fields[2],
+			options:    strings.Split(fields[3], ","),
+		}
+	}
+	if mount == nil {
+		return procMount{}, fmt.Errorf("%s not found in /proc/mounts", mountPoint)
+	}
+
+	return *mount, nil
+}
+
+// impliedRBDImageFeatures are the image features librbd turns on by itself
+// for the parameter of the storage class, on top of the imageFeatures.
+var impliedRBDImageFeatures = map[string][]string{
+	"data-pool": {"dataPool"},
+	"striping":  {"stripeUnit", "stripeCount"},
+}
+
+// validateRBDImageParameters checks that the image has the imageFeatures,
+// dataPool, stripeUnit, stripeCount and objectSize the storage class asks
+// for. The image must have exactly the imageFeatures, apart from the ones
+// implied by the other parameters. The parameters the storage class does not
+// set are not checked.
+func validateRBDImageParameters(info *rbdImageInfo, sc *scv1.StorageClass) error {
+	var errs []error
+	if features := sc.Parameters["imageFeatures"]; features != "" {
+		expected := strings.Split(features, ",")
+		for _, feature := range expected {
+			if !contains(info.Features, feature) {
+				errs = append(errs, fmt.Errorf("imageFeatures: %s missing in %s",
+					feature, strings.Join(info.Features, ",")))
+			}
+		}
+		for _, feature := range info.Features {
+			if !contains(expected, feature) && !rbdImageFeatureImplied(feature, sc) {
+				errs = append(errs, fmt.Errorf("imageFeatures: %s not expected in %s",
+					feature, strings.Join(info.Features, ",")))
+			}
+		}
+	}
+	if pool := sc.Parameters["dataPool"]; pool != "" && pool != info.DataPool {
+		errs = append(errs, fmt.Errorf("dataPool: expected %s, image has %q", pool, info.DataPool))
+	}
+
+	for _, p := range []struct {
+		name  string
+		value int64
+	}{
+		{name: "stripeUnit", value: info.StripeUnit},
+		{name: "stripeCount", value: info.StripeCount},
+		{name: "objectSize", value: info.ObjectSize},
+	} {
+		param := sc.Parameters[p.name]
+		if param == "" {
+			continue
+		}
+		expected, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid parameter %q: %w", p.name, param, err))
+		} else if expected != p.value {
+			errs = append(errs, fmt.Errorf("%s: expected %d, image has %d", p.name, expected, p.value))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// rbdImageFeatureImplied returns true when librbd turns the feature on for a
+// parameter the storage class sets.
+func rbdImageFeatureImplied(feature string, sc *scv1.StorageClass) bool {
+	for _, param := range impliedRBDImageFeatures[feature] {
+		if sc.Parameters[param] != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateMountParameters checks that the mount has the filesystem type and
+// all mount options of the storage class.
+func validateMountParameters(mount procMount, sc *scv1.StorageClass) error {
+	var errs []error
+	fsType := sc.Parameters["csi.storage.k8s.io/fstype"]
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	if mount.fsType != fsType {
+		errs = append(errs, fmt.Errorf("fstype: expected %s, %s is mounted as %s", fsType, mount.device, mount.fsType))
+	}
+	for _, opt := range sc.MountOptions {
+		if !contains(mount.options, opt) {
+			errs = append(errs, fmt.Errorf("mountOptions: %s missing in %s", opt, strings.Join(mount.options, ",")))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateRBDStorageClassParameters checks that the parameters of the storage
+// class the PVC was provisioned from are applied. The image must have the
+// image parameters in rbd info. The mount of a Filesystem mode volume in
+// /proc/mounts of the pod must have the fstype and the mount options, and
+// blkid, run in the nodeplugin as the pod has no access to the device, must
+// find the fstype on the device.
+func validateRBDStorageClassParameters(f *framework.Framework, pvc *v1.PersistentVolumeClaim, pod *v1.Pod) error {
+	claim, err := getPersistentVolumeClaim(f.ClientSet, pvc.Namespace, pvc.Name)
+	if err != nil {
+		return err
+	}
+	if claim.Spec.StorageClassName == nil {
+		return fmt.Errorf("PVC %s has no storage class", claim.Name)
+	}
+	sc, err := f.ClientSet.StorageV1().StorageClasses().Get(context.TODO(), *claim.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get storageclass %s: %w", *claim.Spec.StorageClassName, err)
+	}
+	pv, err := getBoundPersistentVolume(f.ClientSet, claim)
+	if err != nil {
+		return err
+	}
+	ref, err := getRBDImageRef(pv)
+	if err != nil {
+		return err
+	}
+
+	info, err := getCephBackend(f).ImageInfo(ref.pool, ref.image)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ref, err)
+	}
+	if err = validateRBDImageParameters(info, sc); err != nil {
+		return fmt.Errorf("%s does not match storageclass %s:\n%w", ref, sc.Name, err)
+	}
+
+	if claim.Spec.VolumeMode != nil && *claim.Spec.VolumeMode == v1.PersistentVolumeBlock {
+		framework.Logf("%s matches storageclass %s", ref, sc.Name)
+
+		return nil
+	}
+	container, path, err := podVolumePath(pod, claim.Name, v1.PersistentVolumeFilesystem)
+	if err != nil {
+		return err
+	}
+	stdout, stdErr, err := execCommandInContainerByPodName(f, "cat /proc/mounts", pod.Namespace, pod.Name, container)
+	if err != nil {
+		return fmt.Errorf("failed to read /proc/mounts of pod %s: %w, %s", pod.Name, err, stdErr)
+	}
+	mount, err := parseProcMounts(stdout, path)
+	if err != nil {
+		return fmt.Errorf("pod %s: %w", pod.Name, err)
+	}
+	if err = validateMountParameters(mount, sc); err != nil {
+		return fmt.Errorf("mount of %s in pod %s does not match storageclass %s:\n%w", ref, pod.Name, sc.Name, err)
+	}
+
+	blkidType, err := nodeDeviceFsType(f, pod.Spec.NodeName, mount.device)
+	if err != nil {
+		return err
+	}
+	if blkidType != mount.fsType {
+		return fmt.Errorf("blkid finds %s on %s of %s, mounted as %s", blkidType, mount.device, ref, mount.fsType)
+	}
+	framework.Logf("%s and its mount in pod %s match storageclass %s", ref, pod.Name, sc.Name)
+
+	return nil
+}
+
+// nodeDeviceFsType returns the filesystem type blkid finds on the device,
+// run in the rbd nodeplugin on the node.
+func nodeDeviceFsType(f *framework.Framework, nodeName, device string) (string, error) {
+	podName, err := getDaemonsetPodOnNode(f, rbdNodePluginDaemonSet, nodeName, cephCSINamespace)
+	if err != nil {
+		return "", err
+	}
+	cmd := "blkid -o value -s TYPE " + device
+	stdout, stdErr, err := execCommandInContainerByPodName(f, cmd, cephCSINamespace, podName, rbdPluginContainer)
+	if err != nil {
+		return "", fmt.Errorf("failed to exec %q in pod %s: %w, %s", cmd, podName, err, stdErr)
+	}
+
+	return strings.TrimSpace(stdout), nil
+}
@@ -0,0 +1,89 @@
+package ceph_csi
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	scv1 "k8s.io/api/storage/v1"
+)
+
+var _ = Describe("Storage class parameters", Label("unit"), func() {
+	const mounts = `overlay / overlay rw,relatime,lowerdir=/var/lib/containerd/l 0 0
+/dev/rbd0 /var/lib/www/html ext4 rw,relatime,discard,stripe=16 0 0
+/dev/rbd1 /var/lib/www/html xfs rw,noatime,discard,attr2,inode64 0 0
+`
+
+	It("should find the last mount of the mount point", func() {
+		mount, err := parseProcMounts(mounts, "/var/lib/www/html")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(mount).To(Equal(procMount{
+			device:     "/dev/rbd1",
+			mountPoint: "/var/lib/www/html",
+			fsType:     "xfs",
+			options:    []string{"rw", "noatime", "discard", "attr2", "inode64"},
+		}))
+
+		_, err = parseProcMounts(mounts, "/var/lib/www")
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should check the fstype and the mount options", func() {
+		mount, err := parseProcMounts(mounts, "/var/lib/www/html")
+		Expect(err).ShouldNot(HaveOccurred())
+		sc := &scv1.StorageClass{
+			Parameters:   map[string]string{"csi.storage.k8s.io/fstype": "xfs"},
+			MountOptions: []string{"discard", "noatime"},
+		}
+		Expect(validateMountParameters(mount, sc)).To(Succeed())
+
+		sc.Parameters = nil
+		sc.MountOptions = append(sc.MountOptions, "nobarrier")
+		err = validateMountParameters(mount, sc)
+		Expect(err).To(MatchError(ContainSubstring("fstype: expected ext4, /dev/rbd1 is mounted as xfs")))
+		Expect(err).To(MatchError(ContainSubstring("mountOptions: nobarrier missing")))
+	})
+
+	It("should check the image parameters the storage class sets", func() {
+		info := &rbdImageInfo{
+			Features:    []string{"layering", "exclusive-lock", "object-map", "fast-diff", "striping", "data-pool"},
+			ObjectSize:  4 << 20,
+			DataPool:    "ec-pool",
+			StripeUnit:  65536,
+			StripeCount: 8,
+		}
+		sc := &scv1.StorageClass{Parameters: map[string]string{
+			"imageFeatures": "layering,exclusive-lock,object-map,fast-diff",
+			"dataPool":      "ec-pool",
+			"stripeUnit":    "65536",
+			"stripeCount":   "8",
+			"objectSize":    "4194304",
+		}}
+		Expect(validateRBDImageParameters(info, sc)).To(Succeed())
+		Expect(validateRBDImageParameters(info, &scv1.StorageClass{})).To(Succeed())
+
+		sc.Parameters["imageFeatures"] = "layering,deep-flatten"
+		sc.Parameters["dataPool"] = "other-pool"
+		sc.Parameters["objectSize"] = "8388608"
+		err := validateRBDImageParameters(info, sc)
+		Expect(err).To(MatchError(ContainSubstring("imageFeatures: deep-flatten missing")))
+		Expect(err).To(MatchError(ContainSubstring("dataPool: expected other-pool")))
+		Expect(err).To(MatchError(ContainSubstring("objectSize: expected 8388608, image has 4194304")))
+		Expect(err.Error()).NotTo(ContainSubstring("stripeUnit"))
+	})
+
+	It("should reject the image features the storage class does not ask for", func() {
+		info := &rbdImageInfo{Features: []string{"layering", "exclusive-lock", "striping", "data-pool"}}
+		sc := &scv1.StorageClass{Parameters: map[string]string{"imageFeatures": "layering"}}
+
+		err := validateRBDImageParameters(info, sc)
+		Expect(err).To(MatchError(ContainSubstring("imageFeatures: exclusive-lock not expected")))
+		Expect(err).To(MatchError(ContainSubstring("imageFeatures: striping not expected")))
+		Expect(err).To(MatchError(ContainSubstring("imageFeatures: data-pool not expected")))
+
+		sc.Parameters["imageFeatures"] = "layering,exclusive-lock"
+		sc.Parameters["stripeCount"] = "8"
+		sc.Parameters["dataPool"] = "ec-pool"
+		info.DataPool = "ec-pool"
+		info.StripeCount = 8
+		Expect(validateRBDImageParameters(info, sc)).To(Succeed())
+	})
+})
@@ -0,0 +1,320 @@
+package ceph_csi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// topologyDomain is the failure domain of the topology specs.
+	topologyDomain = "zone"
+	// topologyZoneLabel is the node label the topology specs put the nodes
+	// in their zone with.
+	topologyZoneLabel = "test.failure-domain/" + topologyDomain
+	// rbdTopologyZoneKey is the topology key the rbd nodeplugin publishes
+	// for topologyZoneLabel.
+	rbdTopologyZoneKey = "topology.rbd.csi.ceph.com/" + topologyDomain
+
+	// the containers of the rbd workloads whose args enable topology.
+	rbdPluginContainer     = "csi-rbdplugin"
+	csiProvisionerSidecar  = "csi-provisioner"
+	topologyFeatureGateArg = "--feature-gates=Topology=true"
+)
+
+// rbdTopologyPools maps zones to the rbd pools the volumes of the nodes in
+// the zone are provisioned in, e.g. "zone-a=pool-a,zone-b=pool-b". The
+// topology specs are skipped when it is empty.
+var rbdTopologyPools string
+
+// topologyPool is the pool of a zone.
+type topologyPool struct {
+	zone string
+	pool string
+}
+
+// parseTopologyPools parses the value of rbdTopologyPools, the pools are
+// sorted by zone.
+func parseTopologyPools(value string) ([]topologyPool, error) {
+	var pools []topologyPool
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		zone, pool, ok := strings.Cut(entry, "=")
+		if !ok || zone == "" || pool == "" {
+			return nil, fmt.Errorf("invalid topology pool %q, expected <zone>=<pool>", entry)
+		}
+		if seen[zone] {
+			return nil, fmt.Errorf("zone %s has more than one pool", zone)
+		}
+		seen[zone] = true
+		pools = append(pools, topologyPool{zone: zone, pool: pool})
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].zone < pools[j].zone })
+
+	return pools, nil
+}
+
+func validateTopologyPools(value string) []string {
+	if _, err := parseTopologyPools(value); err != nil {
+		return []string{err.Error()}
+	}
+
+	return nil
+}
+
+// topologyConstrainedPools returns the topologyConstrainedPools parameter of
+// an rbd storage class for the pools.
+func topologyConstrainedPools(pools []topologyPool) (string, error) {
+	type domainSegment struct {
+		DomainLabel string `json:"domainLabel"`
+		Value       string `json:"value"`
+	}
+	type constrainedPool struct {
+		PoolName       string          `json:"poolName"`
+		DomainSegments []domainSegment `json:"domainSegments"`
+	}
+
+	param := make([]constrainedPool, 0, len(pools))
+	for _, p := range pools {
+		param = append(param, constrainedPool{
+			PoolName: p.pool,
+			DomainSegments: []domainSegment{{
+				DomainLabel: topologyDomain,
+				Value:       p.zone,
+			}},
+		})
+	}
+	data, err := json.Marshal(param)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// nodeLabels holds the values of some labels of the nodes, nil for a label
+// the node does not have, so they can be restored.
+type nodeLabels map[string]map[string]*string
+
+// saveNodeLabels returns the values of the labels of the nodes.
+func saveNodeLabels(nodes []v1.Node, keys ...string) nodeLabels {
+	saved := nodeLabels{}
+	for i := range nodes {
+		labels := map[string]*string{}
+		for _, key := range keys {
+			if value, ok := nodes[i].Labels[key]; ok {
+				labels[key] = &value
+			} else {
+				labels[key] = nil
+			}
+		}
+		saved[nodes[i].Name] = labels
+	}
+
+	return saved
+}
+
+// patchNodeLabels sets the labels of a node, a nil value removes the label.
+func patchNodeLabels(c kubernetes.Interface, node string, labels map[string]*string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.CoreV1().Nodes().Patch(context.TODO(), node, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to patch labels of node %s: %w", node, err)
+	}
+
+	return nil
+}
+
+// restoreNodeLabels sets the saved labels back.
+func restoreNodeLabels(c kubernetes.Interface, saved nodeLabels) error {
+	for node, labels := range saved {
+		if err := patchNodeLabels(c, node, labels); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// assignZones labels the nodes round robin with the zones of the pools and
+// returns the zone of every node.
+func assignZones(c kubernetes.Interface, nodes []v1.Node, pools []topologyPool) (map[string]string, error) {
+	zones := map[string]string{}
+	for i := range nodes {
+		zone := pools[i%len(pools)].zone
+		if err := patchNodeLabels(c, nodes[i].Name, map[string]*string{topologyZoneLabel: &zone}); err != nil {
+			return nil, err
+		}
+		zones[nodes[i].Name] = zone
+	}
+
+	return zones, nil
+}
+
+// rbdDriverArgs are the container args of the rbd nodeplugin daemonset and
+// the provisioner deployment, keyed by container name.
+type rbdDriverArgs struct {
+	nodePlugin  map[string][]string
+	provisioner map[string][]string
+}
+
+func containerArgs(containers []v1.Container) map[string][]string {
+	args := map[string][]string{}
+	for i := range containers {
+		args[containers[i].Name] = append([]string(nil), containers[i].Args...)
+	}
+
+	return args
+}
+
+// setDomainLabelsArg replaces the domain labels in the args of the rbd
+// plugin container.
+func setDomainLabelsArg(args []string, labels string) []string {
+	updated := make([]string, 0, len(args)+1)
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, domainLabelsArg("")) {
+			updated = append(updated, arg)
+		}
+	}
+
+	return append(updated, domainLabelsArg(labels))
+}
+
+// setTopologyFeatureGateArg turns the Topology feature gate of the
+// csi-provisioner sidecar on.
+func setTopologyFeatureGateArg(args []string) []string {
+	updated := make([]string, 0, len(args)+1)
+	for _, arg := range args {
+		arg = enableTopologyInTemplate(arg)
+		updated = append(updated, arg)
+	}
+	if !contains(updated, topologyFeatureGateArg) {
+		updated = append(updated, topologyFeatureGateArg)
+	}
+
+	return updated
+}
+
+// updateDaemonSet applies the change to the latest version of the daemonset.
+func updateDaemonSet(c kubernetes.Interface, name string, change func(ds *appsv1.DaemonSet)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ds, err := c.AppsV1().DaemonSets(cephCSINamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		change(ds)
+		_, err = c.AppsV1().DaemonSets(cephCSINamespace).Update(context.TODO(), ds, metav1.UpdateOptions{})
+
+		return err
+	})
+}
+
+// updateDeployment applies the change to the latest version of the
+// deployment.
+func updateDeployment(c kubernetes.Interface, name string, change func(deploy *appsv1.Deployment)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deploy, err := c.AppsV1().Deployments(cephCSINamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		change(deploy)
+		_, err = c.AppsV1().Deployments(cephCSINamespace).Update(context.TODO(), deploy, metav1.UpdateOptions{})
+
+		return err
+	})
+}
+
+// enableRBDTopology passes the domain labels to the rbd nodeplugin and turns
+// the Topology feature gate of the provisioner on. It returns the args the
+// workloads had, so restoreRBDDriverArgs can undo the change. The pods are
+// rolled out by their controllers, wait for them before using the driver.
+func enableRBDTopology(c kubernetes.Interface, domainLabels string) (*rbdDriverArgs, error) {
+	saved := &rbdDriverArgs{}
+	found := false
+	err := updateDaemonSet(c, rbdNodePluginDaemonSet, func(ds *appsv1.DaemonSet) {
+		saved.nodePlugin = containerArgs(ds.Spec.Template.Spec.Containers)
+		for i := range ds.Spec.Template.Spec.Containers {
+			container := &ds.Spec.Template.Spec.Containers[i]
+			if container.Name == rbdPluginContainer {
+				container.Args = setDomainLabelsArg(container.Args, domainLabels)
+				found = true
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update daemonset %s: %w", rbdNodePluginDaemonSet, err)
+	}
+	if !found {
+		return saved, fmt.Errorf("daemonset %s has no %s container", rbdNodePluginDaemonSet, rbdPluginContainer)
+	}
+
+	found = false
+	err = updateDeployment(c, rbdProvisionerDeployment, func(deploy *appsv1.Deployment) {
+		saved.provisioner = containerArgs(deploy.Spec.Template.Spec.Containers)
+		for i := range deploy.Spec.Template.Spec.Containers {
+			container := &deploy.Spec.Template.Spec.Containers[i]
+			if container.Name == csiProvisionerSidecar {
+				container.Args = setTopologyFeatureGateArg(container.Args)
+				found = true
+			}
+		}
+	})
+	if err != nil {
+		return saved, fmt.Errorf("failed to update deployment %s: %w", rbdProvisionerDeployment, err)
+	}
+	if !found {
+		return saved, fmt.Errorf("deployment %s has no %s container", rbdProvisionerDeployment, csiProvisionerSidecar)
+	}
+
+	return saved, nil
+}
+
+// restoreRBDDriverArgs sets the saved args back on the rbd workloads.
+func restoreRBDDriverArgs(c kubernetes.Interface, saved *rbdDriverArgs) error {
+	if saved.nodePlugin != nil {
+		err := updateDaemonSet(c, rbdNodePluginDaemonSet, func(ds *appsv1.DaemonSet) {
+			for i := range ds.Spec.Template.Spec.Containers {
+				container := &ds.Spec.Template.Spec.Containers[i]
+				if args, ok := saved.nodePlugin[container.Name]; ok {
+					container.Args = args
+				}
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to restore daemonset %s: %w", rbdNodePluginDaemonSet, err)
+		}
+	}
+	if saved.provisioner != nil {
+		err := updateDeployment(c, rbdProvisionerDeployment, func(deploy *appsv1.Deployment) {
+			for i := range deploy.Spec.Template.Spec.Containers {
+				container := &deploy.Spec.Template.Spec.Containers[i]
+				if args, ok := saved.provisioner[container.Name]; ok {
+					container.Args = args
+				}
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to restore deployment %s: %w", rbdProvisionerDeployment, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package ceph_csi
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("Topology", Label("unit"), func() {
+	It("should parse the topology pools", func() {
+		Expect(parseTopologyPools("")).To(BeEmpty())
+		Expect(parseTopologyPools("zone-b=pool-b, zone-a=pool-a")).To(Equal([]topologyPool{
+			{zone: "zone-a", pool: "pool-a"},
+			{zone: "zone-b", pool: "pool-b"},
+		}))
+		Expect(validateTopologyPools("zone-a")).To(ConsistOf(ContainSubstring("expected <zone>=<pool>")))
+		Expect(validateTopologyPools("zone-a=pool-a,zone-a=pool-b")).To(ConsistOf("zone zone-a has more than one pool"))
+
+		Expect(topologyConstrainedPools([]topologyPool{{zone: "zone-a", pool: "pool-a"}})).To(Equal(
+			`[{"poolName":"pool-a","domainSegments":[{"domainLabel":"zone","value":"zone-a"}]}]`))
+	})
+
+	It("should enable topology on the rbd driver and restore it", func() {
+		ds := &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: rbdNodePluginDaemonSet, Namespace: cephCSINamespace},
+		}
+		ds.Spec.Template.Spec.Containers = []v1.Container{
+			{Name: "driver-registrar", Args: []string{"--v=1"}},
+			{Name: rbdPluginContainer, Args: []string{"--nodeserver=true", "--domainlabels=old/zone"}},
+		}
+		deploy := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: rbdProvisionerDeployment, Namespace: cephCSINamespace},
+		}
+		deploy.Spec.Template.Spec.Containers = []v1.Container{
+			{Name: csiProvisionerSidecar, Args: []string{"--v=1", "--feature-gates=Topology=false"}},
+		}
+		c := fake.NewSimpleClientset(ds, deploy)
+
+		saved, err := enableRBDTopology(c, topologyZoneLabel)
+		Expect(err).ShouldNot(HaveOccurred())
+		ds, err = c.AppsV1().DaemonSets(cephCSINamespace).Get(context.TODO(), rbdNodePluginDaemonSet, metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ds.Spec.Template.Spec.Containers[0].Args).To(Equal([]string{"--v=1"}))
+		Expect(ds.Spec.Template.Spec.Containers[1].Args).To(Equal(
+			[]string{"--nodeserver=true", "--domainlabels=" + topologyZoneLabel}))
+		deploy, err = c.AppsV1().Deployments(cephCSINamespace).Get(context.TODO(),
+			rbdProvisionerDeployment, metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deploy.Spec.Template.Spec.Containers[0].Args).To(Equal([]string{"--v=1", "--feature-gates=Topology=true"}))
+
+		Expect(restoreRBDDriverArgs(c, saved)).To(Succeed())
+		ds, err = c.AppsV1().DaemonSets(cephCSINamespace).Get(context.TODO(), rbdNodePluginDaemonSet, metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ds.Spec.Template.Spec.Containers[1].Args).To(Equal([]string{"--nodeserver=true", "--domainlabels=old/zone"}))
+		deploy, err = c.AppsV1().Deployments(cephCSINamespace).Get(context.TODO(),
+			rbdProvisionerDeployment, metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deploy.Spec.Template.Spec.Containers[0].Args).To(Equal([]string{"--v=1", "--feature-gates=Topology=false"}))
+	})
+
+	It("should label the nodes with the zones and restore the labels", func() {
+		nodes := []v1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{topologyZoneLabel: "east"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+		}
+		c := fake.NewSimpleClientset(&nodes[0], &nodes[1], &nodes[2])
+		pools := []topologyPool{{zone: "zone-a", pool: "pool-a"}, {zone: "zone-b", pool: "pool-b"}}
+
+		saved := saveNodeLabels(nodes, topologyZoneLabel)
+		Expect(assignZones(c, nodes, pools)).To(Equal(map[string]string{
+			"node-1": "zone-a", "node-2": "zone-b", "node-3": "zone-a",
+		}))
+		Expect(restoreNodeLabels(c, saved)).To(Succeed())
+
+		node, err := c.CoreV1().Nodes().Get(context.TODO(), "node-1", metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(node.Labels).To(Equal(map[string]string{topologyZoneLabel: "east"}))
+		node, err = c.CoreV1().Nodes().Get(context.TODO(), "node-2", metav1.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(node.Labels).NotTo(HaveKey(topologyZoneLabel))
+	})
+
+	It("should add the feature gate when the provisioner has none", func() {
+		Expect(setTopologyFeatureGateArg([]string{"--v=1"})).To(Equal([]string{"--v=1", topologyFeatureGateArg}))
+	})
+})
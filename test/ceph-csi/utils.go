@@ -4,10 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"os"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
@@ -17,8 +14,8 @@ import (
 	v1 "k8s.io/api/core/v1"
 	scv1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
-	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/kubernetes/test/e2e/framework"
 	e2ekubectl "k8s.io/kubernetes/test/e2e/framework/kubectl"
@@ -46,14 +43,15 @@ const (
 	keyringCephFSNodePluginUsername        = "rook-csi-cephfs-node"
 
 	// secret names.
-	rbdNodePluginSecretName           = "rook-csi-rbd-node"
-	rbdProvisionerSecretName          = "rook-csi-rbd-provisioner"
 	rbdNamespaceNodePluginSecretName  = "rook-csi-rbd-ns-node"
 	rbdNamespaceProvisionerSecretName = "rook-csi-rbd-ns-provisioner"
 	rbdMigrationNodePluginSecretName  = "rook-csi-rbd-mig-node"
 	rbdMigrationProvisionerSecretName = "rook-csi-rbd-mig-provisioner"
-	cephFSNodePluginSecretName        = "rook-csi-cephfs-node"
-	cephFSProvisionerSecretName       = "rook-csi-cephfs-provisioner"
+
+	// manifestRbdSc and manifestCephfsSc are the default names of the
+	// storage classes the suite creates.
+	manifestRbdSc    = "csi-rbd-sc"
+	manifestCephfsSc = "csi-cephfs-sc"
 
 	noError = ""
 
@@ -75,17 +73,52 @@ var (
 	defaultSubvolumegroup = "csi"
 
 	radosNamespace string
+
+	// cephCSIClusterID is the clusterID of the storage and snapshot classes,
+	// the one in the manifests is used when it is empty.
+	cephCSIClusterID string
+
+	defaultRbdSc    = manifestRbdSc
+	defaultCephfsSc = manifestCephfsSc
+
+	// the names of the CSI drivers, discovered from the CSIDriver objects
+	// when they are not configured.
+	rbdProvisioner    string
+	cephfsProvisioner string
+	nfsProvisioner    string
+
+	// secret names.
+	rbdNodePluginSecretName     = "rook-csi-rbd-node"
+	rbdProvisionerSecretName    = "rook-csi-rbd-provisioner"
+	cephFSNodePluginSecretName  = "rook-csi-cephfs-node"
+	cephFSProvisionerSecretName = "rook-csi-cephfs-provisioner"
+
+	// the workloads of ceph-csi in cephCSINamespace.
+	rbdNodePluginDaemonSet      = "csi-rbdplugin"
+	rbdProvisionerDeployment    = "csi-rbdplugin-provisioner"
+	cephFSNodePluginDaemonSet   = "csi-cephfsplugin"
+	cephFSProvisionerDeployment = "csi-cephfsplugin-provisioner"
 )
 
-func addTopologyDomainsToDSYaml(template, labels string) string {
-	return strings.ReplaceAll(template, "# - \"--domainlabels=failure-domain/region,failure-domain/zone\"",
-		"- \"--domainlabels="+labels+"\"")
-}
+// newClusterFramework returns a framework that only carries a clientset. It is
+// used outside of specs, e.g. in the suite hooks, where
+// framework.NewDefaultFramework can not be called.
+func newClusterFramework(baseName string) (*framework.Framework, error) {
+	c, err := framework.LoadClientset()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clientset: %w", err)
+	}
 
-func oneReplicaDeployYaml(template string) string {
-	re := regexp.MustCompile(`(\s+replicas:) \d+`)
+	return &framework.Framework{
+		BaseName:  baseName,
+		ClientSet: c,
+	}, nil
+}
 
-	return re.ReplaceAllString(template, `$1 1`)
+// domainLabelsArg returns the arg of the nodeplugin that sets the node labels
+// it publishes as topology.
+func domainLabelsArg(labels string) string {
+	return "--domainlabels=" + labels
 }
 
 func enableTopologyInTemplate(data string) string {
@@ -224,18 +257,7 @@ func retryKubectlArgs(namespace string, action kubectlAction, t int, args ...str
 }
 
 func unmarshal(fileName string, obj interface{}) error {
-	f, err := os.ReadFile(fileName)
-	if err != nil {
-		return err
-	}
-	data, err := utilyaml.ToJSON(f)
-	if err != nil {
-		return err
-	}
-
-	err = json.Unmarshal(data, obj)
-
-	return err
+	return unmarshalManifest(fileName, manifestParams{}, obj)
 }
 
 func getStorageClass(path string) (scv1.StorageClass, error) {
@@ -249,6 +271,35 @@ func deleteStorageClass(c kubernetes.Interface, name string) error {
 	return c.StorageV1().StorageClasses().Delete(context.Background(), name, metav1.DeleteOptions{})
 }
 
+// setAllowVolumeExpansion changes allowVolumeExpansion of the storage class,
+// unlike its parameters it can be updated.
+func setAllowVolumeExpansion(c kubernetes.Interface, name string, allow bool) error {
+	patch := []byte(fmt.Sprintf(`{"allowVolumeExpansion":%t}`, allow))
+	_, err := c.StorageV1().StorageClasses().Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to set allowVolumeExpansion of storageclass %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// applyRBDStorageClassOptions sets the volumeBindingMode and mountOptions
+// scOptions of createRBDStorageClass on the storage class. The comma
+// separated mount options are appended to the ones of the manifest, so the
+// default discard is kept.
+func applyRBDStorageClassOptions(sc *scv1.StorageClass, scOptions map[string]string) {
+	if scOptions["volumeBindingMode"] == "WaitForFirstConsumer" {
+		value := scv1.VolumeBindingWaitForFirstConsumer
+		sc.VolumeBindingMode = &value
+	}
+
+	// comma separated mount options
+	if opt, ok := scOptions[rbdMountOptions]; ok {
+		mOpt := strings.Split(opt, ",")
+		sc.MountOptions = append(sc.MountOptions, mOpt...)
+	}
+}
+
 func createRBDStorageClass(
 	c kubernetes.Interface,
 	f *framework.Framework,
@@ -262,8 +313,14 @@ func createRBDStorageClass(
 		return fmt.Errorf("failed to get sc: %w", err)
 	}
 
-	sc.Provisioner = "rook-ceph.rbd.csi.ceph.com"
+	sc.Provisioner, err = getRBDDriverName(c)
+	if err != nil {
+		return err
+	}
 	sc.Name = name
+	if cephCSIClusterID != "" {
+		sc.Parameters["clusterID"] = cephCSIClusterID
+	}
 	sc.Parameters["pool"] = defaultRbdPool
 	sc.Parameters["csi.storage.k8s.io/provisioner-secret-namespace"] = cephCSISecretNamespace
 	sc.Parameters["csi.storage.k8s.io/provisioner-secret-name"] = rbdProvisionerSecretName
@@ -274,7 +331,7 @@ func createRBDStorageClass(
 	sc.Parameters["csi.storage.k8s.io/node-stage-secret-namespace"] = cephCSISecretNamespace
 	sc.Parameters["csi.storage.k8s.io/node-stage-secret-name"] = rbdNodePluginSecretName
 
-	fsID, err := getCephClusterID()
+	fsID, err := getCephClusterID(f)
 	if err != nil {
 		return fmt.Errorf("failed to get ceph clusterID: %w", err)
 	}
@@ -290,16 +347,7 @@ func createRBDStorageClass(
 		}
 	}
 
-	if scOptions["volumeBindingMode"] == "WaitForFirstConsumer" {
-		value := scv1.VolumeBindingWaitForFirstConsumer
-		sc.VolumeBindingMode = &value
-	}
-
-	// comma separated mount options
-	if opt, ok := scOptions[rbdMountOptions]; ok {
-		mOpt := strings.Split(opt, ",")
-		sc.MountOptions = append(sc.MountOptions, mOpt...)
-	}
+	applyRBDStorageClassOptions(&sc, scOptions)
 	sc.ReclaimPolicy = &policy
 
 	timeout := time.Duration(deployTimeout) * time.Minute
@@ -319,64 +367,169 @@ func createRBDStorageClass(
 	})
 }
 
+// volumeStatsCapacity and volumeStatsUsed are the kubelet metrics of a
+// volume that are checked, kubelet labels them with the namespace and the
+// name of the PVC.
+const (
+	volumeStatsCapacity = "kubelet_volume_stats_capacity_bytes"
+	volumeStatsUsed     = "kubelet_volume_stats_used_bytes"
+)
+
+// metricLabelRE matches a label of a series in the Prometheus text format.
+var metricLabelRE = regexp.MustCompile(`(\w+)="((?:[^"\\]|\\.)*)"`)
+
+// parseVolumeStats returns the values of the kubelet_volume_stats series of
+// the PVC in the Prometheus text format metrics of a kubelet, by the name of
+// the metric.
+func parseVolumeStats(data []byte, namespace, claim string) (map[string]float64, error) {
+	stats := map[string]float64{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "kubelet_volume_stats_") {
+			continue
+		}
+		open, end := strings.Index(line, "{"), strings.LastIndex(line, "}")
+		if open < 0 || end < open {
+			continue
+		}
+		labels := map[string]string{}
+		for _, m := range metricLabelRE.FindAllStringSubmatch(line[open+1:end], -1) {
+			labels[m[1]] = m[2]
+		}
+		if labels["namespace"] != namespace || labels["persistentvolumeclaim"] != claim {
+			continue
+		}
+		fields := strings.Fields(line[end+1:])
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("no value in %q", line)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in %q: %w", line, err)
+		}
+		stats[line[:open]] = value
+	}
+
+	return stats, scanner.Err()
+}
+
+// validateVolumeStats checks that the stats report the capacity of the PVC,
+// with the filesystemOverhead for a Filesystem mode volume, and the used bytes
+// of a Filesystem mode volume.
+func validateVolumeStats(stats map[string]float64, pvc *v1.PersistentVolumeClaim) error {
+	capacity := pvc.Status.Capacity[v1.ResourceStorage]
+	minSize := float64(capacity.Value())
+	block := pvc.Spec.VolumeMode != nil && *pvc.Spec.VolumeMode == v1.PersistentVolumeBlock
+	if !block {
+		minSize *= 1 - filesystemOverhead
+	}
+	maxSize := float64(capacity.Value() + capacityRoundUp)
+
+	reported, ok := stats[volumeStatsCapacity]
+	switch {
+	case !ok:
+		return fmt.Errorf("%s of PVC %s not reported", volumeStatsCapacity, pvc.Name)
+	case reported < minSize || reported > maxSize:
+		return fmt.Errorf("%s of PVC %s is %.0f, expected %.0f-%.0f for a capacity of %s",
+			volumeStatsCapacity, pvc.Name, reported, minSize, maxSize, capacity.String())
+	}
+	if _, ok := stats[volumeStatsUsed]; !ok && !block {
+		return fmt.Errorf("%s of PVC %s not reported", volumeStatsUsed, pvc.Name)
+	}
+
+	return nil
+}
+
+// podClaimNames returns the names of the PVCs of the pod, including those of
+// its generic ephemeral volumes.
+func podClaimNames(pod *v1.Pod) []string {
+	var names []string
+	for _, vol := range pod.Spec.Volumes {
+		switch {
+		case vol.PersistentVolumeClaim != nil:
+			names = append(names, vol.PersistentVolumeClaim.ClaimName)
+		case vol.Ephemeral != nil:
+			names = append(names, pod.Name+"-"+vol.Name)
+		}
+	}
+
+	return names
+}
+
+// validateVolumeMetrics writes to the volumes of the pods of the deployment
+// and checks that the kubelet of the node of each pod reports the stats of
+// the PVCs of the pod.
 func validateVolumeMetrics(deploy *appsv1.Deployment, deployTimeout int, f *framework.Framework) {
+	selector, err := metav1.LabelSelectorAsSelector(deploy.Spec.Selector)
+	if err != nil {
+		framework.Failf("invalid selector of deployment %s: %v", deploy.Name, err)
+	}
 	opts := metav1.ListOptions{
-		LabelSelector: "app=ceph-csi-nginx",
+		LabelSelector: selector.String(),
 	}
 	podList, err := f.ClientSet.CoreV1().Pods(deploy.Namespace).List(context.Background(), opts)
 	if err != nil {
-		framework.Logf("get pod list error %v", err)
+		framework.Failf("failed to list pods of deployment %s: %v", deploy.Name, err)
 	}
 	if len(podList.Items) != int(*deploy.Spec.Replicas) {
-		framework.Logf("get pod list length %d is not %d", len(podList.Items), *deploy.Spec.Replicas)
+		framework.Failf("deployment %s has %d pods, expected %d", deploy.Name, len(podList.Items), *deploy.Spec.Replicas)
 	}
 
-	nodeName := podList.Items[0].Spec.NodeName
-
 	for _, po := range podList.Items {
 		cmd := `echo hello000000world | tee -a /var/lib/www/html/test`
 		if strings.Contains(deploy.Name, "block") {
 			cmd = `echo abcdefghijklmnopqrstuvwxyz | dd of=/dev/xvda`
 		}
-		execCommandInContainerByPodName(
+		_, stdErr, err := execCommandInContainerByPodName(
 			f,
 			cmd,
 			po.Namespace,
 			po.Name,
 			po.Spec.Containers[0].Name,
 		)
-	}
-
-	clientSet, err := kubernetes.NewForConfig(f.ClientConfig())
-	if err != nil {
-		framework.Logf("get clientset error %v", err)
+		if err != nil {
+			framework.Failf("failed to write to the volume of pod %s: %v, %s", po.Name, err, stdErr)
+		}
 	}
 
 	ctx := context.TODO()
-	err = wait.PollUntilContextTimeout(ctx, poll, time.Duration(deployTimeout)*time.Minute, true, func(ctx context.Context) (bool, error) {
-		dat, err := clientSet.RESTClient().
-			Get().
-			AbsPath(fmt.Sprintf(KUBELET_NODE_METRICS_URI, nodeName)).
-			DoRaw(ctx)
-		if err != nil {
-			return false, fmt.Errorf("k8s raw API request error %w", err)
-		}
-		if !strings.Contains(string(dat), "kubelet_volume_stats") {
-			return false, nil
-		}
+	for i := range podList.Items {
+		po := &podList.Items[i]
+		for _, claim := range podClaimNames(po) {
+			pvc, err := getPersistentVolumeClaim(f.ClientSet, po.Namespace, claim)
+			if err != nil {
+				framework.Failf("failed to get PVC %s of pod %s: %v", claim, po.Name, err)
+			}
 
-		scanner := bufio.NewScanner(bytes.NewReader(dat))
-		for scanner.Scan() {
-			if strings.Contains(scanner.Text(), "kubelet_volume_stats") {
-				framework.Logf(scanner.Text())
+			var lastErr error
+			err = wait.PollUntilContextTimeout(ctx, poll, time.Duration(deployTimeout)*time.Minute, true,
+				func(ctx context.Context) (bool, error) {
+					dat, err := f.ClientSet.CoreV1().RESTClient().
+						Get().
+						AbsPath(fmt.Sprintf(KUBELET_NODE_METRICS_URI, po.Spec.NodeName)).
+						DoRaw(ctx)
+					if err != nil {
+						return false, fmt.Errorf("k8s raw API request error %w", err)
+					}
+					stats, err := parseVolumeStats(dat, pvc.Namespace, pvc.Name)
+					if err != nil {
+						return false, err
+					}
+					if lastErr = validateVolumeStats(stats, pvc); lastErr != nil {
+						return false, nil
+					}
+					framework.Logf("volume stats of PVC %s on node %s: %v", pvc.Name, po.Spec.NodeName, stats)
+
+					return true, nil
+				})
+			if wait.Interrupted(err) {
+				err = lastErr
+			}
+			if err != nil {
+				framework.Failf("kubelet_volume_stats of PVC %s not reported: %v", pvc.Name, err)
 			}
 		}
-
-		return true, nil
-	})
-
-	if err != nil {
-		framework.Failf("kubelet_volume_stats metrics NOT found")
 	}
 }
 
@@ -387,18 +540,36 @@ func createCephfsStorageClass(
 	f *framework.Framework,
 	enablePool bool,
 	params map[string]string,
+) error {
+	return createCephfsStorageClassWithPolicy(c, f, enablePool, params, deletePolicy)
+}
+
+// createCephfsStorageClassWithPolicy creates the cephfs storage class with the
+// reclaim policy.
+func createCephfsStorageClassWithPolicy(
+	c kubernetes.Interface,
+	f *framework.Framework,
+	enablePool bool,
+	params map[string]string,
+	policy v1.PersistentVolumeReclaimPolicy,
 ) error {
 	scPath := "manifest/cephfs/storageclass.yaml"
 	sc, err := getStorageClass(scPath)
 	if err != nil {
 		return err
 	}
+	sc.Provisioner, err = getCephFSDriverName(c)
+	if err != nil {
+		return err
+	}
 	// TODO: remove this once the ceph-csi driver release-v3.9 is completed
 	// and upgrade tests are done from v3.9 to devel.
 	// The mountOptions from previous are not compatible with NodeStageVolume
 	// request.
-	sc.Provisioner = "rook-ceph.cephfs.csi.ceph.com"
 	sc.MountOptions = []string{}
+	if cephCSIClusterID != "" {
+		sc.Parameters["clusterID"] = cephCSIClusterID
+	}
 
 	sc.Parameters["fsName"] = defaultFileSystemName
 	sc.Parameters["csi.storage.k8s.io/provisioner-secret-namespace"] = cephCSISecretNamespace
@@ -425,7 +596,7 @@ func createCephfsStorageClass(
 		sc.Parameters[param] = value
 	}
 
-	fsID, err := getCephClusterID()
+	fsID, err := getCephClusterID(f)
 	if err != nil {
 		return fmt.Errorf("failed to get ceph clusterID: %w", err)
 	}
@@ -433,6 +604,7 @@ func createCephfsStorageClass(
 	if sc.Parameters["clusterID"] == "" {
 		sc.Parameters["clusterID"] = fsID
 	}
+	sc.ReclaimPolicy = &policy
 
 	timeout := time.Duration(deployTimeout) * time.Minute
 
@@ -470,58 +642,6 @@ func waitForPvDeleted(t int, f *framework.Framework) error {
 	})
 }
 
-func validateTestVolumeSize(pod *v1.Pod, expectSizeInMb int, f *framework.Framework) error {
-	cmd := `stat -f -c '%b' /var/lib/www/html`
-	if strings.Contains(pod.Name, "block") {
-		cmd = `lsblk -n -d -r -b |grep rbd | cut -d' ' -f4`
-	}
-	stdout, stdErr, err := execCommandInContainerByPodName(
-		f,
-		cmd,
-		pod.Namespace,
-		pod.Name,
-		pod.Spec.Containers[0].Name,
-	)
-	if err != nil {
-		framework.Failf("failed to exec cmd in pod: %v, %s", err, stdErr)
-	}
-	blocks, err := strconv.Atoi(strings.TrimSuffix(stdout, "\n"))
-	if err != nil {
-		framework.Failf("failed to convert disk total block number: %v", err)
-	}
-
-	cmd = `stat -f -c '%S' /var/lib/www/html`
-	if strings.Contains(pod.Name, "block") {
-		cmd = `lsblk -n -d -r -b |grep rbd | cut -d' ' -f4`
-	}
-	stdout, stdErr, err = execCommandInContainerByPodName(
-		f,
-		cmd,
-		pod.Namespace,
-		pod.Name,
-		pod.Spec.Containers[0].Name,
-	)
-	if err != nil {
-		framework.Failf("failed to exec cmd in pod: %v, %s", err, stdErr)
-	}
-	blockSize, err := strconv.Atoi(strings.TrimSuffix(stdout, "\n"))
-	if err != nil {
-		framework.Failf("failed to convert disk block size: %v", err)
-	}
-
-	if strings.Contains(pod.Name, "block") {
-		blocks = 1
-	}
-	diskSize := blockSize * blocks / 1024 / 1024
-
-	framework.Logf("disk size %d * %d = %dM", blockSize, blocks, diskSize)
-	if diskSize < expectSizeInMb {
-		framework.Failf("disk size %d is less than %d", diskSize, expectSizeInMb)
-	}
-
-	return nil
-}
-
 // --------------------------
 //     ceph client operation
 // --------------------------
@@ -530,15 +650,16 @@ var (
 	clusterID string
 )
 
-func getCephClusterID() (string, error) {
+func getCephClusterID(f *framework.Framework) (string, error) {
 	if clusterID != "" {
 		return clusterID, nil
 	}
 
-	fsID, err := exec.Command("ceph", "fsid").CombinedOutput()
+	fsID, err := getCephBackend(f).ClusterID()
 	if err != nil {
-		return "", fmt.Errorf("failed getting clusterID: %w", err)
+		return "", err
 	}
-	// remove new line present in fsID
-	return strings.Trim(string(fsID), "\n"), nil
+	clusterID = fsID
+
+	return clusterID, nil
 }
@@ -0,0 +1,71 @@
+package ceph_csi
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Volume metrics", Label("unit"), func() {
+	const metrics = `# HELP kubelet_volume_stats_capacity_bytes [ALPHA] Capacity in bytes of the volume
+# TYPE kubelet_volume_stats_capacity_bytes gauge
+kubelet_volume_stats_capacity_bytes{namespace="rbd-1234",persistentvolumeclaim="other-pvc"} 5.36870912e+09
+kubelet_volume_stats_capacity_bytes{namespace="rbd-1234",persistentvolumeclaim="rbd-pvc"} 1.0434699264e+09
+kubelet_volume_stats_used_bytes{persistentvolumeclaim="rbd-pvc",namespace="rbd-1234"} 2.4576e+07
+kubelet_volume_stats_used_bytes{namespace="rbd-5678",persistentvolumeclaim="rbd-pvc"} 1024
+`
+
+	newClaim := func(name string, mode v1.PersistentVolumeMode) *v1.PersistentVolumeClaim {
+		return &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "rbd-1234", Name: name},
+			Spec:       v1.PersistentVolumeClaimSpec{VolumeMode: &mode},
+			Status: v1.PersistentVolumeClaimStatus{
+				Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			},
+		}
+	}
+
+	It("should only parse the series of the PVC", func() {
+		Expect(parseVolumeStats([]byte(metrics), "rbd-1234", "rbd-pvc")).To(Equal(map[string]float64{
+			volumeStatsCapacity: 1.0434699264e+09,
+			volumeStatsUsed:     2.4576e+07,
+		}))
+		Expect(parseVolumeStats([]byte(metrics), "rbd-1234", "missing-pvc")).To(BeEmpty())
+		_, err := parseVolumeStats([]byte(`kubelet_volume_stats_used_bytes{namespace="a",persistentvolumeclaim="b"} x`), "a", "b")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should require the capacity of the PVC", func() {
+		stats, err := parseVolumeStats([]byte(metrics), "rbd-1234", "rbd-pvc")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(validateVolumeStats(stats, newClaim("rbd-pvc", v1.PersistentVolumeFilesystem))).To(Succeed())
+		Expect(validateVolumeStats(stats, newClaim("rbd-pvc", v1.PersistentVolumeBlock))).
+			To(MatchError(ContainSubstring("expected 1073741824-1077936128")))
+
+		stats, err = parseVolumeStats([]byte(metrics), "rbd-1234", "other-pvc")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(validateVolumeStats(stats, newClaim("other-pvc", v1.PersistentVolumeFilesystem))).
+			To(MatchError(ContainSubstring("is 5368709120")))
+
+		stats, err = parseVolumeStats([]byte(metrics), "rbd-5678", "rbd-pvc")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(validateVolumeStats(stats, newClaim("rbd-pvc", v1.PersistentVolumeFilesystem))).
+			To(MatchError(ContainSubstring(volumeStatsCapacity + " of PVC rbd-pvc not reported")))
+	})
+
+	It("should name the PVCs of generic ephemeral volumes after the pod", func() {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx-1"},
+			Spec: v1.PodSpec{Volumes: []v1.Volume{
+				{Name: "mypvc", VolumeSource: v1.VolumeSource{Ephemeral: &v1.EphemeralVolumeSource{}}},
+				{Name: "data", VolumeSource: v1.VolumeSource{
+					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "cephfs-pvc"},
+				}},
+				{Name: "config", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{}}},
+			}},
+		}
+		Expect(podClaimNames(pod)).To(Equal([]string{"nginx-1-mypvc", "cephfs-pvc"}))
+	})
+})